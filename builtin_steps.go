@@ -0,0 +1,357 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/sandbox"
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Registers the steps of this package in the DefaultRegistry.
+func init() {
+	for _, t := range builtinSteps {
+		Register(t)
+	}
+}
+
+var builtinSteps = []StepType{
+	{
+		Name: "env",
+		Doc:  "Copies environment variables into the KeyVal.",
+		Params: []Param{
+			{Name: "vars", Type: ParamStrings, Required: true, Doc: "names of the environment variables to copy"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			return NewEnvStep(p.Strings("vars")), nil
+		},
+	},
+	{
+		Name: "command",
+		Doc:  "Runs a Bash command, or a program with its arguments, and stores its output under \"stdout\" and \"stderr\". Its strings are templates rendered against the KeyVal, e.g. {{.archive}}, whose values reach a command in environment variables unless they go through raw.",
+		Params: []Param{
+			{Name: "name", Type: ParamString, Doc: "name of the step"},
+			{Name: "command", Type: ParamString, Doc: "shell script passed to bash -c"},
+			{Name: "args", Type: ParamStrings, Doc: "program and its arguments, run without a shell, instead of command"},
+			{Name: "dir", Type: ParamString, Doc: "working directory of the command"},
+			{Name: "env", Type: ParamStrings, Doc: "KEY=VALUE variables added to the environment of the command"},
+			{Name: "stdin", Type: ParamString, Doc: "standard input of the command"},
+			{Name: "allow_failure", Type: ParamBool, Doc: "store a non-zero exit code under \"exit_code\" instead of failing the step"},
+			{Name: "sets", Type: ParamString, Doc: "key storing whether the command exited with status 0, e.g. \"compiled\", instead of failing the step"},
+			{Name: "tests", Type: ParamString, Doc: "format of the test results stored under \"tests\", tap or junit, read from stdout or the reports; failed tests do not fail the step"},
+			{Name: "reports", Type: ParamString, Doc: "glob of the files holding the test results, relative to the directory of the command"},
+			{Name: "student", Type: ParamBool, Doc: "the command runs the student's code, so that its failure is the student's and is not retried; implied by sandbox"},
+			{Name: "max_output", Type: ParamNumber, Doc: "KiB of stdout and of stderr kept, head and tail, defaults to 1024"},
+			{Name: "log_file", Type: ParamString, Doc: "file receiving the whole output, relative to the directory of the command"},
+			{Name: "stream", Type: ParamBool, Doc: "send the first 1000 lines of the output to the status of the job as they are printed"},
+			{Name: "sandbox", Type: ParamBool, Doc: "run the command as nobody, without network or the environment of the worker, in the source directory, which is the only one it may write besides /tmp; needs root"},
+			{Name: "cpu", Type: ParamDuration, Doc: "CPU time limit of the sandbox, defaults to 1m"},
+			{Name: "memory", Type: ParamNumber, Doc: "memory limit of the sandbox in MiB, enforced by the cgroup of the step, defaults to 4096"},
+			{Name: "file_size", Type: ParamNumber, Doc: "limit on the size of files written in the sandbox in MiB, defaults to 64"},
+			{Name: "processes", Type: ParamNumber, Doc: "limit on the processes and threads of the sandbox, enforced by the cgroup of the step, defaults to 256"},
+			{Name: "network", Type: ParamBool, Doc: "keep the network in the sandbox"},
+		},
+		Check: func(p Params) error {
+			switch args := len(p.Strings("args")) > 0; {
+			case p.Has("command") && args:
+				return errors.New(`parameters "command" and "args" exclude each other`)
+			case !p.Has("command") && !args:
+				return errors.New(`missing parameter "command" or "args"`)
+			}
+			switch p.String("tests") {
+			case "", TestsTAP, TestsJUnit:
+			default:
+				return fmt.Errorf("unknown test format %q, expected %q or %q", p.String("tests"), TestsTAP, TestsJUnit)
+			}
+			if p.Has("reports") && !p.Has("tests") {
+				return errors.New(`parameter "reports" needs "tests"`)
+			}
+			// Every string is a template rendered against the KeyVal
+			texts := append([]string{p.String("command"), p.String("dir"), p.String("stdin"), p.String("log_file"), p.String("reports")}, p.Strings("args")...)
+			for _, text := range append(texts, p.Strings("env")...) {
+				if err := checkTemplate(text); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			step := NewStepFromCommand(p.String("name"), p.String("command"))
+			if args := p.Strings("args"); len(args) > 0 {
+				step = NewStepFromArgs(p.String("name"), args...)
+			}
+			step.Dir, step.Env, step.Stdin = p.String("dir"), p.Strings("env"), p.String("stdin")
+			step.Template = true
+			step.AllowFailure, step.Student = p.Bool("allow_failure"), p.Bool("student")
+			step.Sets, step.Tests, step.TestReports = p.String("sets"), p.String("tests"), p.String("reports")
+			step.MaxOutput = int(p.Number("max_output") * 1024)
+			step.LogFile, step.StreamOutput = p.String("log_file"), p.Bool("stream")
+			if !p.Bool("sandbox") {
+				return step, nil
+			}
+			box := sandbox.Default()
+			if p.Has("cpu") {
+				box.CPU = p.Duration("cpu")
+			}
+			if p.Has("memory") {
+				box.Memory = int64(p.Number("memory")) << 20
+			}
+			if p.Has("file_size") {
+				box.FileSize = int64(p.Number("file_size")) << 20
+			}
+			if p.Has("processes") {
+				box.Processes = int(p.Number("processes"))
+			}
+			box.Network = p.Bool("network")
+			step.sandbox, step.Student = box, true
+			return step, nil
+		},
+	},
+	{
+		Name: "github",
+		Doc:  "Downloads a public GitHub repo and stores the path of the source under \"archive\".",
+		Params: []Param{
+			{Name: "owner", Type: ParamString, Doc: "owner of the repo, defaults to OWNER"},
+			{Name: "repo", Type: ParamString, Doc: "name of the repo, defaults to REPO"},
+			{Name: "ref", Type: ParamString, Doc: "branch, tag, or SHA to download, defaults to SHA, else REF"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			return NewGithubStep(p.String("owner"), p.String("repo"), p.String("ref"), logger), nil
+		},
+	},
+	{
+		Name: "local",
+		Doc:  "Grades a directory on disk, storing its path under \"archive\" and a content hash under \"SHA\".",
+		Params: []Param{
+			{Name: "path", Type: ParamString, Required: true, Doc: "directory holding the source"},
+			{Name: "gitignore", Type: ParamBool, Doc: "leave out the files matched by .gitignore"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			return NewLocalSourceStep(p.String("path"), p.Bool("gitignore"), logger), nil
+		},
+	},
+	{
+		Name: "checkstyle",
+		Doc:  "Runs Checkstyle over the source and stores the report under \"checkstyle\".",
+		Params: []Param{
+			{Name: "jar", Type: ParamString, Doc: "location of the Checkstyle jar, defaults to " + DefaultCheckstyleJarLoc},
+			{Name: "src_dir", Type: ParamString, Doc: "source directory, defaults to \"archive\""},
+			{Name: "config", Type: ParamString, Doc: "Checkstyle configuration, defaults to " + DefaultCheckstyleConfigLoc},
+			{Name: "repo_base", Type: ParamString, Doc: "prefix removed from reported file names, defaults to src_dir"},
+			{Name: "text", Type: ParamBool, Doc: "use the plain text report instead of XML"},
+			{Name: "max_output", Type: ParamNumber, Doc: "KiB of the report and of stderr kept, head and tail, defaults to 1024"},
+			{Name: "log_file", Type: ParamString, Doc: "file receiving the whole output, relative to the source directory"},
+			{Name: "stream", Type: ParamBool, Doc: "send the first 1000 lines of the output to the status of the job as they are printed"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			step := NewCheckstyleStep(p.String("jar"), p.String("src_dir"), p.String("config"), p.String("repo_base"), p.Bool("text"), logger)
+			step.toolOutput = outputParams(p)
+			return step, nil
+		},
+	},
+	{
+		Name: "findbugs",
+		Doc:  "Runs FindBugs over the source and stores the report under \"findbugs\".",
+		Params: []Param{
+			{Name: "jar", Type: ParamString, Doc: "location of the FindBugs jar, defaults to " + DefaultFindBugsJarLoc},
+			{Name: "output", Type: ParamString, Doc: "file the report is written to, defaults to " + DefaultFindBugsOutputLoc},
+			{Name: "src_dir", Type: ParamString, Doc: "source directory, defaults to \"archive\""},
+			{Name: "text", Type: ParamBool, Doc: "use the plain text report instead of XML"},
+			{Name: "max_output", Type: ParamNumber, Doc: "KiB of stdout and of stderr kept, head and tail, defaults to 1024"},
+			{Name: "log_file", Type: ParamString, Doc: "file receiving the whole output, relative to the source directory"},
+			{Name: "stream", Type: ParamBool, Doc: "send the first 1000 lines of the output to the status of the job as they are printed"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			step := NewFindbugsStep(p.String("jar"), p.String("output"), p.String("src_dir"), p.Bool("text"), logger).(*findbugsStep)
+			step.toolOutput = outputParams(p)
+			return step, nil
+		},
+	},
+	{
+		Name: "comment",
+		Doc:  "Comments the Checkstyle findings on the graded commit.",
+		Params: []Param{
+			{Name: "owner", Type: ParamString, Doc: "owner of the repo, defaults to OWNER"},
+			{Name: "repo", Type: ParamString, Doc: "name of the repo, defaults to REPO"},
+			{Name: "sha", Type: ParamString, Doc: "commit to comment on, defaults to SHA"},
+			{Name: "token_env", Type: ParamString, Doc: "environment variable holding the GitHub token, defaults to GH_ACCESS_TOKEN"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			client := githubClient(p.StringOr("token_env", "GH_ACCESS_TOKEN"))
+			return NewCommentStep(p.String("owner"), p.String("repo"), p.String("sha"), client, logger), nil
+		},
+	},
+	{
+		Name: "lateness",
+		Doc:  "Computes the late penalty of the graded commit and applies it to \"score\".",
+		Params: []Param{
+			{Name: "deadline", Type: ParamTime, Required: true, Doc: "assignment deadline"},
+			{Name: "policy", Type: ParamString, Doc: "\"hard\" (default) or \"percent\""},
+			{Name: "percent", Type: ParamNumber, Doc: "percent deducted per day late by the percent policy"},
+			{Name: "grace", Type: ParamDuration, Doc: "lateness forgiven before the policy applies"},
+			{Name: "extensions", Type: ParamString, Doc: "CSV file of per-student extensions"},
+			{Name: "token_env", Type: ParamString, Doc: "environment variable holding the GitHub token used to look up the commit time"},
+		},
+		Check: func(p Params) error {
+			switch name := p.StringOr("policy", "hard"); name {
+			case "hard":
+				return nil
+			case "percent":
+				if !p.Has("percent") {
+					return errors.New(`missing parameter "percent" of the percent policy`)
+				}
+				return PercentPerDay{Percent: p.Number("percent")}.Validate()
+			default:
+				return fmt.Errorf("unknown late policy %q", name)
+			}
+		},
+		New: newLatenessStep,
+	},
+	{
+		Name: "rubric",
+		Doc:  "Grades the results of the earlier steps, storing the points under \"score\" and their breakdown under \"rubric\".",
+		Params: []Param{
+			{Name: "compiled", Type: ParamNumber, Doc: "points awarded if \"compiled\" is true, e.g. set by a command with sets: compiled"},
+			{Name: "tests", Type: ParamNumber, Doc: "points shared by the tests under \"tests\", e.g. read by a command with tests: junit, in proportion to their score"},
+			{Name: "checkstyle", Type: ParamNumber, Doc: "points awarded for the Checkstyle report, less checkstyle_deduct per finding"},
+			{Name: "checkstyle_deduct", Type: ParamNumber, Doc: "points deducted per Checkstyle finding"},
+			{Name: "findbugs", Type: ParamNumber, Doc: "points awarded for the FindBugs report, less findbugs_deduct per bug"},
+			{Name: "findbugs_deduct", Type: ParamNumber, Doc: "points deducted per FindBugs bug"},
+		},
+		Check: func(p Params) error {
+			for _, name := range []string{"compiled", "tests", "checkstyle", "checkstyle_deduct", "findbugs", "findbugs_deduct"} {
+				if p.Number(name) < 0 {
+					return fmt.Errorf("parameter %q is negative", name)
+				}
+			}
+			return nil
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			return NewRubricStep(Rubric{
+				Compiled:         p.Number("compiled"),
+				Tests:            p.Number("tests"),
+				Checkstyle:       p.Number("checkstyle"),
+				CheckstyleDeduct: p.Number("checkstyle_deduct"),
+				Findbugs:         p.Number("findbugs"),
+				FindbugsDeduct:   p.Number("findbugs_deduct"),
+			}), nil
+		},
+	},
+	{
+		Name: "gradescope",
+		Doc:  "Writes the results in Gradescope's results.json format.",
+		Params: []Param{
+			{Name: "path", Type: ParamString, Doc: "output file, defaults to " + DefaultGradescopeResultsLoc},
+			{Name: "visibility", Type: ParamString, Doc: "visibility of the results, defaults to " + DefaultGradescopeVisibility},
+			{Name: "stdout_visibility", Type: ParamString, Doc: "visibility of the autograder output, defaults to visibility"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			return NewGradescopeStep(p.String("path"), p.String("visibility"), p.String("stdout_visibility"), logger), nil
+		},
+	},
+	{
+		Name: "canvas",
+		Doc:  "Posts \"score\" and a feedback comment to a Canvas assignment.",
+		Params: []Param{
+			{Name: "base_url", Type: ParamString, Required: true, Doc: "URL of the Canvas instance"},
+			{Name: "token_env", Type: ParamString, Doc: "environment variable holding the Canvas token, defaults to CANVAS_TOKEN"},
+			{Name: "course", Type: ParamString, Required: true, Doc: "Canvas course ID"},
+			{Name: "assignment", Type: ParamString, Required: true, Doc: "Canvas assignment ID"},
+			{Name: "roster", Type: ParamString, Required: true, Doc: "CSV file with github and canvas_id columns"},
+			{Name: "dry_run", Type: ParamBool, Doc: "only log the payloads"},
+		},
+		New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+			roster, err := LoadCanvasRoster(p.String("roster"))
+			if err != nil {
+				return nil, err
+			}
+			token := os.Getenv(p.StringOr("token_env", "CANVAS_TOKEN"))
+			return NewCanvasGradeStep(p.String("base_url"), token, p.String("course"), p.String("assignment"), roster, p.Bool("dry_run"), nil, logger), nil
+		},
+	},
+	{
+		Name: "lti",
+		Doc:  "Publishes \"score\" to an LTI 1.3 line item with Assignment and Grade Services.",
+		Params: []Param{
+			{Name: "token_url", Type: ParamString, Required: true, Doc: "OAuth2 token endpoint of the platform"},
+			{Name: "client_id", Type: ParamString, Required: true, Doc: "client ID of the tool"},
+			{Name: "key_id", Type: ParamString, Doc: "ID of the tool's key in its JWKS"},
+			{Name: "key_file", Type: ParamString, Required: true, Doc: "PEM file holding the tool's RSA private key"},
+			{Name: "line_item", Type: ParamString, Required: true, Doc: "URL of the line item"},
+			{Name: "max_score", Type: ParamNumber, Required: true, Doc: "maximum score of the line item"},
+			{Name: "roster", Type: ParamString, Required: true, Doc: "CSV file with github and lti_user_id columns"},
+			{Name: "dry_run", Type: ParamBool, Doc: "only log the payloads"},
+		},
+		New: newAGSStep,
+	},
+}
+
+func newLatenessStep(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+	var (
+		deadline = p.Time("deadline")
+		policy   LatePolicy
+		ext      Extensions
+		client   *github.Client
+		err      error
+	)
+
+	switch name := p.StringOr("policy", "hard"); name {
+	case "hard":
+		policy = HardCutoff{}
+	case "percent":
+		policy = PercentPerDay{Percent: p.Number("percent")}
+	default:
+		return nil, fmt.Errorf("unknown late policy %q", name)
+	}
+	if grace := p.Duration("grace"); grace > 0 {
+		policy = GracePeriod{Grace: grace, Policy: policy}
+	}
+
+	if p.Has("extensions") {
+		if ext, err = LoadExtensions(p.String("extensions"), deadline); err != nil {
+			return nil, err
+		}
+	}
+	if p.Has("token_env") {
+		client = githubClient(p.String("token_env"))
+	}
+	return NewLatenessStep(deadline, policy, ext, client, logger), nil
+}
+
+func newAGSStep(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+	key, err := LoadRSAPrivateKey(p.String("key_file"))
+	if err != nil {
+		return nil, err
+	}
+	roster, err := LoadLTIRoster(p.String("roster"))
+	if err != nil {
+		return nil, err
+	}
+	client := NewAGSClient(p.String("token_url"), p.String("client_id"), p.String("key_id"), key, nil)
+	return NewAGSGradeStep(client, p.String("line_item"), p.Number("max_score"), roster, p.Bool("dry_run"), logger), nil
+}
+
+// githubClient authenticates to GitHub with the token in the named environment variable.
+// It sends the requests with the client of the job, see WithHTTPClient.
+func githubClient(tokenEnv string) *github.Client {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: os.Getenv(tokenEnv)},
+	)
+	base := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: contextTransport{}})
+	return github.NewClient(oauth2.NewClient(base, ts))
+}
+
+// outputParams reads the max_output, log_file and stream parameters of a Checkstyle or FindBugs step.
+func outputParams(p Params) toolOutput {
+	return toolOutput{
+		MaxOutput:    int(p.Number("max_output") * 1024),
+		LogFile:      p.String("log_file"),
+		StreamOutput: p.Bool("stream"),
+	}
+}
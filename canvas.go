@@ -0,0 +1,162 @@
+package jobs
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// PUT /api/v1/courses/:course_id/assignments/:assignment_id/submissions/:user_id
+const canvasSubmissionURL = "%s/api/v1/courses/%s/assignments/%s/submissions/%s"
+
+// CanvasRoster maps GitHub usernames to Canvas user IDs.
+type CanvasRoster map[string]string
+
+// LoadCanvasRoster reads a roster from a CSV file. See ReadCanvasRoster for the format.
+func LoadCanvasRoster(path string) (CanvasRoster, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCanvasRoster(f)
+}
+
+// ReadCanvasRoster parses a roster from CSV. The first row is a header which must
+// contain a "github" column and a "canvas_id" column.
+func ReadCanvasRoster(r io.Reader) (CanvasRoster, error) {
+	return readRoster(r, "github", "canvas_id")
+}
+
+// readRoster parses a CSV file mapping the keyCol column to the valCol column.
+func readRoster(r io.Reader, keyCol, valCol string) (map[string]string, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	roster := map[string]string{}
+	if len(rows) == 0 {
+		return roster, nil
+	}
+
+	keyIdx, valIdx := indexOf(rows[0], keyCol), indexOf(rows[0], valCol)
+	if keyIdx < 0 || valIdx < 0 {
+		return nil, fmt.Errorf("roster needs a %v and a %v column", keyCol, valCol)
+	}
+
+	for _, row := range rows[1:] {
+		key, val := strings.TrimSpace(row[keyIdx]), strings.TrimSpace(row[valIdx])
+		if key != "" && val != "" {
+			roster[key] = val
+		}
+	}
+	return roster, nil
+}
+
+// CanvasGradeStep posts the computed "score" and a feedback comment to a Canvas assignment submission.
+type CanvasGradeStep struct {
+	baseURL      string
+	token        string
+	courseID     string
+	assignmentID string
+	roster       CanvasRoster
+	dryRun       bool
+	client       *http.Client
+	log          *logrus.Logger
+	jobContext
+	pipeline.StepContext
+}
+
+// NewCanvasGradeStep creates a step which grades the student's submission to the assignment on the Canvas
+// instance at baseURL (e.g. https://canvas.instructure.com). The student is looked up in the roster by the
+// STUDENT key, falling back to OWNER. If client is nil, the client of the job is used, see WithHTTPClient. In dry-run mode the
+// payloads are only logged.
+func NewCanvasGradeStep(baseURL, token, courseID, assignmentID string, roster CanvasRoster, dryRun bool, client *http.Client, logger *logrus.Logger) *CanvasGradeStep {
+	return &CanvasGradeStep{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		token:        token,
+		courseID:     courseID,
+		assignmentID: assignmentID,
+		roster:       roster,
+		dryRun:       dryRun,
+		client:       client,
+		log:          logger,
+	}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (c *CanvasGradeStep) Exec(request *pipeline.Request) *pipeline.Result {
+	student := extractStudent(request.KeyVal)
+	userID, ok := c.roster[student]
+	if !ok {
+		c.Status("Student is missing from the Canvas roster")
+		return &pipeline.Result{Error: fmt.Errorf("no Canvas user for GitHub user %q", student)}
+	}
+
+	score, ok := extractScore(request.KeyVal)
+	if !ok {
+		return &pipeline.Result{Error: errors.New("no score has been computed")}
+	}
+
+	form := url.Values{}
+	form.Set("submission[posted_grade]", formatFloat(score))
+	if comment := feedback(request.KeyVal); comment != "" {
+		form.Set("comment[text_comment]", comment)
+	}
+	endpoint := fmt.Sprintf(canvasSubmissionURL, c.baseURL, url.PathEscape(c.courseID), url.PathEscape(c.assignmentID), url.PathEscape(userID))
+
+	if c.dryRun {
+		c.log.Infof("Dry run: PUT %v %v", endpoint, form.Encode())
+	} else if err := c.put(endpoint, form); err != nil {
+		c.Status("Failed to post the grade to Canvas")
+		return &pipeline.Result{Error: err}
+	}
+
+	nextMap := fromMap(request.KeyVal)
+	nextMap["canvas"] = form
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+func (c *CanvasGradeStep) put(endpoint string, form url.Values) error {
+	req, err := http.NewRequest(http.MethodPut, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	c.Status("Posting grade to Canvas...")
+	resp, err := httpClient(c.jobCtx(), c.client).Do(req.WithContext(c.jobCtx()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("canvas responded %v: %s", resp.Status, body)
+		if transientStatus(resp.StatusCode) {
+			return &TransientError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Cancel is a no-op
+func (c *CanvasGradeStep) Cancel() error {
+	c.Status("cancel step")
+	return nil
+}
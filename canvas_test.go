@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCanvasGradeStep(t *testing.T) {
+	const name = "test pipeline 1"
+
+	var posted = map[string]string{}
+	canvas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/api/v1/courses/101/assignments/7/submissions/4242" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		posted["grade"] = r.PostForm.Get("submission[posted_grade]")
+		posted["comment"] = r.PostForm.Get("comment[text_comment]")
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer canvas.Close()
+
+	roster, err := ReadCanvasRoster(strings.NewReader("github,canvas_id\nbob,4242\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		seed     = NewSeedStep(map[string]interface{}{"OWNER": "bob", "score": 8.5})
+		step     = NewCanvasGradeStep(canvas.URL, "secret", "101", "7", roster, false, nil, logrus.New())
+		workpipe = pipeline.New(name, 10000)
+		stage    = pipeline.NewStage(name, false, false)
+	)
+
+	stage.AddStep(seed)
+	stage.AddStep(step)
+	workpipe.AddStage(stage)
+
+	if res := workpipe.Run(); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if posted["grade"] != "8.5" {
+		t.Errorf("expected a grade of 8.5, observed %q", posted["grade"])
+	}
+	if !strings.Contains(posted["comment"], "Score: 8.5") {
+		t.Errorf("unexpected comment %q", posted["comment"])
+	}
+}
+
+func TestCanvasGradeStepDryRun(t *testing.T) {
+	canvas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("dry run should not call Canvas, observed %v %v", r.Method, r.URL)
+	}))
+	defer canvas.Close()
+
+	step := NewCanvasGradeStep(canvas.URL, "secret", "101", "7", CanvasRoster{"bob": "4242"}, true, nil, logrus.New())
+	res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{"OWNER": "bob", "score": 3.0}})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	res = step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{"OWNER": "mallory", "score": 3.0}})
+	if res.Error == nil {
+		t.Error("expected an error for a student missing from the roster")
+	}
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCanvasGradeStepJobClient(t *testing.T) {
+	canvas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer canvas.Close()
+
+	transport := &countingTransport{}
+	step := NewCanvasGradeStep(canvas.URL, "secret", "101", "7", CanvasRoster{"bob": "4242"}, false, nil, logrus.New())
+	step.SetContext(WithHTTPClient(context.Background(), &http.Client{Transport: transport}))
+	if res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{"OWNER": "bob", "score": 3.0}}); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if transport.requests != 1 {
+		t.Errorf("expected the grade to be posted with the client of the job, observed %v requests", transport.requests)
+	}
+}
@@ -0,0 +1,216 @@
+// Package cgroup places the processes of a step in a cgroup v2 of their own, so that steps share a
+// grading host fairly, and reads back the memory and CPU time they used once they finish.
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cpuPeriod is the period of cpu.max, in microseconds.
+const cpuPeriod = 100000
+
+// Limits bounds the resources of the processes of a cgroup. A zero limit leaves the resource unlimited.
+type Limits struct {
+	// Memory is memory.max, in bytes. Processes past it are killed by the OOM killer.
+	Memory int64 `json:"memory,omitempty"`
+	// CPUs is cpu.max, as a number of CPUs, e.g. 1.5.
+	CPUs float64 `json:"cpus,omitempty"`
+	// Processes is pids.max, the number of processes and threads. Forks past it fail.
+	Processes int `json:"processes,omitempty"`
+}
+
+// Usage is what the processes of a cgroup used.
+type Usage struct {
+	// MemoryPeak is the largest memory use of the processes, in bytes, from memory.peak.
+	// It is zero on kernels older than 5.19.
+	MemoryPeak int64 `json:"memory_peak"`
+	// CPU is the CPU time of the processes, from cpu.stat.
+	CPU time.Duration `json:"cpu"`
+	// OOMKills is the number of processes killed for running out of memory, from memory.events.
+	OOMKills int `json:"oom_kills,omitempty"`
+	// MemoryLimit is the memory.max the processes ran under, if any.
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+	// ForksRefused is the number of forks which failed for reaching pids.max, from pids.events.
+	ForksRefused int `json:"forks_refused,omitempty"`
+}
+
+// OOMError reports that a process was killed for using more memory than its cgroup allows.
+type OOMError struct {
+	Usage *Usage
+}
+
+func (e *OOMError) Error() string {
+	peak, limit := e.Usage.MemoryPeak, e.Usage.MemoryLimit
+	switch {
+	case peak > 0 && limit > 0:
+		return fmt.Sprintf("ran out of memory: used %v of the %v allowed", FormatBytes(peak), FormatBytes(limit))
+	case limit > 0:
+		// memory.peak is missing before Linux 5.19
+		return fmt.Sprintf("ran out of memory: used the %v allowed", FormatBytes(limit))
+	case peak > 0:
+		return fmt.Sprintf("ran out of memory after using %v", FormatBytes(peak))
+	default:
+		return "ran out of memory"
+	}
+}
+
+// Parent is the cgroup under which each step gets a cgroup of its own.
+type Parent struct {
+	path string
+	seq  uint64
+	// pids tells whether the pids controller of the children is enabled.
+	pids bool
+}
+
+// Open creates the cgroup at path if needed, e.g. /sys/fs/cgroup/alligrader, and enables the memory
+// and cpu controllers of its children, along with the pids controller if available. The cgroup above
+// it must have them enabled, and path must not hold processes itself.
+func Open(path string) (*Parent, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if err := write(path, "cgroup.subtree_control", "+memory +cpu +pids"); err == nil {
+		return &Parent{path: path, pids: true}, nil
+	}
+	if err := write(path, "cgroup.subtree_control", "+memory +cpu"); err != nil {
+		return nil, fmt.Errorf("enabling the memory and cpu controllers of %v: %v", path, err)
+	}
+	return &Parent{path: path}, nil
+}
+
+// New creates a child cgroup with the limits.
+func (p *Parent) New(limits Limits) (*Group, error) {
+	if limits.Processes > 0 && !p.pids {
+		return nil, fmt.Errorf("cannot limit the processes: the pids controller is not available under %v", p.path)
+	}
+	name := fmt.Sprintf("step-%d-%d", os.Getpid(), atomic.AddUint64(&p.seq, 1))
+	g := &Group{path: filepath.Join(p.path, name), limits: limits}
+	if err := os.Mkdir(g.path, 0755); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if limits.Memory > 0 {
+		err = write(g.path, "memory.max", strconv.FormatInt(limits.Memory, 10))
+		// Without swap, memory.max is the memory the processes can use
+		write(g.path, "memory.swap.max", "0")
+	}
+	if err == nil && limits.CPUs > 0 {
+		err = write(g.path, "cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod))
+	}
+	if err == nil && limits.Processes > 0 {
+		err = write(g.path, "pids.max", strconv.Itoa(limits.Processes))
+	}
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// Group is the cgroup of a step.
+type Group struct {
+	path   string
+	limits Limits
+}
+
+// Path returns the path of the cgroup.
+func (g *Group) Path() string {
+	return g.path
+}
+
+// Add moves the process into the cgroup. The children it starts afterwards are in the cgroup too,
+// but not those it started before: start the process in the cgroup instead where it forks right away.
+func (g *Group) Add(pid int) error {
+	return write(g.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Usage reads what the processes of the cgroup used so far.
+func (g *Group) Usage() (*Usage, error) {
+	usage := &Usage{MemoryLimit: g.limits.Memory}
+
+	if blob, err := ioutil.ReadFile(filepath.Join(g.path, "memory.peak")); err == nil {
+		usage.MemoryPeak, _ = strconv.ParseInt(strings.TrimSpace(string(blob)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	stat, err := readKeyed(filepath.Join(g.path, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	usage.CPU = time.Duration(stat["usage_usec"]) * time.Microsecond
+
+	events, err := readKeyed(filepath.Join(g.path, "memory.events"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	usage.OOMKills = int(events["oom_kill"])
+
+	pids, err := readKeyed(filepath.Join(g.path, "pids.events"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	usage.ForksRefused = int(pids["max"])
+	return usage, nil
+}
+
+// Close kills the processes left in the cgroup, then removes it.
+func (g *Group) Close() error {
+	// cgroup.kill is only found on kernels 5.14 and later
+	write(g.path, "cgroup.kill", "1")
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(g.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		// The killed processes take a moment to leave
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
+
+func write(dir, file, content string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644)
+}
+
+// readKeyed reads a file of "key value" lines, such as cpu.stat.
+func readKeyed(path string) (map[string]int64, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]int64{}
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// FormatBytes formats a size for people, e.g. "2.1 GB".
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,120 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(blob)
+}
+
+// TestGroup runs against a directory laid out like a cgroup, to check the files read and written.
+func TestGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parent, err := Open(filepath.Join(dir, "alligrader"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controllers := readFile(t, filepath.Join(dir, "alligrader", "cgroup.subtree_control")); controllers != "+memory +cpu +pids" {
+		t.Errorf("expected the memory, cpu and pids controllers to be enabled, observed %q", controllers)
+	}
+
+	group, err := parent.New(Limits{Memory: 256 << 20, CPUs: 1.5, Processes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{"memory.max": "268435456", "cpu.max": "150000 100000", "pids.max": "64"} {
+		if observed := readFile(t, filepath.Join(group.Path(), file)); observed != expected {
+			t.Errorf("expected %v to be %q, observed %q", file, expected, observed)
+		}
+	}
+	if err := group.Add(42); err != nil {
+		t.Fatal(err)
+	}
+	if procs := readFile(t, filepath.Join(group.Path(), "cgroup.procs")); procs != "42" {
+		t.Errorf("expected the process to be added, observed %q", procs)
+	}
+
+	for file, content := range map[string]string{
+		"memory.peak":   "2147483648\n",
+		"cpu.stat":      "usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n",
+		"memory.events": "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"pids.events":   "max 2\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(group.Path(), file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage, err := group.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Usage{MemoryPeak: 2 << 30, CPU: 1500 * time.Millisecond, OOMKills: 1, MemoryLimit: 256 << 20, ForksRefused: 2}
+	if *usage != expected {
+		t.Errorf("expected %+v, observed %+v", expected, *usage)
+	}
+	for usage, expected := range map[Usage]string{
+		*usage:                   "ran out of memory: used 2.1 GB of the 268.4 MB allowed",
+		{MemoryLimit: 256 << 20}: "ran out of memory: used the 268.4 MB allowed",
+		{MemoryPeak: 2 << 30}:    "ran out of memory after using 2.1 GB",
+		{}:                       "ran out of memory",
+	} {
+		if msg := (&OOMError{Usage: &usage}).Error(); msg != expected {
+			t.Errorf("expected %q, observed %q", expected, msg)
+		}
+	}
+}
+
+// TestCgroup runs a command in a real cgroup, where the memory and cpu controllers are delegated to the tests.
+func TestCgroup(t *testing.T) {
+	controllers, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.subtree_control")
+	if err != nil || !strings.Contains(string(controllers), "memory") || !strings.Contains(string(controllers), "cpu") {
+		t.Skip("no cgroup v2 with the memory and cpu controllers at /sys/fs/cgroup")
+	}
+	path := filepath.Join("/sys/fs/cgroup", "alligrader-test")
+	parent, err := Open(path)
+	if err != nil {
+		t.Skipf("cannot create cgroups here: %v", err)
+	}
+	defer os.Remove(path)
+
+	group, err := parent.New(Limits{Memory: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+
+	// Hold 128 MB in a pipe buffer of tail, which the memory limit kills
+	cmd := exec.Command("sh", "-c", "head -c 128000000 /dev/zero | tail -c 128000000 > /dev/null")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Add(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("expected the command to run out of memory")
+	}
+	usage, err := group.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.OOMKills == 0 || usage.CPU == 0 {
+		t.Errorf("expected an OOM kill and some CPU time, observed %+v", usage)
+	}
+}
@@ -1,7 +1,6 @@
 package jobs
 
 import (
-	"bytes"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -13,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/cgroup"
 	"github.com/sirupsen/logrus"
 )
 
@@ -74,79 +74,54 @@ func (checkstyle *CheckstyleStep) setSrcDir(request *pipeline.Request) error {
 	return nil
 }
 
-func (checkstyle *CheckstyleStep) launchCmd() (*Checkstyle, error) {
+func (checkstyle *CheckstyleStep) launchCmd() (check *Checkstyle, err error) {
 
 	log := checkstyle.log
 	cmd := checkstyle.Cmd()
-	stdout, stderr, err := checkstyle.captureOutput(cmd)
+	span := startCmdSpan(checkstyle.jobCtx(), "checkstyle", cmd.Args)
+	defer func() { endCmdSpan(span, cmd, err) }()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Warn("Could not collect stdout/stderr")
+		log.Warn("Could not collect stdout")
 		return nil, err
 	}
-	tee, stream2 := checkstyle.teeStream(stdout)
+	// Keep what is needed to debug a failure, however much Checkstyle prints
+	report, stderr, done, err := checkstyle.outputs(checkstyle.srcDir, checkstyle.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	cmd.Stderr = stderr
 
 	if err = checkstyle.startCmd(cmd); err != nil {
 		return nil, err
 	}
 
-	var check = &Checkstyle{}
-	if err = xml.NewDecoder(tee).Decode(&check); err != nil {
+	check = &Checkstyle{}
+	if err = xml.NewDecoder(io.TeeReader(stdout, report)).Decode(&check); err != nil {
 		log.Warn("Decoding failed!")
-		log.Warn("Dumping Stdout")
-		dumpStream(stream2, log)
-		log.Warn("Dumping Stderr")
-		dumpStream(stderr, log)
+		// Drain stdout so that Checkstyle can exit
+		io.Copy(report, stdout)
+		if checkstyle.procs.wait() == ErrCancelled {
+			return nil, ErrCancelled
+		}
+		log.Warnf("Stdout is: %v", report)
+		log.Warnf("Stderr is: %v", stderr)
 		return nil, err
 	}
 
-	if err = cmd.Wait(); err != nil {
+	if err = checkstyle.procs.wait(); err != nil {
 		checkstyle.log.Warn("Failed to wait for command completion")
+		checkstyle.log.Warnf("Stderr is: %v", stderr)
 		return nil, err
-		// Do not call Fatal because we need to dump stderr first.
 	}
 
 	checkstyle.log.Info("Program has finished running")
-	if err != nil {
-		log.Info("Dumping STDOUT")
-		dumpStream(stream2, log)
-		log.Info("Dumping STDERR")
-		dumpStream(stderr, log)
-		return nil, err
-	}
-
 	checkstyle.listFiles()
 	checkstyle.log.Info("Completed the marshalling of the Checkstyle struct.")
 	return check, err
 }
 
-func dumpStream(stream io.Reader, log *logrus.Logger) {
-	b, err := ioutil.ReadAll(stream)
-	if err != nil {
-		log.Warn(err)
-	}
-
-	log.Infof("Stdout is: %s", b)
-}
-
-func (checkstyle *CheckstyleStep) teeStream(stream io.Reader) (io.Reader, io.Reader) {
-	var buffer bytes.Buffer
-	var tee = io.TeeReader(stream, &buffer)
-	return tee, stream
-}
-
-func (checkstyle *CheckstyleStep) captureOutput(cmd *exec.Cmd) (io.ReadCloser, io.ReadCloser, error) {
-	stdout, err1 := cmd.StdoutPipe()
-	stderr, err2 := cmd.StderrPipe()
-
-	if err1 != nil {
-		return nil, nil, err1
-	}
-	if err2 != nil {
-		return nil, nil, err2
-	}
-	return stdout, stderr, nil
-}
-
 // TODO delete, only used for debugging purposes.
 func (checkstyle *CheckstyleStep) listFiles() {
 	files, err := ioutil.ReadDir(checkstyle.srcDir)
@@ -162,7 +137,7 @@ func (checkstyle *CheckstyleStep) listFiles() {
 }
 
 func (checkstyle *CheckstyleStep) startCmd(cmd *exec.Cmd) error {
-	if err := cmd.Start(); err != nil {
+	if err := checkstyle.procs.start(checkstyle.jobCtx(), cmd, cgroup.Limits{}); err != nil {
 		checkstyle.log.Warn("Failed to start the command")
 		return err
 	}
@@ -187,6 +162,7 @@ func (checkstyle *CheckstyleStep) Exec(request *pipeline.Request) *pipeline.Resu
 
 	nextMap := fromMap(request.KeyVal)
 	nextMap["checkstyle"] = check
+	recordUsage(nextMap, "checkstyle", checkstyle.procs.usage)
 
 	return &pipeline.Result{
 		Error:  err,
@@ -233,26 +209,17 @@ func (checkstyle *CheckstyleStep) serialize(blob string) (*Checkstyle, error) {
 	return &check, err
 }
 
-// Cancel will cancel the step. Does nothing.
-// Could be rewritten to kill the subprocess
+// Cancel stops Checkstyle along with its JVM. See CommandStep.Cancel.
 func (checkstyle *CheckstyleStep) Cancel() error {
 	checkstyle.Status("Cancel")
-	return nil
+	return checkstyle.procs.cancel()
 }
 
 // Cmd returns a *exec.Cmd configued to run Checkstyle over the source code referenced in the CheckstyleStep struct.
 func (checkstyle *CheckstyleStep) Cmd() *exec.Cmd {
-	var strTmpl = cmdTmplCheckstyle
-
+	args := []string{"-c", checkstyle.checkLoc, "-f", "xml", checkstyle.srcDir}
 	if checkstyle.text {
-		strTmpl = cmdTmplCheckstyleText
+		args = []string{"-c", checkstyle.checkLoc, checkstyle.srcDir}
 	}
-	cmd := fmt.Sprintf(
-		strTmpl,
-		checkstyle.jarLoc,
-		checkstyle.checkLoc,
-		checkstyle.srcDir,
-	)
-
-	return exec.Command("bash", "-c", cmd)
+	return javaCommand(checkstyle.jarLoc, args...)
 }
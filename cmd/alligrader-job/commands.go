@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/alligrader/jobs"
+)
+
+func validateCmd(args []string, stdout, stderr io.Writer) int {
+	var (
+		flags  = flag.NewFlagSet("validate", flag.ContinueOnError)
+		asJSON = flags.Bool("json", false, "print the outcome as JSON")
+	)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: alligrader-job validate [-json] <spec>")
+		return exitUsage
+	}
+
+	_, err := jobs.LoadJobSpec(flags.Arg(0))
+	if *asJSON {
+		outcome := struct {
+			Valid bool   `json:"valid"`
+			Error string `json:"error,omitempty"`
+		}{Valid: err == nil}
+		if err != nil {
+			outcome.Error = err.Error()
+		}
+		writeJSON(stdout, outcome)
+	} else if err != nil {
+		fmt.Fprintln(stderr, err)
+	} else {
+		fmt.Fprintf(stdout, "%v is valid\n", flags.Arg(0))
+	}
+
+	if err != nil {
+		return exitUsage
+	}
+	return exitOK
+}
+
+func listStepsCmd(args []string, stdout, stderr io.Writer) int {
+	var (
+		flags  = flag.NewFlagSet("list-steps", flag.ContinueOnError)
+		asJSON = flags.Bool("json", false, "print the step types as JSON")
+	)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	types := jobs.DefaultRegistry.List()
+	if *asJSON {
+		writeJSON(stdout, types)
+		return exitOK
+	}
+	for _, t := range types {
+		fmt.Fprintln(stdout, t.Usage())
+		fmt.Fprintln(stdout)
+	}
+	return exitOK
+}
+
+func reportCmd(args []string, stdout, stderr io.Writer) int {
+	var (
+		flags  = flag.NewFlagSet("report", flag.ContinueOnError)
+		asJSON = flags.Bool("json", false, "print a summary of the results as JSON")
+	)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: alligrader-job report [-json] <results.json>")
+		return exitUsage
+	}
+
+	blob, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	results, err := readResults(blob)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v: %v\n", flags.Arg(0), err)
+		return exitUsage
+	}
+
+	if *asJSON {
+		summary := struct {
+			Score  *float64 `json:"score"`
+			Passed int      `json:"passed"`
+			Failed int      `json:"failed"`
+		}{Score: results.Score}
+		for _, test := range results.Tests {
+			if test.Status == "failed" {
+				summary.Failed++
+			} else {
+				summary.Passed++
+			}
+		}
+		writeJSON(stdout, summary)
+		return exitOK
+	}
+
+	renderResults(stdout, results)
+	return exitOK
+}
+
+// readResults decodes either a Gradescope results.json or a report written by 'run -o'.
+func readResults(blob []byte) (*jobs.GradescopeResults, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["job"]; ok {
+		var report jobReport
+		if err := json.Unmarshal(blob, &report); err != nil {
+			return nil, err
+		}
+		if report.Results == nil {
+			report.Results = &jobs.GradescopeResults{}
+		}
+		return report.Results, nil
+	}
+
+	var results jobs.GradescopeResults
+	err := json.Unmarshal(blob, &results)
+	return &results, err
+}
+
+// renderResults prints the results the way a student would read them.
+func renderResults(w io.Writer, results *jobs.GradescopeResults) {
+	if results == nil {
+		return
+	}
+	if results.Score != nil {
+		fmt.Fprintf(w, "Score: %v\n", *results.Score)
+	}
+	if results.Output != "" {
+		fmt.Fprintln(w, results.Output)
+	}
+
+	for _, test := range results.Tests {
+		status := test.Status
+		if status == "" {
+			status = "done"
+		}
+		line := fmt.Sprintf("[%v] %v", status, test.Name)
+		if test.Score != nil && test.MaxScore != nil {
+			line += fmt.Sprintf(" (%v/%v)", *test.Score, *test.MaxScore)
+		}
+		fmt.Fprintln(w, line)
+		if test.Output != "" {
+			fmt.Fprintln(w, "    "+strings.Replace(test.Output, "\n", "\n    ", -1))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Command alligrader-job runs and inspects autograder jobs described by job spec files.
+//
+// Usage:
+//
+//	alligrader-job run [flags] <spec>          run a job against a local path or a GitHub repo
+//	alligrader-job validate [-json] <spec>     check a job spec without running it
+//	alligrader-job list-steps [-json]          list the step types a spec can use
+//	alligrader-job report [-json] <results>    render a stored results.json
+//	alligrader-job serve [flags]               grade the pushes announced by GitHub webhooks
+//
+// The exit status tells apart a submission which failed grading from a failure of the grader itself:
+// 0 on success, 1 if the student's submission failed or timed out, 2 on an infrastructure failure,
+// and 3 on bad usage or an invalid spec.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alligrader/jobs/sandbox"
+)
+
+const (
+	exitOK             = 0
+	exitStudentFailure = 1
+	exitInfraFailure   = 2
+	exitUsage          = 3
+)
+
+const usage = `usage: alligrader-job <command> [flags] [args]
+
+commands:
+  run <spec>          run a job against a local path or a GitHub repo
+  validate <spec>     check a job spec without running it
+  list-steps          list the step types a spec can use
+  report <results>    render a stored results.json
+  serve               grade the pushes announced by GitHub webhooks
+
+Run 'alligrader-job <command> -h' for the flags of a command.
+`
+
+func main() {
+	// Sandboxed commands are started through this binary
+	sandbox.Init()
+	os.Exit(realMain(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func realMain(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "run":
+		return runCmd(args[1:], stdout, stderr)
+	case "validate":
+		return validateCmd(args[1:], stdout, stderr)
+	case "list-steps":
+		return listStepsCmd(args[1:], stdout, stderr)
+	case "report":
+		return reportCmd(args[1:], stdout, stderr)
+	case "serve":
+		return serveCmd(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n%v", args[0], usage)
+		return exitUsage
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSpec(t *testing.T, dir, command string) string {
+	spec := "name: cli test\nstages:\n  - name: run\n    steps:\n      - type: command\n        params: {command: '" + command + "', student: true}\n"
+	path := filepath.Join(dir, "job.yml")
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alligrader-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cases = []struct {
+		command string
+		flags   []string
+		code    int
+		status  string
+	}{
+		{"echo graded", nil, exitOK, "passed"},
+		{"exit 3", nil, exitStudentFailure, "student_failure"},
+		{"sleep 30", []string{"-timeout", "200ms"}, exitStudentFailure, "timeout"},
+	}
+
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		args := append(append([]string{"run", "-json"}, c.flags...), writeSpec(t, dir, c.command))
+		code := realMain(args, &stdout, &stderr)
+		if code != c.code {
+			t.Errorf("%q: expected exit code %v, observed %v (%v)", c.command, c.code, code, stderr.String())
+		}
+
+		var report jobReport
+		if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status != c.status {
+			t.Errorf("%q: expected status %v, observed %v", c.command, c.status, report.Status)
+		}
+	}
+}
+
+func TestRunTraceJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alligrader-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stdout, stderr bytes.Buffer
+	if code := realMain([]string{"run", "-json", "-trace", "-", writeSpec(t, dir, "echo graded")}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("expected exit code %v for spans on the standard output of the JSON report, observed %v", exitUsage, code)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected nothing on the standard output, observed %q", stdout.String())
+	}
+}
+
+func TestRunFetchUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alligrader-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := writeSpec(t, dir, "echo graded")
+	for _, args := range [][]string{
+		{"-owner", "alligrader", "-ref", "master"},
+		{"-owner", "alligrader", "-repo", "TestRepo"},
+		{"-owner", "alligrader", "-repo", "TestRepo", "-ref", "master", "-path", dir},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := realMain(append(append([]string{"run"}, args...), spec), &stdout, &stderr); code != exitUsage {
+			t.Errorf("%q: expected exit code %v, observed %v", args, exitUsage, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alligrader-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bad := filepath.Join(dir, "bad.yml")
+	ioutil.WriteFile(bad, []byte("name: bad\nstages: [{name: a, steps: [{type: nope}]}]"), 0644)
+
+	var stdout, stderr bytes.Buffer
+	if code := realMain([]string{"validate", writeSpec(t, dir, "true")}, &stdout, &stderr); code != exitOK {
+		t.Errorf("expected a valid spec, observed %v", stderr.String())
+	}
+	if code := realMain([]string{"validate", "-json", bad}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("expected exit code %v for an invalid spec, observed %v", exitUsage, code)
+	}
+	if !strings.Contains(stdout.String(), `"valid": false`) {
+		t.Errorf("unexpected output %v", stdout.String())
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alligrader-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "results.json")
+	results := `{"score": 7, "tests": [{"name": "adds", "score": 2, "max_score": 2, "status": "passed"}, {"name": "Checkstyle", "status": "failed", "output": "1 problems found:\nMain.java:3: no"}]}`
+	ioutil.WriteFile(path, []byte(results), 0644)
+
+	var stdout, stderr bytes.Buffer
+	if code := realMain([]string{"report", path}, &stdout, &stderr); code != exitOK {
+		t.Fatal(stderr.String())
+	}
+	for _, expected := range []string{"Score: 7", "[passed] adds (2/2)", "[failed] Checkstyle", "    Main.java:3: no"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("expected %q in the report:\n%v", expected, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// jobReport is the machine-readable outcome of a run.
+type jobReport struct {
+	Job      string                  `json:"job"`
+	Status   string                  `json:"status"`
+	Error    string                  `json:"error,omitempty"`
+	Duration float64                 `json:"duration_seconds"`
+	Results  *jobs.GradescopeResults `json:"results"`
+	KeyVal   map[string]interface{}  `json:"keyval"`
+}
+
+// keyValFlag collects repeated -set KEY=VALUE flags.
+type keyValFlag map[string]interface{}
+
+func (kv keyValFlag) String() string {
+	return fmt.Sprint(map[string]interface{}(kv))
+}
+
+func (kv keyValFlag) Set(str string) error {
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected KEY=VALUE, found %q", str)
+	}
+	kv[parts[0]] = parts[1]
+	return nil
+}
+
+func runCmd(args []string, stdout, stderr io.Writer) int {
+	var (
+		flags   = flag.NewFlagSet("run", flag.ContinueOnError)
+		keyVal  = keyValFlag{}
+		path    = flags.String("path", "", "grade a copy of the source in this directory instead of fetching it")
+		ignore  = flags.Bool("gitignore", false, "leave out the files of -path matched by .gitignore")
+		owner   = flags.String("owner", "", "owner of the GitHub repo to fetch and grade (sets OWNER)")
+		repo    = flags.String("repo", "", "name of the GitHub repo to fetch and grade (sets REPO)")
+		ref     = flags.String("ref", "", "ref of the GitHub repo to fetch (sets REF, and SHA unless -sha is given)")
+		sha     = flags.String("sha", "", "SHA of the commit to fetch (sets SHA)")
+		asJSON  = flags.Bool("json", false, "print a JSON report instead of text")
+		output  = flags.String("o", "", "also write the JSON report to this file")
+		trace   = flags.String("trace", "", "export a trace of the run: \"otlp\", \"-\" for stdout, or a file")
+		timeout = flags.Duration("timeout", 0, "limit the run to this duration, instead of the timeout of the spec")
+		cgroups = flags.String("cgroup", "", "run the commands of every step in a cgroup v2 of their own under this one")
+		memory  = flags.Int64("step-memory", 0, "memory limit of the cgroup of a step in MiB, 0 for none")
+		cpus    = flags.Float64("step-cpus", 0, "CPUs the cgroup of a step may use, 0 for no limit")
+		verbose = flags.Bool("v", false, "log the details of every step")
+	)
+	flags.Var(keyVal, "set", "set KEY=VALUE in the KeyVal before the job starts (repeatable)")
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: alligrader-job run [flags] <spec>")
+		return exitUsage
+	}
+	if *asJSON && *trace == tracing.Stdout {
+		fmt.Fprintln(stderr, "-trace - would mix the spans with the JSON report on the standard output, trace to a file instead")
+		return exitUsage
+	}
+
+	spec, err := jobs.LoadJobSpec(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	for key, val := range map[string]string{"OWNER": *owner, "REPO": *repo, "REF": *ref, "SHA": *ref} {
+		if val != "" {
+			keyVal[key] = val
+		}
+	}
+	if *sha != "" {
+		keyVal["SHA"] = *sha
+	}
+	fetch := *owner != "" || *repo != ""
+	if _, ok := keyVal["SHA"]; fetch && (*owner == "" || *repo == "" || !ok || *path != "") {
+		fmt.Fprintln(stderr, "-owner and -repo fetch a GitHub repo at -ref or -sha, instead of -path")
+		return exitUsage
+	}
+
+	logger := logrus.New()
+	logger.Out = stderr
+	logger.Level = logrus.WarnLevel
+	if *verbose {
+		logger.Level = logrus.DebugLevel
+	}
+
+	var setup []pipeline.Step
+	if len(keyVal) > 0 {
+		setup = append(setup, jobs.NewSeedStep(keyVal))
+	}
+	if *path != "" {
+		source := jobs.NewLocalSourceStep(*path, *ignore, logger)
+		defer source.Cleanup()
+		setup = append(setup, source)
+	}
+	if fetch {
+		// Fetches the OWNER, REPO and SHA seeded above
+		source := jobs.NewGithubStep("", "", "", logger)
+		defer source.Cleanup()
+		setup = append(setup, source)
+	}
+
+	var client *http.Client
+	if *trace != "" {
+		shutdown, err := tracing.Start(context.Background(), *trace)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitInfraFailure
+		}
+		defer shutdown(context.Background())
+		client = &http.Client{Transport: tracing.InstrumentTransport(http.DefaultTransport)}
+	}
+	if *timeout == 0 {
+		*timeout = spec.Timeout
+	}
+	ctx, cancel := jobs.WithJobTimeout(context.Background(), *timeout)
+	defer cancel()
+	if *cgroups != "" {
+		parent, err := cgroup.Open(*cgroups)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitInfraFailure
+		}
+		ctx = jobs.WithCgroup(ctx, parent, cgroup.Limits{Memory: *memory << 20, CPUs: *cpus})
+	}
+	if client != nil {
+		ctx = jobs.WithHTTPClient(ctx, client)
+	}
+	jobTrace := tracing.StartJob(ctx, spec.Name, keyVal)
+
+	workpipe, err := spec.WrappedPipeline(logger, jobTrace.Wrap, setup...)
+	if err != nil {
+		jobTrace.End(err)
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	start := time.Now()
+	res := jobs.RunContext(ctx, workpipe, func(line string) {
+		fmt.Fprintln(stderr, line)
+	})
+	if res != nil {
+		jobTrace.End(res.Error)
+	} else {
+		jobTrace.End(fmt.Errorf("pipeline returned no result"))
+	}
+
+	report, code := newJobReport(spec.Name, res, time.Since(start))
+	if *output != "" {
+		blob, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*output, blob, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitInfraFailure
+		}
+	}
+
+	if *asJSON {
+		writeJSON(stdout, report)
+		return code
+	}
+
+	fmt.Fprintf(stdout, "%v: %v (%.1fs)\n", report.Job, report.Status, report.Duration)
+	if report.Error != "" {
+		fmt.Fprintf(stdout, "error: %v\n", report.Error)
+	}
+	renderResults(stdout, report.Results)
+	return code
+}
+
+func newJobReport(name string, res *pipeline.Result, elapsed time.Duration) (*jobReport, int) {
+	report := &jobReport{
+		Job:      name,
+		Status:   "passed",
+		Duration: elapsed.Seconds(),
+		KeyVal:   map[string]interface{}{},
+	}
+	if res == nil {
+		report.Status = "infra_failure"
+		report.Error = "pipeline returned no result"
+		return report, exitInfraFailure
+	}
+
+	report.Results = jobs.NewGradescopeResults(res.KeyVal)
+	for key, val := range res.KeyVal {
+		// Keep what serializes, and describe what does not
+		if _, err := json.Marshal(val); err != nil {
+			val = fmt.Sprint(val)
+		}
+		report.KeyVal[key] = val
+	}
+
+	code := exitOK
+	if res.Error != nil {
+		report.Error = res.Error.Error()
+		report.Status, code = "infra_failure", exitInfraFailure
+		switch {
+		case jobs.IsStudentError(res.Error):
+			report.Status, code = "student_failure", exitStudentFailure
+		case jobs.IsTimeout(res.Error):
+			report.Status, code = "timeout", exitStudentFailure
+		}
+	}
+	return report, code
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/metrics"
+	"github.com/alligrader/jobs/queue"
+	"github.com/alligrader/jobs/status"
+	"github.com/alligrader/jobs/tracing"
+	"github.com/alligrader/jobs/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+func serveCmd(args []string, stdout, stderr io.Writer) int {
+	var (
+		flags     = flag.NewFlagSet("serve", flag.ContinueOnError)
+		addr      = flags.String("addr", ":8080", "address to listen on for webhooks")
+		adminAddr = flags.String("admin-addr", "localhost:8081", "address to listen on for the history of the runs, the state of the jobs and the metrics")
+		routes    = flags.String("routes", "routes.yml", "file mapping repos to job specs")
+		dbPath    = flags.String("db", "queue.db", "file holding the job queue")
+		histPath  = flags.String("history", "history.db", "file holding the record of every run")
+		workers   = flags.Int("workers", 4, "number of jobs run at once")
+		attempts  = flags.Int("attempts", queue.DefaultMaxAttempts, "number of runs of a job failing from infrastructure errors")
+		timeout   = flags.Duration("timeout", 30*time.Minute, "limit on the runs of jobs whose spec sets no timeout")
+		secretEnv = flags.String("secret-env", "WEBHOOK_SECRET", "environment variable holding the webhook secret")
+		traceDest = flags.String("trace", "", "export a trace of every run: \"otlp\", \"-\" for stdout, or a file")
+		cgroupDir = flags.String("cgroup", "", "run the commands of every step in a cgroup v2 of their own under this one")
+		memory    = flags.Int64("step-memory", 0, "memory limit of the cgroup of a step in MiB, 0 for none")
+		cpus      = flags.Float64("step-cpus", 0, "CPUs the cgroup of a step may use, 0 for no limit")
+		verbose   = flags.Bool("v", false, "log the details of every step")
+	)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	secret := os.Getenv(*secretEnv)
+	if secret == "" {
+		fmt.Fprintf(stderr, "%v is not set\n", *secretEnv)
+		return exitUsage
+	}
+	table, err := webhook.LoadRoutes(*routes)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	logger := logrus.New()
+	logger.Out = stderr
+	if *verbose {
+		logger.Level = logrus.DebugLevel
+	}
+
+	q, err := queue.OpenBoltQueue(*dbPath, logger)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInfraFailure
+	}
+	defer q.Close()
+	q.MaxAttempts = *attempts
+
+	store, err := history.OpenBoltStore(*histPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInfraFailure
+	}
+	defer store.Close()
+
+	// Count the requests of every step to GitHub and other APIs
+	measure := metrics.New()
+	transport := measure.InstrumentTransport(http.DefaultTransport)
+	if err := measure.WatchQueue(q); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInfraFailure
+	}
+
+	if *traceDest != "" {
+		shutdown, err := tracing.Start(context.Background(), *traceDest)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitInfraFailure
+		}
+		defer shutdown(context.Background())
+		transport = tracing.InstrumentTransport(transport)
+	}
+
+	hub := status.NewHub()
+	runner := queue.NewRunner(store, logger)
+	runner.Observers = append(runner.Observers, hub, measure)
+	runner.Wrap = measure.Wrap
+	runner.Timeout = *timeout
+	runner.Client = &http.Client{Transport: transport}
+	if *cgroupDir != "" {
+		if runner.Cgroups, err = cgroup.Open(*cgroupDir); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitInfraFailure
+		}
+		runner.Limits = cgroup.Limits{Memory: *memory << 20, CPUs: *cpus}
+	}
+	pool := queue.NewPool(q, runner.Run, *workers, logger)
+	pool.MaxAttempts = *attempts
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", webhook.NewServer([]byte(secret), table, q, logger))
+	server := &http.Server{Addr: *addr, Handler: mux}
+
+	// The history and the jobs hold the grades and logs of every student, and the metrics name the
+	// assignments: keep them off the public listener
+	admin := http.NewServeMux()
+	runs := history.NewHandler(store, logger)
+	admin.Handle("/runs", runs)
+	admin.Handle("/runs/", runs)
+	jobStatus := status.NewHandler(hub, q, store, logger)
+	admin.Handle("/jobs", jobStatus)
+	admin.Handle("/jobs/", jobStatus)
+	admin.Handle("/metrics", measure.Handler())
+	adminServer := &http.Server{Addr: *adminAddr, Handler: admin}
+
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Info("Shutting down, waiting for the running jobs...")
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+		adminServer.Shutdown(shutdown)
+		stop()
+	}()
+
+	workersDone := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(workersDone)
+	}()
+
+	adminErrs := make(chan error, 1)
+	go func() {
+		logger.Infof("Listening for admin requests on %v", *adminAddr)
+		err := adminServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			server.Close()
+		}
+		adminErrs <- err
+	}()
+
+	logger.Infof("Listening for webhooks on %v/webhook", *addr)
+	code := exitOK
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error(err)
+		code = exitInfraFailure
+		adminServer.Close()
+		stop()
+	}
+	if err := <-adminErrs; err != http.ErrServerClosed {
+		logger.Error(err)
+		code = exitInfraFailure
+	}
+	<-workersDone
+	return code
+}
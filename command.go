@@ -2,48 +2,332 @@ package jobs
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/sandbox"
 )
 
-// CommandStep is a pipeline step for running a given string as a Bash command.
+// CommandStep is a pipeline step for running a given string as a Bash command, or a program with its arguments.
 // Make a function that takes a command and returns a pipeline.Step from the string.
+//
+// With Template, the command, its arguments, and the Dir, Env, Stdin and LogFile of the step are Go templates
+// rendered against the KeyVal of the request, e.g. "javac -d build {{.archive}}/*.java". A key missing from
+// the KeyVal fails the step. In a Bash command, every value is passed in an environment variable which the
+// command references as a single word, e.g. "${ALLIGRADER_VALUE_1}", so that Bash never parses it, unless
+// it goes through raw, e.g. {{raw .flags}}. Elsewhere, the function quote quotes a value for Bash.
 type CommandStep struct {
-	name string
-	cmd  *exec.Cmd
+	// Template renders the command and the strings of the step against the KeyVal, see above.
+	// Steps built from a spec set it.
+	Template bool
+	// Dir is the working directory of the command, by default that of the step's process.
+	Dir string
+	// Env holds KEY=VALUE variables added to the environment of the command. A sandboxed command gets
+	// them alone, instead of the environment of the worker.
+	Env []string
+	// Stdin is written to the standard input of the command.
+	Stdin string
+	// AllowFailure makes a non-zero exit code a success, whose code is stored under "exit_code"
+	// like any other. Otherwise it fails the step.
+	AllowFailure bool
+	// Sets, if set, is the key storing whether the command exited with status 0, e.g. "compiled" for a Rubric.
+	// A non-zero exit status then does not fail the step.
+	Sets string
+	// Tests, if set, is the format of the results of the tests the command runs, TestsTAP or TestsJUnit,
+	// which the step stores under "tests" as a []TestResult. They are read from the stdout of the command,
+	// or from the files matching TestReports. A non-zero exit status then fails the step only if no test ran.
+	Tests string
+	// TestReports is a glob of the files holding the results of the tests, relative to the directory
+	// of the command, e.g. "target/surefire-reports/*.xml". Template renders it too.
+	TestReports string
+	// Student makes a command which exits with an error or runs out of memory fail the step as a StudentError,
+	// for commands running the student's code, such as a compiler or the tests. Otherwise the failure is
+	// that of the grader, e.g. of a git clone, and the job may be retried. Sandboxed steps always set it.
+	Student bool
+	// MaxOutput is how much of its stdout and of its stderr the step keeps in memory, DefaultMaxOutput if zero.
+	// Past it, the step keeps the head and the tail of each.
+	MaxOutput int
+	// LogFile, if set, receives the whole stdout and stderr of the command, up to MaxLogFile.
+	// A relative path is relative to the directory of the command.
+	LogFile string
+	// StreamOutput sends the lines of the output of the command to the status of the step as they are printed,
+	// up to 1000 of them, then counts the others.
+	StreamOutput bool
+
+	name        string
+	args        []string
+	shell       bool
+	cmd         *exec.Cmd
+	logFile     string
+	testReports string
+	sandbox *sandbox.Sandbox
+	procs   procGroup
+	jobContext
 	pipeline.StepContext
 }
 
-// NewStepFromCommand creates a new CommandStep from the given string, using running `bash -C <string>`
+// NewStepFromCommand creates a new CommandStep from the given string, using running `bash -C <string>`.
+// Keep it for shell scripts: values such as paths are safer passed to NewStepFromArgs.
 func NewStepFromCommand(name, command string) *CommandStep {
+	step := NewStepFromArgs(name, "bash", "-c", command)
+	step.shell = true
+	return step
+}
+
+// NewStepFromArgs creates a CommandStep running the program args[0] with the rest of args
+// as its arguments, passed as they are, without a shell. args must not be empty.
+func NewStepFromArgs(name string, args ...string) *CommandStep {
 	return &CommandStep{
 		name: name,
-		cmd:  exec.Command("bash", "-c", command),
+		args: args,
 	}
 }
 
+// NewSandboxedStepFromCommand creates a CommandStep running the command in the sandbox, from the
+// source directory stored under "archive" if any. The outcome of the command is stored under "sandbox".
+// The binary running the step must call sandbox.Init.
+func NewSandboxedStepFromCommand(name, command string, box *sandbox.Sandbox) *CommandStep {
+	step := NewStepFromCommand(name, command)
+	step.sandbox = box
+	step.Student = true
+	return step
+}
+
 // Exec runs the command step, should be run by the pipeline, not directly.
 func (c *CommandStep) Exec(request *pipeline.Request) *pipeline.Result {
-	c.Status(fmt.Sprintf("%+v", request))
-	out, err := c.cmd.Output()
+	cmd, keys, err := c.command(request.KeyVal)
 	if err != nil {
-		c.Cancel()
-		return &pipeline.Result{
-			Error: err,
+		return &pipeline.Result{Error: err, KeyVal: request.KeyVal}
+	}
+	c.cmd = cmd
+	// Log the templates and the keys they use rather than the rendered command, which may hold secrets
+	if len(keys) > 0 {
+		c.Status(fmt.Sprintf("running %q in %q, rendered with %v", c.args, c.Dir, strings.Join(keys, ", ")))
+	} else {
+		c.Status(fmt.Sprintf("running %q in %q", c.args, c.cmd.Dir))
+	}
+
+	span := startCmdSpan(c.jobCtx(), filepath.Base(c.args[0]), c.args)
+	limit := c.MaxOutput
+	if limit == 0 {
+		limit = DefaultMaxOutput
+	}
+	stdout, stderr := newBoundedOutput(limit, nil), newBoundedOutput(limit, nil)
+	c.cmd.Stdout, c.cmd.Stderr = stdout, stderr
+	start := time.Now()
+	restore, limits, err := c.confine(request)
+	if err == nil {
+		var done func()
+		if done, err = c.stream(stdout, stderr); err == nil {
+			err = c.procs.run(c.jobCtx(), c.cmd, limits)
+			done()
+		}
+		if rerr := restore(); rerr != nil && err == nil {
+			err = fmt.Errorf("handing the workspace back: %v", rerr)
+		}
+	}
+	endCmdSpan(span, c.cmd, err)
+
+	result := &CommandResult{
+		Args:     c.args,
+		Keys:     keys,
+		ExitCode: -1,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+	if state := c.cmd.ProcessState; state != nil {
+		result.ExitCode, result.Signal = state.ExitCode(), exitSignal(state)
+	}
+	// Even a failed step keeps the KeyVal of the steps before it, e.g. for the history
+	keyVal := fromMap(request.KeyVal)
+	keyVal["command"] = result
+	keyVal["stdout"], keyVal["stderr"], keyVal["exit_code"] = result.Stdout, result.Stderr, result.ExitCode
+
+	var usage *sandbox.Result
+	if c.sandbox != nil && c.cmd.ProcessState != nil {
+		usage = c.sandbox.Inspect(c.cmd.ProcessState, c.procs.usage)
+		keyVal["sandbox"] = usage
+		if usage.ExitCode == sandbox.ExitInitFailure {
+			err = fmt.Errorf("could not set up the sandbox: %v", err)
+		} else if usage.Exceeded != "" && err != ErrCancelled {
+			err = &StudentError{Err: &sandbox.LimitError{Result: usage}}
 		}
 	}
-	stdout := string(out)
+	recordUsage(keyVal, c.stepName(), c.procs.usage)
 
+	_, exited := err.(*exec.ExitError)
+	allowed := c.AllowFailure || c.Sets != ""
+	if c.Sets != "" && (err == nil || exited) {
+		keyVal[c.Sets] = err == nil
+	}
+	if c.Tests != "" && (err == nil || exited) {
+		tests, terr := c.testResults(result.Stdout)
+		switch {
+		case terr != nil && err == nil:
+			err = fmt.Errorf("reading the test results: %v", terr)
+		case terr == nil:
+			keyVal["tests"] = tests
+			// Failed tests are results, not a failure of the step
+			allowed = allowed || len(tests) > 0
+		}
+	}
+	if exited && allowed {
+		err = nil
+	}
+	if err != nil {
+		// A command running the student's code which failed is the fault of that code
+		switch err.(type) {
+		case *exec.ExitError, *cgroup.OOMError:
+			if c.Student {
+				err = &StudentError{Err: err}
+			}
+		}
+	}
 	return &pipeline.Result{
-		Error:  nil,
-		Data:   struct{ msg string }{msg: stdout},
-		KeyVal: map[string]interface{}{"stdout": stdout},
+		Error:  err,
+		Data:   result,
+		KeyVal: keyVal,
 	}
 }
 
-// Cancel is a no-op, required to implement the pipeline step interface
+// stream copies the output of the command to the LogFile and to the status of the step, if asked to.
+// The function returned flushes and closes them once the command exited.
+func (c *CommandStep) stream(stdout, stderr *boundedOutput) (func(), error) {
+	path := c.logFile
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(c.cmd.Dir, path)
+	}
+	return streamOutput(stdout, stderr, path, c.StreamOutput, c.Status)
+}
+
+// testResults parses the results of the tests in the format of the step, from the stdout of the command
+// or from its TestReports.
+func (c *CommandStep) testResults(stdout string) ([]TestResult, error) {
+	if c.Tests == TestsTAP && c.testReports == "" {
+		return ParseTAP(stdout)
+	}
+	if c.testReports == "" {
+		return ParseJUnit([]byte(stdout))
+	}
+	pattern := c.testReports
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(c.cmd.Dir, pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no file matches %q", c.testReports)
+	}
+	var tests []TestResult
+	for _, path := range paths {
+		report, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var found []TestResult
+		if c.Tests == TestsTAP {
+			found, err = ParseTAP(string(report))
+		} else {
+			found, err = ParseJUnit(report)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filepath.Base(path), err)
+		}
+		tests = append(tests, found...)
+	}
+	return tests, nil
+}
+
+// stepName is the name of the step, as in StepSpec.Name.
+func (c *CommandStep) stepName() string {
+	if c.name == "" {
+		return "command"
+	}
+	return c.name
+}
+
+// confine prepares the command to run in the sandbox of the step, if any. It returns the function
+// handing the workspace back once the command exited, and the limits the cgroup of the command must enforce.
+func (c *CommandStep) confine(request *pipeline.Request) (func() error, cgroup.Limits, error) {
+	if c.sandbox == nil {
+		return func() error { return nil }, cgroup.Limits{}, nil
+	}
+	if archive, ok := request.KeyVal["archive"].(string); ok && c.cmd.Dir == "" {
+		c.cmd.Dir = archive
+	}
+	restore, err := c.sandbox.Command(c.cmd)
+	return restore, c.sandbox.CgroupLimits(), err
+}
+
+// Cancel stops the command along with every process it started: they get SIGTERM,
+// then SIGKILL if they still run after the CancelGracePeriod. Exec then returns ErrCancelled.
 func (c *CommandStep) Cancel() error {
 	c.Status("cancel step")
-	return nil
+	return c.procs.cancel()
+}
+
+// command renders the templates of the step, if it has any, into the command to run.
+// It returns the keys of the KeyVal they used.
+func (c *CommandStep) command(keyVal map[string]interface{}) (*exec.Cmd, []string, error) {
+	r := &renderer{keyVal: keyVal, keys: map[string]bool{}}
+	render := func(text string, shell bool) (string, error) {
+		if !c.Template {
+			return text, nil
+		}
+		return r.render(text, shell)
+	}
+
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		var err error
+		// The script of bash -c is the last argument
+		if args[i], err = render(arg, c.shell && i == len(c.args)-1); err != nil {
+			return nil, nil, fmt.Errorf("rendering the command: %v", err)
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+
+	var err error
+	if cmd.Dir, err = render(c.Dir, false); err != nil {
+		return nil, nil, fmt.Errorf("rendering the directory: %v", err)
+	}
+	if c.logFile, err = render(c.LogFile, false); err != nil {
+		return nil, nil, fmt.Errorf("rendering the log file: %v", err)
+	}
+	if c.testReports, err = render(c.TestReports, false); err != nil {
+		return nil, nil, fmt.Errorf("rendering the test reports: %v", err)
+	}
+	env := make([]string, 0, len(c.Env))
+	for _, v := range c.Env {
+		if v, err = render(v, false); err != nil {
+			return nil, nil, fmt.Errorf("rendering the environment: %v", err)
+		}
+		env = append(env, v)
+	}
+	// The values of the script
+	env = append(env, r.vars...)
+	switch {
+	case c.sandbox != nil:
+		// Not the environment of the worker, which holds its secrets
+		cmd.Env = env
+	case len(env) > 0:
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if c.Stdin != "" {
+		stdin, err := render(c.Stdin, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rendering stdin: %v", err)
+		}
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	return cmd, r.usedKeys(), nil
 }
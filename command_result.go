@@ -0,0 +1,26 @@
+package jobs
+
+import "time"
+
+// DefaultMaxOutput is how much of the stdout and of the stderr of a command a step keeps in memory.
+const DefaultMaxOutput = 1 << 20
+
+// CommandResult is the outcome of the command of a CommandStep. It is the Data of the step's result,
+// failed or not, and is stored under "command", along with "stdout", "stderr" and "exit_code".
+type CommandResult struct {
+	// Args is the command before its templates are rendered, so that no value of the KeyVal, such as
+	// a secret, ends up in the history.
+	Args []string `json:"args"`
+	// Keys are the keys of the KeyVal which the templates used.
+	Keys []string `json:"keys,omitempty"`
+	// ExitCode is -1 if the command was killed by a signal.
+	ExitCode int `json:"exit_code"`
+	// Signal names the signal which killed the command, if any.
+	Signal string `json:"signal,omitempty"`
+	// Stdout and Stderr keep the head and the tail of the output past the MaxOutput of the step,
+	// with a marker counting the bytes left out between them.
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// Duration is the wall time of the command.
+	Duration time.Duration `json:"duration"`
+}
@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// commandFuncs are the functions available to the templates of a CommandStep.
+var commandFuncs = template.FuncMap{
+	"quote": shellQuote,
+	"raw":   func(val interface{}) interface{} { return val },
+}
+
+// checkTemplate checks that the text is a valid template for a CommandStep.
+func checkTemplate(text string) error {
+	_, err := template.New("command").Funcs(commandFuncs).Parse(text)
+	return err
+}
+
+// renderer renders the templates of a CommandStep against the KeyVal, noting the keys they use.
+type renderer struct {
+	keyVal map[string]interface{}
+	keys   map[string]bool
+	// vars are the KEY=VALUE variables holding the values of a shell script. See variable.
+	vars []string
+}
+
+// render renders the template text. In a shell script, every value goes through quote unless it goes
+// through raw, and quote passes it in a variable rather than in the script.
+func (r *renderer) render(text string, shell bool) (string, error) {
+	funcs := template.FuncMap{}
+	if shell {
+		funcs["quote"] = r.variable
+	}
+	tmpl, err := template.New("command").Funcs(commandFuncs).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	if shell {
+		quoteActions(tmpl.Tree, tmpl.Tree.Root)
+	}
+	templateKeys(tmpl.Tree.Root, r.keys)
+	var out strings.Builder
+	if err := tmpl.Execute(&out, r.keyVal); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// variable stores the value in a variable of the environment of the script, and returns a reference to it.
+// Bash never parses the value: quoting it instead would not hold inside "...", `...` or $(...).
+func (r *renderer) variable(val interface{}) string {
+	name := fmt.Sprintf("ALLIGRADER_VALUE_%d", len(r.vars)+1)
+	r.vars = append(r.vars, name+"="+fmt.Sprint(val))
+	return `"${` + name + `}"`
+}
+
+// usedKeys returns the keys the templates rendered so far used, sorted.
+func (r *renderer) usedKeys() []string {
+	keys := make([]string, 0, len(r.keys))
+	for key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteActions pipes every value the template prints through quote, unless it ends with quote or raw.
+func quoteActions(tree *parse.Tree, node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			quoteActions(tree, n)
+		}
+	case *parse.ActionNode:
+		// An action declaring a variable prints nothing
+		if len(node.Pipe.Decl) > 0 {
+			return
+		}
+		cmds := node.Pipe.Cmds
+		if last, ok := cmds[len(cmds)-1].Args[0].(*parse.IdentifierNode); ok && (last.Ident == "quote" || last.Ident == "raw") {
+			return
+		}
+		quote := parse.NewIdentifier("quote").SetTree(tree).SetPos(node.Pos)
+		node.Pipe.Cmds = append(cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: node.Pos, Args: []parse.Node{quote}})
+	case *parse.IfNode:
+		quoteActions(tree, node.List)
+		quoteActions(tree, node.ElseList)
+	case *parse.RangeNode:
+		quoteActions(tree, node.List)
+		quoteActions(tree, node.ElseList)
+	case *parse.WithNode:
+		quoteActions(tree, node.List)
+		quoteActions(tree, node.ElseList)
+	}
+}
+
+// templateKeys adds the keys of the KeyVal which the template uses to keys.
+func templateKeys(node parse.Node, keys map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			templateKeys(n, keys)
+		}
+	case *parse.ActionNode:
+		templateKeys(node.Pipe, keys)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			templateKeys(cmd, keys)
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			templateKeys(arg, keys)
+		}
+	case *parse.ChainNode:
+		templateKeys(node.Node, keys)
+	case *parse.FieldNode:
+		keys[node.Ident[0]] = true
+	case *parse.VariableNode:
+		if len(node.Ident) > 1 && node.Ident[0] == "$" {
+			keys[node.Ident[1]] = true
+		}
+	case *parse.IfNode:
+		templateKeys(&node.BranchNode, keys)
+	case *parse.RangeNode:
+		templateKeys(&node.BranchNode, keys)
+	case *parse.WithNode:
+		templateKeys(&node.BranchNode, keys)
+	case *parse.BranchNode:
+		templateKeys(node.Pipe, keys)
+		templateKeys(node.List, keys)
+		templateKeys(node.ElseList, keys)
+	}
+}
+
+// shellQuote quotes the value as a single word for Bash.
+func shellQuote(val interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(val), "'", `'\''`, -1) + "'"
+}
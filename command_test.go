@@ -1,12 +1,26 @@
 package jobs
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
 
 	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/sandbox"
 )
 
+func TestMain(m *testing.M) {
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
 func ExampleCommandStep() {
 
 	const name = "test pipeline 1"
@@ -42,3 +56,266 @@ func ExampleCommandStep() {
 	// Output:
 	// hello world
 }
+
+func TestCommandStepCancel(t *testing.T) {
+	for _, command := range []string{
+		// The background sleep holds stdout open: Exec only returns once the whole group is gone
+		"sleep 30 & sleep 30",
+		// SIGTERM is ignored by bash and sleep alike, so they must be killed after the grace period
+		"trap '' TERM; sleep 30 & sleep 30",
+	} {
+		step := NewStepFromCommand("sleep", command)
+		step.procs.grace = 100 * time.Millisecond
+
+		done := make(chan *pipeline.Result)
+		go func() {
+			done <- step.Exec(&pipeline.Request{})
+		}()
+		for started := false; !started; time.Sleep(10 * time.Millisecond) {
+			step.procs.mu.Lock()
+			started = step.procs.cmd != nil
+			step.procs.mu.Unlock()
+		}
+		// Give bash the time to start its children
+		time.Sleep(100 * time.Millisecond)
+
+		if err := step.Cancel(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case res := <-done:
+			if res.Error != ErrCancelled {
+				t.Errorf("%v: expected ErrCancelled, observed %v", command, res.Error)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: the command still runs after being cancelled", command)
+		}
+	}
+
+	// A step cancelled once runs its command again, e.g. when retried
+	dir, err := ioutil.TempDir("", "cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	step := NewStepFromCommand("retried", "test -f retried || sleep 30; echo again")
+	step.Dir = dir
+	time.AfterFunc(200*time.Millisecond, func() { step.Cancel() })
+	if res := step.Exec(&pipeline.Request{}); res.Error != ErrCancelled {
+		t.Fatalf("expected ErrCancelled, observed %v", res.Error)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "retried"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res := step.Exec(&pipeline.Request{}); res.Error != nil || res.KeyVal["stdout"] != "again\n" {
+		t.Errorf("expected the step to run again, observed %v", res.Error)
+	}
+	step.Cancel()
+	if res := step.Exec(&pipeline.Request{}); res.Error != ErrCancelled {
+		t.Errorf("expected a step cancelled between its runs not to start, observed %v", res.Error)
+	}
+	if res := step.Exec(&pipeline.Request{}); res.Error != nil {
+		t.Errorf("expected the step to run again, observed %v", res.Error)
+	}
+}
+
+func TestSandboxedCommandStep(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandboxes are only supported on Linux")
+	}
+
+	box := &sandbox.Sandbox{Limits: sandbox.Limits{CPU: time.Second}, UID: sandbox.NobodyID, GID: sandbox.NobodyID}
+	res := NewSandboxedStepFromCommand("loop", "while :; do :; done", box).Exec(&pipeline.Request{})
+	if res.Error != nil && !IsStudentError(res.Error) {
+		t.Skipf("cannot set up a sandbox here: %v", res.Error)
+	}
+
+	var limitErr *sandbox.LimitError
+	if !errors.As(res.Error, &limitErr) || limitErr.Result.Exceeded != sandbox.ExceededCPU {
+		t.Fatalf("expected the command to exceed its CPU time, observed %v", res.Error)
+	}
+
+	// Limits on memory and processes need a cgroup
+	if res = NewSandboxedStepFromCommand("ok", "echo graded", sandbox.Default()).Exec(&pipeline.Request{}); res.Error == nil || IsStudentError(res.Error) {
+		t.Errorf("expected the step to fail without a cgroup, observed %v", res.Error)
+	}
+	box = sandbox.Default()
+	box.Memory, box.Processes = 0, 0
+	res = NewSandboxedStepFromCommand("ok", "echo graded", box).Exec(&pipeline.Request{})
+	if res.Error != nil || res.KeyVal["stdout"] != "graded\n" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if usage, ok := res.KeyVal["sandbox"].(*sandbox.Result); !ok || usage.ExitCode != 0 {
+		t.Errorf("expected the outcome of the command, observed %v", res.KeyVal["sandbox"])
+	}
+}
+
+func TestCommandStepArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	arg := `it's a "path" $(touch injected) ; touch injected`
+	step := NewStepFromArgs("printf", "printf", "%s", arg)
+	step.Dir = dir
+	res := step.Exec(&pipeline.Request{})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res.KeyVal["stdout"] != arg {
+		t.Errorf("expected the argument to be passed as it is, observed %q", res.KeyVal["stdout"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "injected")); err == nil {
+		t.Error("expected no shell to interpret the argument")
+	}
+}
+
+func TestCommandStepTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "it's here")
+	if err := os.Mkdir(archive, 0755); err != nil {
+		t.Fatal(err)
+	}
+	request := &pipeline.Request{KeyVal: map[string]interface{}{
+		"archive": archive, "SHA": "abc", "token": "secret $(touch injected)", "flags": "-n",
+	}}
+
+	step := NewStepFromCommand("template", `cat; echo " $GREETING"; cd {{.archive}} && basename "$PWD"; echo {{raw .flags}} {{.token}}; exit 3`)
+	step.Dir, step.Env, step.Stdin = "{{.archive}}", []string{"GREETING=hello {{.SHA}}"}, "sha {{.SHA}}"
+	step.AllowFailure, step.Template = true, true
+	res := step.Exec(request)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if expected := "sha abc hello abc\nit's here\nsecret $(touch injected)"; res.KeyVal["stdout"] != expected || res.KeyVal["exit_code"] != 3 {
+		t.Errorf("expected %q and exit code 3, observed %q and %v", expected, res.KeyVal["stdout"], res.KeyVal["exit_code"])
+	}
+	if _, err := os.Stat(filepath.Join(archive, "injected")); !os.IsNotExist(err) {
+		t.Error("expected the values to be quoted in the command")
+	}
+	// The history must not hold the values, which may be secrets
+	result := res.Data.(*CommandResult)
+	if strings.Contains(strings.Join(result.Args, " "), "secret") || !reflect.DeepEqual(result.Keys, []string{"SHA", "archive", "flags", "token"}) {
+		t.Errorf("expected the templates and the keys they used, observed %q and %v", result.Args, result.Keys)
+	}
+
+	// A value is never parsed by Bash, even between double quotes or in a command substitution
+	request.KeyVal["stdout"] = "$(echo INJECTED) `echo INJECTED` \"; echo INJECTED"
+	quoted := NewStepFromCommand("quoted", `echo "{{.stdout}}"; echo $(echo "x{{.stdout}}")`)
+	quoted.Template = true
+	res = quoted.Exec(request)
+	if expected := request.KeyVal["stdout"].(string) + "\nx" + request.KeyVal["stdout"].(string) + "\n"; res.Error != nil || res.KeyVal["stdout"] != expected {
+		t.Errorf("expected %q, observed %q and %v", expected, res.KeyVal["stdout"], res.Error)
+	}
+	delete(request.KeyVal, "stdout")
+
+	// Steps built in Go run their command as it is, unless they set Template
+	res = NewStepFromCommand("literal", `echo '{{.SHA}}'`).Exec(request)
+	if res.Error != nil || res.KeyVal["stdout"] != "{{.SHA}}\n" {
+		t.Errorf("expected the command to run as it is, observed %q and %v", res.KeyVal["stdout"], res.Error)
+	}
+
+	fail := NewStepFromCommand("fail", "exit 3")
+	if res := fail.Exec(request); res.Error == nil || IsStudentError(res.Error) {
+		t.Errorf("expected a non-zero exit to fail the step as an infrastructure failure, observed %v", res.Error)
+	}
+	// A failed step runs again, e.g. when it is retried
+	fail.Student = true
+	if res := fail.Exec(request); !IsStudentError(res.Error) {
+		t.Errorf("expected a non-zero exit of the student's code to be the student's failure, observed %v", res.Error)
+	}
+	missing := NewStepFromCommand("missing", "echo {{.missing}}")
+	missing.Template = true
+	if res := missing.Exec(request); res.Error == nil || IsStudentError(res.Error) {
+		t.Errorf("expected a missing key to fail the step, observed %v", res.Error)
+	}
+}
+
+func TestCommandStepResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := NewStepFromCommand("fail", `echo out; echo err >&2; head -c 5000 /dev/zero | tr '\0' x; exit 2`)
+	step.Dir, step.MaxOutput, step.LogFile, step.Student = dir, 100, "output.log", true
+	res := step.Exec(&pipeline.Request{})
+	if !IsStudentError(res.Error) {
+		t.Fatalf("expected the exit code to fail the step, observed %v", res.Error)
+	}
+	result, ok := res.Data.(*CommandResult)
+	if !ok || res.KeyVal["command"] != result {
+		t.Fatalf("expected the result of the command, observed %#v", res.Data)
+	}
+	if result.ExitCode != 2 || result.Signal != "" || result.Stderr != "err\n" || result.Duration <= 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if expected := "out\n" + strings.Repeat("x", 46) + "\n[... 4904 bytes truncated ...]\n" + strings.Repeat("x", 50); result.Stdout != expected || res.KeyVal["stdout"] != expected {
+		t.Errorf("expected the head and the tail of stdout, observed %q", result.Stdout)
+	}
+
+	if log, err := ioutil.ReadFile(filepath.Join(dir, "output.log")); err != nil || len(log) != 5008 {
+		t.Errorf("expected the whole output in the log file, observed %v bytes: %v", len(log), err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	res = NewStepFromCommand("killed", "kill -KILL $$").Exec(&pipeline.Request{})
+	if result := res.Data.(*CommandResult); result.ExitCode != -1 || result.Signal != "killed" {
+		t.Errorf("expected the command to be killed by a signal, observed %+v", result)
+	}
+}
+
+func TestCommandStepTests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := NewStepFromCommand("compile", "exit 1")
+	step.Sets, step.Student = "compiled", true
+	res := step.Exec(&pipeline.Request{})
+	if res.Error != nil || res.KeyVal["compiled"] != false {
+		t.Errorf("expected the exit code under \"compiled\", observed %v and %v", res.KeyVal["compiled"], res.Error)
+	}
+
+	const report = `<testsuites><testsuite name="Calc">
+<testcase classname="CalcTest" name="adds"/>
+<testcase classname="CalcTest" name="subtracts"><failure message="expected 1">but was 3</failure></testcase>
+<testcase classname="CalcTest" name="divides"><skipped/></testcase>
+</testsuite></testsuites>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "TEST-Calc.xml"), []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	step = NewStepFromCommand("test", "exit 1")
+	step.Dir, step.Tests, step.TestReports, step.Student = dir, TestsJUnit, "TEST-*.xml", true
+	res = step.Exec(&pipeline.Request{})
+	expected := []TestResult{{Name: "CalcTest.adds", Passed: true}, {Name: "CalcTest.subtracts", Output: "expected 1\nbut was 3\n"}}
+	if res.Error != nil || !reflect.DeepEqual(res.KeyVal["tests"], expected) {
+		t.Errorf("expected the failed tests to be results, observed %+v and %v", res.KeyVal["tests"], res.Error)
+	}
+
+	step = NewStepFromCommand("test", "echo '1..2'; echo 'ok 1 - adds'; echo 'not ok 2 # TODO later'; echo '# diagnostic'; exit 1")
+	step.Tests = TestsTAP
+	res = step.Exec(&pipeline.Request{})
+	expected = []TestResult{{Name: "adds", Passed: true}, {Name: "test 2", Passed: true, Output: "diagnostic\n"}}
+	if res.Error != nil || !reflect.DeepEqual(res.KeyVal["tests"], expected) {
+		t.Errorf("expected the TAP results, observed %+v and %v", res.KeyVal["tests"], res.Error)
+	}
+
+	// Without any test, the exit code fails the step
+	step = NewStepFromCommand("test", "echo 'does not compile'; exit 1")
+	step.Tests, step.Student = TestsTAP, true
+	if res = step.Exec(&pipeline.Request{}); !IsStudentError(res.Error) {
+		t.Errorf("expected the step to fail without tests, observed %v", res.Error)
+	}
+}
@@ -23,6 +23,7 @@ type CommentStep struct {
 	checkstyleReport *Checkstyle
 	findbugsReport   *bugcollection
 	log              *logrus.Logger
+	jobContext
 	pipeline.StepContext
 }
 
@@ -121,7 +122,7 @@ func (c *CommentStep) Exec(req *pipeline.Request) *pipeline.Result {
 
 	c.logReports()
 
-	ctx := context.Background()
+	ctx := c.jobCtx()
 	client := c.client
 
 	c.log.Warnf("There are %v files.", len(c.checkstyleReport.File))
@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName names the tracer of the spans started by the steps of this package.
+const TracerName = "github.com/alligrader/jobs"
+
+// ContextStep is a step which works under the context of the job running it,
+// so that the commands it launches and the requests it sends show up in the trace of the job.
+type ContextStep interface {
+	pipeline.Step
+	SetContext(ctx context.Context)
+}
+
+// SetContext gives the context to the step if it is a ContextStep.
+func SetContext(step pipeline.Step, ctx context.Context) {
+	if s, ok := step.(ContextStep); ok {
+		s.SetContext(ctx)
+	}
+}
+
+// jobContext holds the context given to a ContextStep. Steps embed it.
+type jobContext struct {
+	ctx context.Context
+}
+
+// SetContext sets the context of the job running the step.
+func (j *jobContext) SetContext(ctx context.Context) {
+	j.ctx = ctx
+}
+
+// jobCtx returns the context of the job, or the background context when the step runs outside of one.
+func (j *jobContext) jobCtx() context.Context {
+	if j.ctx == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+type httpClientKey struct{}
+
+// WithHTTPClient returns a context under which the steps send their requests to GitHub and other APIs
+// with the client, e.g. one which is instrumented, unless they were created with a client of their own.
+func WithHTTPClient(parent context.Context, client *http.Client) context.Context {
+	return context.WithValue(parent, httpClientKey{}, client)
+}
+
+// httpClient returns the client of the step if not nil, else the client of the context set by
+// WithHTTPClient, else http.DefaultClient.
+func httpClient(ctx context.Context, client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	if client, ok := ctx.Value(httpClientKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// contextTransport sends each request with the transport of the client of its context, for the
+// clients of other libraries which are created before the job runs, such as those of go-github.
+type contextTransport struct{}
+
+// RoundTrip sends the request.
+func (contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := httpClient(req.Context(), nil).Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+
+// startCmdSpan starts a span for the launch of the command, a child of the span of the step.
+// args is the command line to record, which must not hold secrets.
+func startCmdSpan(ctx context.Context, name string, args []string) trace.Span {
+	_, span := otel.Tracer(TracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attribute.String("process.command_line", strings.Join(args, " "))),
+	)
+	return span
+}
+
+// endCmdSpan records the exit code of the command and its error, if any, then ends the span.
+func endCmdSpan(span trace.Span, cmd *exec.Cmd, err error) {
+	if cmd.ProcessState != nil {
+		span.SetAttributes(attribute.Int("process.exit.code", cmd.ProcessState.ExitCode()))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StudentError marks a failure caused by the student's submission, such as code which does not compile
+// or a program which exits with an error, as opposed to a failure of the grading infrastructure.
+type StudentError struct {
+	Err error
+}
+
+func (e *StudentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StudentError) Unwrap() error {
+	return e.Err
+}
+
+// IsStudentError reports whether the error was caused by the student's submission.
+func IsStudentError(err error) bool {
+	var studentErr *StudentError
+	return errors.As(err, &studentErr)
+}
+
+// TimeoutError reports that a step, or the whole job, ran longer than its timeout,
+// e.g. because the submission loops forever. Running it again would most likely time out again.
+type TimeoutError struct {
+	// Step is the name of the step which timed out, or empty if the job did.
+	Step    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Step == "" {
+		return fmt.Sprintf("job timed out after %v", e.Timeout)
+	}
+	return fmt.Sprintf("step %q timed out after %v", e.Step, e.Timeout)
+}
+
+// Unwrap returns context.DeadlineExceeded.
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// IsTimeout reports whether the error was caused by a step or job running out of time.
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// ConflictError reports that two steps run by a ParallelStep set the same key of the KeyVal to different values.
+type ConflictError struct {
+	Key   string
+	Steps [2]string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("steps %q and %q both set %q", e.Steps[0], e.Steps[1], e.Key)
+}
+
+// SpecError reports a mistake of the job spec, such as parallel steps setting the same key,
+// which running the job again would repeat: the job fails without being retried.
+type SpecError struct {
+	Err error
+}
+
+func (e *SpecError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
+
+// IsSpecError reports whether the error is a SpecError.
+func IsSpecError(err error) bool {
+	var specErr *SpecError
+	return errors.As(err, &specErr)
+}
+
+// StepError is the error of one of the steps run by a ParallelStep.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Step, e.Err)
+}
+
+// Unwrap returns the error of the step.
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// StepErrors holds the errors of a ParallelStep whose steps failed, or whose outputs conflict.
+type StepErrors []error
+
+func (e StepErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%v steps failed: %v", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the most serious of the errors: a failure of the infrastructure, then a timeout,
+// then a failure of the student's submission. IsStudentError thus only holds if every step failed
+// because of the submission.
+func (e StepErrors) Unwrap() error {
+	var timeout, student error
+	for _, err := range e {
+		switch {
+		case IsTimeout(err):
+			if timeout == nil {
+				timeout = err
+			}
+		case IsStudentError(err):
+			if student == nil {
+				student = err
+			}
+		default:
+			return err
+		}
+	}
+	if timeout != nil {
+		return timeout
+	}
+	return student
+}
+
+// TransientError marks a failure which running the step again may not repeat, such as an API
+// responding 503 or rate limiting the grader. See Retry.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether the error is a TransientError or a network error, such as a connection
+// reset or a request timing out. A job which was cancelled or ran out of time, or whose spec is wrong, is not transient.
+func IsTransient(err error) bool {
+	if err == nil || err == ErrCancelled || IsTimeout(err) || IsStudentError(err) || IsSpecError(err) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var (
+		transientErr *TransientError
+		opErr        *net.OpError
+		netErr       net.Error
+	)
+	return errors.As(err, &transientErr) || errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// transientStatus reports whether an HTTP response with the status code may succeed if sent again.
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code/100 == 5
+}
+
+// PanicError reports that a step panicked. See Recover.
+type PanicError struct {
+	Step  string
+	Value interface{}
+	// Stack is the stack of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("step %q panicked: %v", e.Step, e.Value)
+}
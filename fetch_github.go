@@ -1,12 +1,14 @@
 package jobs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/RobbieMcKinstry/pipeline"
 	"github.com/mholt/archiver"
@@ -21,15 +23,22 @@ const githubURL = "https://api.github.com/repos/%s/%s/%s/%s"
 // "GET /repos/:owner/:repo/:archive_format/:ref"
 
 // GithubFetchStep will download the source code for the given **public** repo (should inject the correct client to fetch a private repo)
+// Call Cleanup to remove the downloaded source once the pipeline is done with it.
 type GithubFetchStep struct {
-	owner string
-	repo  string
-	ref   string
-	log   *logrus.Logger
+	owner      string
+	repo       string
+	ref        string
+	client     *http.Client
+	log        *logrus.Logger
+	mu         sync.Mutex
+	workspaces []string
+	jobContext
 	pipeline.StepContext
 }
 
-// NewGithubStep takes what is essentially the URL of the repo and the ref to download
+// NewGithubStep takes what is essentially the URL of the repo and the ref to download.
+// An empty owner or repo defaults to OWNER or REPO in the KeyVal, and an empty ref to SHA,
+// the commit pushed, else to REF.
 func NewGithubStep(owner, repo, ref string, logger *logrus.Logger) *GithubFetchStep {
 	return &GithubFetchStep{
 		owner: owner,
@@ -39,6 +48,14 @@ func NewGithubStep(owner, repo, ref string, logger *logrus.Logger) *GithubFetchS
 	}
 }
 
+// NewGithubStepWithClient is like NewGithubStep, but downloads with the given client,
+// e.g. one which authenticates. A nil client means the client of the job, see WithHTTPClient.
+func NewGithubStepWithClient(owner, repo, ref string, client *http.Client, logger *logrus.Logger) *GithubFetchStep {
+	step := NewGithubStep(owner, repo, ref, logger)
+	step.client = client
+	return step
+}
+
 // NewGithubStepFromEnvironment reads the owner, repo, and ref from the OWNER, REPO, and REF
 // environment variables.
 func NewGithubStepFromEnvironment() pipeline.Step {
@@ -47,15 +64,22 @@ func NewGithubStepFromEnvironment() pipeline.Step {
 
 // Exec runs the step. Should not be run directly.
 func (g *GithubFetchStep) Exec(request *pipeline.Request) *pipeline.Result {
-	g.Status(fmt.Sprintf("%+v", request))
+	owner, repo, ref := g.source(request.KeyVal)
+	if owner == "" || repo == "" || ref == "" {
+		return &pipeline.Result{Error: errors.New("missing the owner, repo or ref to fetch, set neither by the step nor by OWNER, REPO, SHA or REF")}
+	}
 
 	// Generate the URL to ping GitHub
-	url := fmt.Sprintf(githubURL, g.owner, g.repo, defaultArchieveFormat, g.ref)
-	fileUID := fmt.Sprintf("%v-%v-%v", g.owner, g.repo, g.ref)
+	url := fmt.Sprintf(githubURL, owner, repo, defaultArchieveFormat, ref)
+	fileUID := fmt.Sprintf("%v-%v-%v", owner, repo, ref)
 
 	// Make a POST request to the server (TODO using the installation token in the future)
 	g.Status("Fetching archive from GitHub...")
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return &pipeline.Result{Error: err}
+	}
+	resp, err := httpClient(g.jobCtx(), g.client).Do(req.WithContext(g.jobCtx()))
 	if err != nil {
 		g.Status("Failed to fetch archive from GitHub")
 		return &pipeline.Result{Error: err}
@@ -79,6 +103,7 @@ func (g *GithubFetchStep) Exec(request *pipeline.Request) *pipeline.Result {
 		tmpfileName := stat.Name()
 	*/
 	tmpfileName := tmpfile.Name()
+	defer os.Remove(tmpfileName)
 
 	// Save the zipball to the filesystem
 	_, err = io.Copy(tmpfile, resp.Body)
@@ -94,6 +119,9 @@ func (g *GithubFetchStep) Exec(request *pipeline.Request) *pipeline.Result {
 		g.Status("Failed to create a tmp dir")
 		return &pipeline.Result{Error: err}
 	}
+	g.mu.Lock()
+	g.workspaces = append(g.workspaces, dir)
+	g.mu.Unlock()
 
 	// Break open the archive
 	err = archiver.Zip.Open(tmpfileName, dir)
@@ -117,18 +145,51 @@ func (g *GithubFetchStep) Exec(request *pipeline.Request) *pipeline.Result {
 	}
 
 	if len(dirs) != 1 {
-		g.log.Warn("Expected just a single directory. Instead found %v", len(dirs))
-		g.Status("Rando error")
-		return nil
+		g.Status("Failed to find the source in the archive")
+		return &pipeline.Result{Error: fmt.Errorf("expected a single directory in the archive of %v/%v, found %v", owner, repo, len(dirs))}
 	}
 
 	finalPath := filepath.Join(dir, dirs[0])
 
 	// Finally, return the result
+	nextMap := fromMap(request.KeyVal)
+	nextMap["archive"] = finalPath
 	return &pipeline.Result{
 		Error:  nil,
-		KeyVal: map[string]interface{}{"archive": finalPath},
+		KeyVal: nextMap,
+	}
+}
+
+// source returns the owner, repo and ref to fetch, defaulting to those of the KeyVal.
+func (g *GithubFetchStep) source(keyVal map[string]interface{}) (owner, repo, ref string) {
+	owner, repo, ref = g.owner, g.repo, g.ref
+	if owner == "" {
+		owner, _ = keyVal["OWNER"].(string)
+	}
+	if repo == "" {
+		repo, _ = keyVal["REPO"].(string)
+	}
+	// The commit pushed, rather than the branch, which may have moved since
+	for _, key := range []string{"SHA", "REF"} {
+		if ref == "" {
+			ref, _ = keyVal[key].(string)
+		}
+	}
+	return owner, repo, ref
+}
+
+// Cleanup removes the source downloaded by every run of the step.
+func (g *GithubFetchStep) Cleanup() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var err error
+	for _, workspace := range g.workspaces {
+		if rmErr := os.RemoveAll(workspace); rmErr != nil && err == nil {
+			err = rmErr
+		}
 	}
+	g.workspaces = nil
+	return err
 }
 
 // Cancel is a no-op
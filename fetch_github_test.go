@@ -1,9 +1,14 @@
 package jobs
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"golang.org/x/oauth2"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -90,3 +95,79 @@ func getClient() *http.Client {
 	tc := oauth2.NewClient(ctx, ts)
 	return tc
 }
+
+func TestGithubClientJobClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha": "abc"}`))
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	ctx := WithHTTPClient(context.Background(), &http.Client{Transport: transport})
+	client := githubClient("GH_ACCESS_TOKEN")
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	if _, _, err := client.Repositories.GetCommit(ctx, "alligrader", "TestRepo", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests != 1 {
+		t.Errorf("expected the commit to be fetched with the client of the job, observed %v requests", transport.requests)
+	}
+}
+
+// zipballTransport answers every request with a zipball holding a README in each of the dirs.
+type zipballTransport struct {
+	dirs []string
+	urls []string
+}
+
+func (z *zipballTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	z.urls = append(z.urls, r.URL.String())
+	var blob bytes.Buffer
+	archive := zip.NewWriter(&blob)
+	for _, dir := range z.dirs {
+		w, err := archive.Create(dir + "/README.md")
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte("hello"))
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(&blob), Request: r}, nil
+}
+
+func TestGithubFetchKeyVal(t *testing.T) {
+	request := &pipeline.Request{KeyVal: map[string]interface{}{
+		"OWNER": "bob", "REPO": "hw1-bob", "REF": "refs/heads/master", "SHA": "abc123", "score": 3,
+	}}
+	transport := &zipballTransport{dirs: []string{"bob-hw1-bob-abc123"}}
+	step := NewGithubStep("", "", "", logrus.New())
+	step.SetContext(WithHTTPClient(context.Background(), &http.Client{Transport: transport}))
+	res := step.Exec(request)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	defer step.Cleanup()
+	if expected := "https://api.github.com/repos/bob/hw1-bob/zipball/abc123"; len(transport.urls) != 1 || transport.urls[0] != expected {
+		t.Errorf("expected the pushed commit to be fetched from %v, observed %v", expected, transport.urls)
+	}
+	if _, err := os.Stat(filepath.Join(res.KeyVal["archive"].(string), "README.md")); err != nil || res.KeyVal["score"] != 3 {
+		t.Errorf("expected the source along with the KeyVal of the request, observed %v and %v", res.KeyVal, err)
+	}
+
+	transport.dirs = []string{"a", "b"}
+	if res := step.Exec(request); res == nil || res.Error == nil {
+		t.Error("expected an archive without a single directory to fail the step")
+	}
+	if res := NewGithubStep("", "", "", logrus.New()).Exec(&pipeline.Request{}); res.Error == nil {
+		t.Error("expected a step without a repo to fail")
+	}
+	archive := res.KeyVal["archive"].(string)
+	if err := step.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Errorf("expected the source to be removed, observed %v", err)
+	}
+}
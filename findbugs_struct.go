@@ -1,5 +1,7 @@
 package jobs
 
+import "encoding/xml"
+
 type bugcollection struct {
 	project           project         `xml:"project"`
 	version           string          `xml:"version,attr"`
@@ -169,3 +171,31 @@ type classstats struct {
 	bugs          string `xml:"bugs,attr"`
 	class         string `xml:"class,attr"`
 }
+
+// FindbugsReport is a lean, exported view over the XML output of FindBugs.
+// It only holds what is needed to report the bugs back to a student.
+type FindbugsReport struct {
+	BugInstance []FindbugsBug `xml:"BugInstance"`
+}
+
+// FindbugsBug is a single bug reported by FindBugs.
+type FindbugsBug struct {
+	Type         string `xml:"type,attr"`
+	Priority     string `xml:"priority,attr"`
+	Category     string `xml:"category,attr"`
+	ShortMessage string `xml:"ShortMessage"`
+	LongMessage  string `xml:"LongMessage"`
+	SourceLine   []struct {
+		Sourcefile string `xml:"sourcefile,attr"`
+		Sourcepath string `xml:"sourcepath,attr"`
+		Start      string `xml:"start,attr"`
+	} `xml:"SourceLine"`
+}
+
+// ParseFindbugs decodes the XML report stored under "findbugs" by the FindBugs step.
+// Reports produced in text mode cannot be parsed.
+func ParseFindbugs(report string) (*FindbugsReport, error) {
+	var fb FindbugsReport
+	err := xml.Unmarshal([]byte(report), &fb)
+	return &fb, err
+}
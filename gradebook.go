@@ -0,0 +1,357 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RobbieMcKinstry/pipeline"
+)
+
+// GradebookColumns is the order of the columns written to a gradebook. It never changes between runs,
+// so spreadsheets built on top of the gradebook can rely on it.
+var GradebookColumns = []string{
+	"student",
+	"repo",
+	"sha",
+	"score",
+	"compiled",
+	"tests_passed",
+	"tests_total",
+	"checkstyle_errors",
+	"checkstyle_warnings",
+	"findbugs_bugs",
+	"findbugs_high_priority",
+	"late_hours",
+	"late_penalty",
+	"error",
+}
+
+// GradebookRow is the summary of a single graded job.
+type GradebookRow struct {
+	Student              string
+	Repo                 string
+	SHA                  string
+	Score                string
+	Compiled             string
+	TestsPassed          string
+	TestsTotal           string
+	CheckstyleErrors     string
+	CheckstyleWarnings   string
+	FindbugsBugs         string
+	FindbugsHighPriority string
+	LateHours            string
+	LatePenalty          string
+	Error                string
+}
+
+// NewGradebookRow summarizes the result of a pipeline run. Values missing from the KeyVal are left empty,
+// so a job which never reached a step can be told apart from one with a zero count.
+func NewGradebookRow(res *pipeline.Result) GradebookRow {
+	var (
+		row    GradebookRow
+		keyval = res.KeyVal
+	)
+	if keyval == nil {
+		keyval = map[string]interface{}{}
+	}
+
+	row.Student = extractStudent(keyval)
+	owner, _ := extractStr(keyval, "OWNER")
+	repo, _ := extractStr(keyval, "REPO")
+	if owner != "" || repo != "" {
+		row.Repo = owner + "/" + repo
+	}
+	row.SHA, _ = extractStr(keyval, "SHA")
+
+	if score, ok := extractScore(keyval); ok {
+		row.Score = formatFloat(score)
+	}
+	if compiled, ok := keyval["compiled"].(bool); ok {
+		row.Compiled = strconv.FormatBool(compiled)
+	}
+
+	if tests := extractTests(keyval); tests != nil {
+		passed := 0
+		for _, test := range tests {
+			if test.Passed {
+				passed++
+			}
+		}
+		row.TestsPassed = strconv.Itoa(passed)
+		row.TestsTotal = strconv.Itoa(len(tests))
+	}
+
+	if check, err := extractCheckstyle(keyval, "checkstyle"); err == nil {
+		errs, warnings := 0, 0
+		for _, f := range check.File {
+			for _, e := range f.Error {
+				switch e.Severity {
+				case "error":
+					errs++
+				case "warning":
+					warnings++
+				}
+			}
+		}
+		row.CheckstyleErrors = strconv.Itoa(errs)
+		row.CheckstyleWarnings = strconv.Itoa(warnings)
+	}
+
+	if fb := extractFindbugs(keyval); fb != nil {
+		high := 0
+		for _, bug := range fb.BugInstance {
+			if bug.Priority == "1" {
+				high++
+			}
+		}
+		row.FindbugsBugs = strconv.Itoa(len(fb.BugInstance))
+		row.FindbugsHighPriority = strconv.Itoa(high)
+	}
+
+	if lateness := extractLateness(keyval); lateness != nil {
+		row.LateHours = formatFloat(lateness.Late.Hours())
+		row.LatePenalty = formatFloat(lateness.Penalty)
+	}
+
+	if res.Error != nil {
+		row.Error = res.Error.Error()
+	}
+	return row
+}
+
+func (row GradebookRow) record() []string {
+	return []string{
+		row.Student,
+		row.Repo,
+		row.SHA,
+		row.Score,
+		row.Compiled,
+		row.TestsPassed,
+		row.TestsTotal,
+		row.CheckstyleErrors,
+		row.CheckstyleWarnings,
+		row.FindbugsBugs,
+		row.FindbugsHighPriority,
+		row.LateHours,
+		row.LatePenalty,
+		row.Error,
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Gradebook collects the results of a batch of jobs. It is safe to add results from several goroutines.
+// Adding a second result for the same student replaces the first. Results without a student,
+// e.g. from a job which failed before identifying one, are all kept.
+type Gradebook struct {
+	mu      sync.Mutex
+	rows    map[string]GradebookRow
+	unnamed []GradebookRow
+}
+
+// NewGradebook creates an empty gradebook.
+func NewGradebook() *Gradebook {
+	return &Gradebook{rows: map[string]GradebookRow{}}
+}
+
+// Add records the result of a pipeline run in the gradebook.
+func (g *Gradebook) Add(res *pipeline.Result) {
+	g.AddRow(NewGradebookRow(res))
+}
+
+// AddRow records an already summarized job in the gradebook.
+func (g *Gradebook) AddRow(row GradebookRow) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if row.Student == "" {
+		g.unnamed = append(g.unnamed, row)
+		return
+	}
+	g.rows[row.Student] = row
+}
+
+// Rows returns the recorded rows sorted by student, followed by those without a student in the order they were added.
+func (g *Gradebook) Rows() []GradebookRow {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rows := make([]GradebookRow, 0, len(g.rows)+len(g.unnamed))
+	for _, row := range g.rows {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Student < rows[j].Student })
+	return append(rows, g.unnamed...)
+}
+
+// Write writes the gradebook as delimited text, e.g. ',' for CSV or '\t' for TSV.
+func (g *Gradebook) Write(w io.Writer, comma rune) error {
+	out := csv.NewWriter(w)
+	out.Comma = comma
+
+	if err := out.Write(GradebookColumns); err != nil {
+		return err
+	}
+	for _, row := range g.Rows() {
+		if err := out.Write(row.record()); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Merge writes the gradebook merged into an existing roster. Every roster row and column is kept in order,
+// with the gradebook columns (except "student") appended or overwritten. Roster rows are matched on the
+// studentColumn, and the rows of students without a result in the gradebook are left as they are;
+// students who were graded but are missing from the roster are added at the end.
+// The roster and the output use the same delimiter.
+func (g *Gradebook) Merge(w io.Writer, roster io.Reader, studentColumn string, comma rune) error {
+	in := csv.NewReader(roster)
+	in.Comma = comma
+	in.FieldsPerRecord = -1
+	records, err := in.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("roster is empty")
+	}
+
+	header := records[0]
+	keyCol := indexOf(header, studentColumn)
+	if keyCol < 0 {
+		return errors.New("roster has no column " + studentColumn)
+	}
+	// Keep the cells of rows longer than the header clear of the appended columns
+	for _, record := range records[1:] {
+		for len(header) < len(record) {
+			header = append(header, "")
+		}
+	}
+
+	// Map every gradebook column onto a column of the merged file
+	cols := make([]int, len(GradebookColumns))
+	for i, name := range GradebookColumns {
+		if name == "student" {
+			cols[i] = keyCol
+			continue
+		}
+		if cols[i] = indexOf(header, name); cols[i] < 0 {
+			header = append(header, name)
+			cols[i] = len(header) - 1
+		}
+	}
+
+	out := csv.NewWriter(w)
+	out.Comma = comma
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	graded := map[string]GradebookRow{}
+	for _, row := range g.Rows() {
+		if row.Student != "" {
+			graded[row.Student] = row
+		}
+	}
+
+	fill := func(record []string, row GradebookRow) []string {
+		merged := make([]string, len(header))
+		copy(merged, record)
+		for i, val := range row.record() {
+			merged[cols[i]] = val
+		}
+		return merged
+	}
+
+	for _, record := range records[1:] {
+		student := ""
+		if keyCol < len(record) {
+			student = strings.TrimSpace(record[keyCol])
+		}
+		row, ok := graded[student]
+		if !ok {
+			if err := out.Write(record); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(graded, student)
+		if err := out.Write(fill(record, row)); err != nil {
+			return err
+		}
+	}
+
+	for _, row := range g.Rows() {
+		if _, ok := graded[row.Student]; !ok && row.Student != "" {
+			continue
+		}
+		if err := out.Write(fill(nil, row)); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// WriteFile writes the gradebook to path, as TSV if the file ends in ".tsv" and CSV otherwise.
+// If rosterPath is not "", the gradebook is merged into the roster, matching rows on the student column.
+// The file is replaced once written, so that path may be the roster itself.
+func (g *Gradebook) WriteFile(path, rosterPath string) error {
+	comma := ','
+	if strings.EqualFold(filepath.Ext(path), ".tsv") {
+		comma = '\t'
+	}
+
+	var roster []byte
+	if rosterPath != "" {
+		var err error
+		if roster, err = ioutil.ReadFile(rosterPath); err != nil {
+			return err
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if rosterPath == "" {
+		err = g.Write(f, comma)
+	} else {
+		err = g.Merge(f, bytes.NewReader(roster), "student", comma)
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func indexOf(list []string, str string) int {
+	for i, s := range list {
+		if strings.EqualFold(strings.TrimSpace(s), str) {
+			return i
+		}
+	}
+	return -1
+}
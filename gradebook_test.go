@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+)
+
+func testGradebook() *Gradebook {
+	book := NewGradebook()
+	book.Add(&pipeline.Result{KeyVal: map[string]interface{}{
+		"OWNER":    "bob",
+		"REPO":     "hw1",
+		"SHA":      "abc123",
+		"score":    9.5,
+		"compiled": true,
+		"tests":    []TestResult{{Name: "a", Passed: true}, {Name: "b"}},
+		"lateness": &Lateness{Late: 90 * time.Minute, Penalty: 0.1},
+	}})
+	book.Add(&pipeline.Result{
+		Error:  errors.New("compile failed"),
+		KeyVal: map[string]interface{}{"STUDENT": "alice", "OWNER": "class", "REPO": "hw1-alice", "compiled": false},
+	})
+	return book
+}
+
+func TestGradebookWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testGradebook().Write(&buf, '\t'); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		strings.Join(GradebookColumns, "\t"),
+		"alice\tclass/hw1-alice\t\t\tfalse\t\t\t\t\t\t\t\t\tcompile failed",
+		"bob\tbob/hw1\tabc123\t9.5\ttrue\t1\t2\t\t\t\t\t1.5\t0.1\t",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("expected:\n%q\nobserved:\n%q", expected, buf.String())
+	}
+}
+
+func TestGradebookMerge(t *testing.T) {
+	roster := "Student,Name,score\ncarol,Carol C,old\nbob,Bob B,old,extra\n"
+
+	var buf bytes.Buffer
+	if err := testGradebook().Merge(&buf, strings.NewReader(roster), "student", ','); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 rows, observed:\n%v", buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "Student,Name,score,,repo,sha,compiled") {
+		t.Errorf("unexpected header %v", lines[0])
+	}
+	if lines[1] != "carol,Carol C,old" {
+		t.Errorf("ungraded roster row should be left as it is: %v", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "bob,Bob B,9.5,extra,bob/hw1,abc123,true") {
+		t.Errorf("graded roster row was not merged: %v", lines[2])
+	}
+	if !strings.HasPrefix(lines[3], "alice,,,,class/hw1-alice") {
+		t.Errorf("student missing from the roster should be appended: %v", lines[3])
+	}
+}
+
+func TestGradebookUnnamed(t *testing.T) {
+	book := testGradebook()
+	book.Add(&pipeline.Result{Error: errors.New("no OWNER")})
+	book.Add(&pipeline.Result{Error: errors.New("no REPO")})
+
+	rows := book.Rows()
+	if len(rows) != 4 || rows[2].Error != "no OWNER" || rows[3].Error != "no REPO" {
+		t.Errorf("expected both results without a student after the others, observed %+v", rows)
+	}
+
+	var buf bytes.Buffer
+	if err := book.Merge(&buf, strings.NewReader("student\nbob\n\"\"\n"), "student", ','); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 6 {
+		t.Errorf("expected a header, 2 roster rows and 3 added rows, observed:\n%v", buf.String())
+	}
+}
+
+func TestGradebookWriteFileInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gradebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "roster.csv")
+	if err := ioutil.WriteFile(path, []byte("student,name\ncarol,Carol C\nbob,Bob B\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := testGradebook().WriteFile(path, path); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(blob)), "\n")
+	if len(lines) != 4 || lines[1] != "carol,Carol C" || !strings.HasPrefix(lines[2], "bob,Bob B,bob/hw1") {
+		t.Errorf("expected the roster merged with the gradebook, observed:\n%s", blob)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected no file left beside the gradebook, observed %v files", len(files))
+	}
+}
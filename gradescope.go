@@ -0,0 +1,202 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultGradescopeResultsLoc is where the Gradescope harness expects to find the results.
+	DefaultGradescopeResultsLoc = "/autograder/results/results.json"
+	// DefaultGradescopeVisibility is the visibility of the results if no other is specified.
+	DefaultGradescopeVisibility = "visible"
+)
+
+// GradescopeResults is the results.json schema read by the Gradescope autograder harness.
+type GradescopeResults struct {
+	Score            *float64         `json:"score,omitempty"`
+	Output           string           `json:"output,omitempty"`
+	Visibility       string           `json:"visibility,omitempty"`
+	StdoutVisibility string           `json:"stdout_visibility,omitempty"`
+	Tests            []GradescopeTest `json:"tests"`
+}
+
+// GradescopeTest is a single entry of the "tests" list in results.json.
+type GradescopeTest struct {
+	Name       string   `json:"name"`
+	Score      *float64 `json:"score,omitempty"`
+	MaxScore   *float64 `json:"max_score,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Output     string   `json:"output,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+}
+
+// GradescopeStep converts the test results, lint findings, and score found in the request
+// into Gradescope's results.json and writes it to disk.
+type GradescopeStep struct {
+	path             string
+	visibility       string
+	stdoutVisibility string
+	log              *logrus.Logger
+	pipeline.StepContext
+}
+
+// NewGradescopeStep creates a step which writes results.json to the given path.
+// If any of the arguments are left as "", then they will use the package defaults instead.
+// Visibilities are one of "hidden", "after_due_date", "after_published", or "visible".
+func NewGradescopeStep(path, visibility, stdoutVisibility string, logger *logrus.Logger) *GradescopeStep {
+	if path == "" {
+		path = DefaultGradescopeResultsLoc
+	}
+	if visibility == "" {
+		visibility = DefaultGradescopeVisibility
+	}
+	if stdoutVisibility == "" {
+		stdoutVisibility = visibility
+	}
+	return &GradescopeStep{
+		path:             path,
+		visibility:       visibility,
+		stdoutVisibility: stdoutVisibility,
+		log:              logger,
+	}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (g *GradescopeStep) Exec(request *pipeline.Request) *pipeline.Result {
+	results := NewGradescopeResults(request.KeyVal)
+	results.Visibility = g.visibility
+	results.StdoutVisibility = g.stdoutVisibility
+
+	if err := g.write(results); err != nil {
+		g.Status("Failed to write the Gradescope results")
+		return &pipeline.Result{Error: err}
+	}
+	g.log.Infof("Wrote Gradescope results to %v", g.path)
+
+	nextMap := fromMap(request.KeyVal)
+	nextMap["gradescope"] = results
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+func (g *GradescopeStep) write(results *GradescopeResults) error {
+	blob, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(g.path, blob, 0644)
+}
+
+// Cancel is a no-op
+func (g *GradescopeStep) Cancel() error {
+	g.Status("cancel step")
+	return nil
+}
+
+// NewGradescopeResults builds the Gradescope results from the values left in the KeyVal by earlier steps:
+// "tests" ([]TestResult), "checkstyle" (*Checkstyle), "findbugs" (XML string), "score" and "lateness",
+// and tells the student which step timed out if "error" holds a TimeoutError.
+// When no "score" has been computed Gradescope sums the test scores itself.
+func NewGradescopeResults(keyval map[string]interface{}) *GradescopeResults {
+	results := &GradescopeResults{Tests: []GradescopeTest{}}
+
+	for _, test := range extractTests(keyval) {
+		results.Tests = append(results.Tests, gradescopeTest(test))
+	}
+
+	if check, err := extractCheckstyle(keyval, "checkstyle"); err == nil {
+		results.Tests = append(results.Tests, checkstyleTest(check))
+	}
+
+	if fb := extractFindbugs(keyval); fb != nil {
+		results.Tests = append(results.Tests, findbugsTest(fb))
+	}
+
+	if score, ok := extractScore(keyval); ok {
+		results.Score = &score
+	}
+
+	var output []string
+	if timeoutErr := extractTimeout(keyval); timeoutErr != nil {
+		output = append(output, timeoutMessage(timeoutErr))
+	}
+	if lateness := extractLateness(keyval); lateness != nil {
+		output = append(output, lateness.String())
+	}
+	results.Output = strings.Join(output, "\n")
+
+	return results
+}
+
+func gradescopeTest(test TestResult) GradescopeTest {
+	var (
+		score    = test.Score
+		maxScore = test.MaxScore
+		status   = "failed"
+	)
+	if test.Passed {
+		status = "passed"
+	}
+	gs := GradescopeTest{
+		Name:     test.Name,
+		Score:    &score,
+		MaxScore: &maxScore,
+		Status:   status,
+		Output:   test.Output,
+	}
+	if test.Hidden {
+		gs.Visibility = "hidden"
+	}
+	return gs
+}
+
+func checkstyleTest(check *Checkstyle) GradescopeTest {
+	var lines []string
+	for _, f := range check.File {
+		for _, e := range f.Error {
+			lines = append(lines, fmt.Sprintf("%s:%s: [%s] %s", f.Name, e.Line, e.Severity, e.Message))
+		}
+	}
+	return lintTest("Checkstyle", lines)
+}
+
+func findbugsTest(fb *FindbugsReport) GradescopeTest {
+	var lines []string
+	for _, bug := range fb.BugInstance {
+		lines = append(lines, fmt.Sprintf("%s: [%s] %s", bug.location(), bug.Category, bug.LongMessage))
+	}
+	return lintTest("FindBugs", lines)
+}
+
+// lintTest reports lint findings as an unscored test, which passes if there are no findings.
+func lintTest(name string, findings []string) GradescopeTest {
+	if len(findings) == 0 {
+		return GradescopeTest{Name: name, Status: "passed", Output: "No problems found."}
+	}
+	return GradescopeTest{
+		Name:   name,
+		Status: "failed",
+		Output: fmt.Sprintf("%v problems found:\n%s", len(findings), strings.Join(findings, "\n")),
+	}
+}
+
+func (bug FindbugsBug) location() string {
+	if len(bug.SourceLine) == 0 {
+		return "unknown"
+	}
+	line := bug.SourceLine[0]
+	return line.Sourcepath + ":" + line.Start
+}
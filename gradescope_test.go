@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGradescopeStep(t *testing.T) {
+	const name = "test pipeline 1"
+
+	dir, err := ioutil.TempDir("", "gradescope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkOut, err := ioutil.ReadFile(".test/checkstyle.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check Checkstyle
+	if err = xml.Unmarshal(checkOut, &check); err != nil {
+		t.Fatal(err)
+	}
+	fbOut, err := ioutil.ReadFile(".test/findbugs.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		path = filepath.Join(dir, "results", "results.json")
+		seed = NewSeedStep(map[string]interface{}{
+			"tests": []TestResult{
+				{Name: "adds", Score: 2, MaxScore: 2, Passed: true},
+				{Name: "subtracts", Score: 0, MaxScore: 2, Output: "expected 1, got 3", Hidden: true},
+			},
+			"checkstyle": &check,
+			"findbugs":   string(fbOut),
+			"score":      2.0,
+		})
+		gradescope = NewGradescopeStep(path, "", "hidden", logrus.New())
+		workpipe   = pipeline.New(name, 10000)
+		stage      = pipeline.NewStage(name, false, false)
+	)
+
+	stage.AddStep(seed)
+	stage.AddStep(gradescope)
+	workpipe.AddStage(stage)
+
+	if res := workpipe.Run(); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results GradescopeResults
+	if err = json.Unmarshal(blob, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.Score == nil || *results.Score != 2 {
+		t.Errorf("expected a score of 2, observed %v", results.Score)
+	}
+	if results.Visibility != "visible" || results.StdoutVisibility != "hidden" {
+		t.Errorf("unexpected visibilities %q and %q", results.Visibility, results.StdoutVisibility)
+	}
+	if len(results.Tests) != 4 {
+		t.Fatalf("expected 2 tests and 2 lint entries, observed %v", len(results.Tests))
+	}
+	if test := results.Tests[1]; test.Status != "failed" || test.Visibility != "hidden" || *test.MaxScore != 2 {
+		t.Errorf("unexpected test entry %+v", test)
+	}
+	if lint := results.Tests[3]; lint.Name != "FindBugs" || lint.Status != "failed" || lint.Score != nil {
+		t.Errorf("unexpected FindBugs entry %+v", lint)
+	}
+}
+
+func TestGradescopeTimeout(t *testing.T) {
+	var cases = []struct {
+		err      error
+		expected string
+	}{
+		{&TimeoutError{Step: "tests", Timeout: 2 * time.Minute}, `Step "tests" timed out after 2m0s`},
+		{StepErrors{&StudentError{Err: errors.New("exit status 1")}, &TimeoutError{Timeout: time.Minute}}, "Grading timed out after 1m0s"},
+		{errors.New("exit status 1"), ""},
+	}
+
+	for _, c := range cases {
+		keyVal := map[string]interface{}{"error": c.err, "score": 1.0}
+		results := NewGradescopeResults(keyVal)
+		if !strings.Contains(results.Output, c.expected) || c.expected == "" && results.Output != "" {
+			t.Errorf("expected the output to contain %q, observed %q", c.expected, results.Output)
+		}
+		if comment := feedback(keyVal); !strings.HasPrefix(comment, c.expected) || c.expected == "" && comment != "Score: 1" {
+			t.Errorf("expected the feedback to start with %q, observed %q", c.expected, comment)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"github.com/sirupsen/logrus"
+)
+
+const testSpec = `
+name: hw1
+version: "3"
+stages:
+  - name: build
+    steps:
+      - type: command
+        params: {name: compile, command: echo compiled}
+  - name: test
+    steps:
+      - type: command
+        params: {command: echo compiled; exit 1, student: true}
+`
+
+func TestRecorder(t *testing.T) {
+	spec, err := jobs.ParseJobSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyVal := map[string]interface{}{"OWNER": "bob", "REPO": "hw1-bob", "SHA": "abc123"}
+	rec := NewRecorder("delivery-1", 2, "hw1.yml", spec, keyVal)
+	workpipe, err := spec.WrappedPipeline(logrus.New(), rec.Wrap, jobs.NewSeedStep(keyVal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := jobs.RunWithStatus(workpipe, rec.Status)
+	run := rec.Finish(res, res.Error)
+
+	if run.ID != "delivery-1-2" || run.Assignment != "hw1" || run.Version != "3" || run.Student != "bob" || run.SHA != "abc123" {
+		t.Errorf("unexpected inputs %+v", run)
+	}
+	if run.Status != StatusStudentFailure {
+		t.Errorf("expected a student failure, observed %v", run.Status)
+	}
+	if len(run.Steps) != 2 {
+		t.Fatalf("expected 2 steps, observed %+v", run.Steps)
+	}
+	if step := run.Steps[0]; step.Stage != "build" || step.Name != "compile" || step.Status != StepDone || step.Started.IsZero() {
+		t.Errorf("unexpected step %+v", step)
+	}
+	if step := run.Steps[1]; step.Name != "command" || step.Status != StepFailed || step.Error == "" {
+		t.Errorf("unexpected step %+v", step)
+	}
+	if run.KeyVal["stdout"] != "compiled\n" {
+		t.Errorf("expected the last KeyVal, observed %v", run.KeyVal)
+	}
+	if run.KeyVal["exit_code"] != 1 || run.KeyVal["OWNER"] != "bob" {
+		t.Errorf("expected the KeyVal of the failed step along with that of the steps before it, observed %v", run.KeyVal)
+	}
+
+	rec = NewRecorder("delivery-2", 1, "hw1.yml", spec, keyVal)
+	run = rec.Finish(&pipeline.Result{KeyVal: map[string]interface{}{"score": 7, "SHA": "def456"}}, nil)
+	if run.Status != StatusPassed || run.Score == nil || *run.Score != 7 || run.SHA != "def456" {
+		t.Errorf("expected a pass scored 7 at def456, observed %v %v %v", run.Status, run.Score, run.SHA)
+	}
+}
+
+// A step which fails without a KeyVal leaves the history with the KeyVal of the steps before it
+func TestRecorderFailedStep(t *testing.T) {
+	spec, err := jobs.ParseJobSpec([]byte(`
+name: hw1
+stages:
+  - name: build
+    steps:
+      - type: command
+        params: {name: compile, command: echo compiled}
+      - type: local
+        params: {path: /nonexistent}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyVal := map[string]interface{}{"OWNER": "bob"}
+	rec := NewRecorder("delivery-1", 1, "hw1.yml", spec, keyVal)
+	workpipe, err := spec.WrappedPipeline(logrus.New(), rec.Wrap, jobs.NewSeedStep(keyVal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := jobs.RunWithStatus(workpipe, rec.Status)
+	run := rec.Finish(res, res.Error)
+
+	if run.Status != StatusInfraFailure || run.Steps[1].Status != StepFailed {
+		t.Errorf("expected the local step to fail, observed %v and %+v", run.Status, run.Steps)
+	}
+	if run.KeyVal["stdout"] != "compiled\n" || run.KeyVal["OWNER"] != "bob" || run.KeyVal["timings"] == nil {
+		t.Errorf("expected the KeyVal of the steps before the failed one, observed %v", run.KeyVal)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenBoltStore(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Date(2017, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for i, run := range []*Run{
+		{ID: "a-1", Job: "a", Student: "bob", Assignment: "hw1", Status: StatusInfraFailure},
+		{ID: "a-2", Job: "a", Student: "bob", Assignment: "hw1", Status: StatusPassed, Log: []string{"compiling", "testing"}},
+		{ID: "b-1", Job: "b", Student: "carol", Assignment: "hw1", Status: StatusPassed},
+		{ID: "c-1", Job: "c", Student: "bob", Assignment: "hw2", Status: StatusPassed},
+	} {
+		run.Started = start.Add(time.Duration(i) * time.Hour)
+		if err := store.Save(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := store.List(Query{Student: "bob", Assignment: "hw1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].ID != "a-2" || runs[0].Log != nil {
+		t.Errorf("expected the summaries of bob's hw1 runs, newest first, observed %+v", runs)
+	}
+
+	server := httptest.NewServer(NewHandler(store, logrus.New()))
+	defer server.Close()
+
+	var listed []*Run
+	if err := getJSON(server.URL+"/runs?student=bob&limit=1", &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != "c-1" {
+		t.Errorf("expected bob's latest run, observed %+v", listed)
+	}
+
+	var run Run
+	if err := getJSON(server.URL+"/runs/a-2", &run); err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != StatusPassed || len(run.Log) != 2 {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	resp, err := http.Get(server.URL + "/runs/a-2/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(blob) != "compiling\ntesting\n" {
+		t.Errorf("unexpected log %q", blob)
+	}
+
+	if resp, _ := http.Get(server.URL + "/runs/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing run, observed %v", resp.StatusCode)
+	}
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		blob, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(blob)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,102 @@
+package history
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handler serves the runs of a store as JSON:
+//
+//	GET /runs?student=bob&assignment=hw1&job=...&limit=20   summaries of the matching runs, newest first
+//	GET /runs/{id}                                          a run with its steps, KeyVal and log
+//	GET /runs/{id}/log                                      the log of a run as text
+type Handler struct {
+	store Store
+	log   *logrus.Logger
+}
+
+// NewHandler creates a handler serving the runs of the store. Mount it on both /runs and /runs/.
+func NewHandler(store Store, logger *logrus.Logger) *Handler {
+	return &Handler{store: store, log: logger}
+}
+
+// ServeHTTP serves a request for runs.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs"), "/")
+	if path == "" {
+		h.list(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "log") {
+		http.NotFound(w, r)
+		return
+	}
+	run, err := h.store.Get(parts[0])
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range run.Log {
+			w.Write([]byte(line + "\n"))
+		}
+		return
+	}
+	writeJSON(w, run)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := Query{
+		Student:    params.Get("student"),
+		Assignment: params.Get("assignment"),
+		Job:        params.Get("job"),
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	runs, err := h.store.List(q)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	if runs == nil {
+		runs = []*Run{}
+	}
+	writeJSON(w, runs)
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.log.Errorf("Could not read the history: %v", err)
+	http.Error(w, "could not read the history", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,235 @@
+// Package history records every grading run, so that a TA can look up what was graded,
+// how long each step took, and what the student was told.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+)
+
+// The outcomes of a run.
+const (
+	StatusRunning        = "running"
+	StatusPassed         = "passed"
+	StatusStudentFailure = "student_failure"
+	StatusInfraFailure   = "infra_failure"
+	StatusTimeout        = "timeout"
+)
+
+// maxLogLines bounds the status lines kept per run.
+const maxLogLines = 10000
+
+// Run is the record of a single run of a job.
+type Run struct {
+	ID         string `json:"id"`
+	Job        string `json:"job"`
+	Attempt    int    `json:"attempt"`
+	Assignment string `json:"assignment"`
+	Spec       string `json:"spec,omitempty"`
+	Version    string `json:"spec_version,omitempty"`
+
+	Student string `json:"student,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	SHA     string `json:"sha,omitempty"`
+
+	Status   string       `json:"status"`
+	Error    string       `json:"error,omitempty"`
+	Score    *float64     `json:"score,omitempty"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished,omitempty"`
+	Duration float64      `json:"duration_seconds"`
+	Steps    []StepRecord `json:"steps,omitempty"`
+
+	// KeyVal holds the final KeyVal of the pipeline, such as the findings and test results.
+	// Values which do not serialize are stored as text.
+	KeyVal map[string]interface{} `json:"keyval,omitempty"`
+	// Log holds the status lines emitted by the steps.
+	Log []string `json:"log,omitempty"`
+}
+
+// StepRecord is the record of a single step of a run.
+type StepRecord struct {
+	Stage    string    `json:"stage"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// The status of a step.
+const (
+	StepPending = "pending"
+	StepRunning = "running"
+	StepDone    = "done"
+	StepFailed  = "failed"
+)
+
+// Summary returns a copy of the run without its KeyVal and log, as listed by the query API.
+func (run *Run) Summary() *Run {
+	summary := *run
+	summary.KeyVal, summary.Log = nil, nil
+	return &summary
+}
+
+// Recorder builds the record of a run as its pipeline runs.
+// Its Wrap method is a jobs.StepWrapper, and its Status method receives the status lines of jobs.RunWithStatus.
+type Recorder struct {
+	mu  sync.Mutex
+	run *Run
+	// last is the latest KeyVal seen by a step, kept since a failed pipeline returns none.
+	last map[string]interface{}
+}
+
+// NewRecorder starts the record of an attempt at a job, whose pipeline is built from spec and seeded with keyVal.
+func NewRecorder(job string, attempt int, specPath string, spec *jobs.JobSpec, keyVal map[string]interface{}) *Recorder {
+	run := &Run{
+		ID:         fmt.Sprintf("%v-%v", job, attempt),
+		Job:        job,
+		Attempt:    attempt,
+		Assignment: spec.Name,
+		Spec:       specPath,
+		Version:    spec.Version,
+		Status:     StatusRunning,
+		Started:    time.Now().UTC(),
+	}
+	run.setInputs(keyVal)
+	return &Recorder{run: run}
+}
+
+// Wrap times the step and records its outcome.
+func (r *Recorder) Wrap(stage string, spec jobs.StepSpec, step pipeline.Step) pipeline.Step {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Steps = append(r.run.Steps, StepRecord{Stage: stage, Name: spec.Name(), Type: spec.Type, Status: StepPending})
+	return jobs.Use(spec.Name(), step, r.record(len(r.run.Steps)-1))
+}
+
+// Status appends a status line to the log.
+func (r *Recorder) Status(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.run.Log) < maxLogLines {
+		r.run.Log = append(r.run.Log, line)
+	}
+}
+
+// Run returns a copy of the record so far.
+func (r *Recorder) Run() *Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.copy()
+}
+
+func (r *Recorder) copy() *Run {
+	run := *r.run
+	run.Steps = append([]StepRecord(nil), r.run.Steps...)
+	run.Log = append([]string(nil), r.run.Log...)
+	return &run
+}
+
+// Finish completes the record with the result of the pipeline, which is nil if it could not run, and err, the failure of the job if any.
+// If the result holds no KeyVal, as when a step failed, the last KeyVal seen by a step is recorded instead.
+func (r *Recorder) Finish(res *pipeline.Result, err error) *Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run := r.run
+	run.Finished = time.Now().UTC()
+	run.Duration = run.Finished.Sub(run.Started).Seconds()
+	run.Status = StatusPassed
+	if err != nil {
+		run.Error = err.Error()
+		run.Status = StatusInfraFailure
+		switch {
+		case jobs.IsStudentError(err):
+			run.Status = StatusStudentFailure
+		case jobs.IsTimeout(err):
+			run.Status = StatusTimeout
+		}
+	}
+
+	final := r.last
+	if res != nil && res.KeyVal != nil {
+		final = res.KeyVal
+	}
+	if final != nil {
+		run.setInputs(final)
+		run.KeyVal = map[string]interface{}{}
+		for key, val := range final {
+			// Keep what serializes, and describe what does not
+			if _, err := json.Marshal(val); err != nil {
+				val = fmt.Sprint(val)
+			}
+			run.KeyVal[key] = val
+		}
+		switch score := final["score"].(type) {
+		case float64:
+			run.Score = &score
+		case int:
+			f := float64(score)
+			run.Score = &f
+		}
+	}
+	return r.copy()
+}
+
+// setInputs copies the submission fields found in the KeyVal, e.g. the SHA resolved by a fetch step.
+func (run *Run) setInputs(keyVal map[string]interface{}) {
+	for key, field := range map[string]*string{"OWNER": &run.Owner, "REPO": &run.Repo, "REF": &run.Ref, "SHA": &run.SHA, "STUDENT": &run.Student} {
+		if val, ok := keyVal[key].(string); ok && val != "" {
+			*field = val
+		}
+	}
+	if run.Student == "" {
+		run.Student = run.Owner
+	}
+}
+
+func (r *Recorder) stepStarted(index int, keyVal map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if keyVal != nil {
+		r.last = keyVal
+	}
+	r.run.Steps[index].Status = StepRunning
+	r.run.Steps[index].Started = time.Now().UTC()
+}
+
+func (r *Recorder) stepFinished(index int, res *pipeline.Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if res != nil {
+		err = res.Error
+		if res.KeyVal != nil {
+			r.last = res.KeyVal
+		}
+	}
+	step := &r.run.Steps[index]
+	step.Duration = time.Since(step.Started).Seconds()
+	step.Status = StepDone
+	if err != nil {
+		step.Status, step.Error = StepFailed, err.Error()
+	}
+}
+
+// record records when the step at the index starts and ends.
+func (r *Recorder) record(index int) jobs.Middleware {
+	return func(name string, step pipeline.Step, next jobs.ExecFunc) jobs.ExecFunc {
+		return func(request *pipeline.Request) *pipeline.Result {
+			r.stepStarted(index, request.KeyVal)
+			res := next(request)
+			r.stepFinished(index, res)
+			return res
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var runsBucket = []byte("runs")
+
+// Query selects runs. Empty fields match every run.
+type Query struct {
+	Student    string
+	Assignment string
+	Job        string
+	// Limit bounds the number of runs returned, newest first, if positive.
+	Limit int
+}
+
+func (q Query) matches(run *Run) bool {
+	return (q.Student == "" || q.Student == run.Student) &&
+		(q.Assignment == "" || q.Assignment == run.Assignment) &&
+		(q.Job == "" || q.Job == run.Job)
+}
+
+// Store persists runs.
+type Store interface {
+	// Save stores the run, replacing any run with the same ID.
+	Save(run *Run) error
+	// Get returns the run with the given ID, or nil.
+	Get(id string) (*Run, error)
+	// List returns the summaries of the runs matching the query, newest first.
+	List(q Query) ([]*Run, error)
+}
+
+// BoltStore is a Store kept in a BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the store at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open the history %v: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(runsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Save stores the run, replacing any run with the same ID.
+func (s *BoltStore) Save(run *Run) error {
+	blob, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).Put([]byte(run.ID), blob)
+	})
+}
+
+// Get returns the run with the given ID, or nil.
+func (s *BoltStore) Get(id string) (*Run, error) {
+	var run *Run
+	err := s.db.View(func(tx *bolt.Tx) error {
+		blob := tx.Bucket(runsBucket).Get([]byte(id))
+		if blob == nil {
+			return nil
+		}
+		run = &Run{}
+		return json.Unmarshal(blob, run)
+	})
+	return run, err
+}
+
+// List returns the summaries of the runs matching the query, newest first.
+// It reads every run, which is fine for the few thousand runs of a course.
+func (s *BoltStore) List(q Query) ([]*Run, error) {
+	var runs []*Run
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).ForEach(func(k, v []byte) error {
+			var run Run
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			if q.matches(&run) {
+				runs = append(runs, run.Summary())
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.After(runs[j].Started)
+	})
+	if q.Limit > 0 && len(runs) > q.Limit {
+		runs = runs[:q.Limit]
+	}
+	return runs, nil
+}
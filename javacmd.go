@@ -2,11 +2,12 @@ package jobs
 
 import (
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os/exec"
+	"path/filepath"
 
 	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/cgroup"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,6 +20,9 @@ type (
 		repoBase string
 		text     bool
 		log      *logrus.Logger
+		procs    procGroup
+		toolOutput
+		jobContext
 		pipeline.StepContext
 	}
 
@@ -28,14 +32,25 @@ type (
 		outputLoc string
 		text      bool
 		log       *logrus.Logger
+		procs     procGroup
+		toolOutput
+		jobContext
 		pipeline.StepContext
 	}
 
+	// toolOutput sets what a Checkstyle or FindBugs step keeps of the output of its JVM, like the MaxOutput,
+	// LogFile and StreamOutput of a CommandStep. A relative LogFile is relative to the source directory.
+	toolOutput struct {
+		MaxOutput    int
+		LogFile      string
+		StreamOutput bool
+	}
+
 	javacmd interface {
 		init(*pipeline.Request) error
 		setSrcDir(*pipeline.Request) error
 		Cmd() *exec.Cmd
-		pipeline.Step
+		ContextStep
 	}
 )
 
@@ -51,13 +66,30 @@ const (
 	DefaultFindBugsOutputLoc = "/findbugs_output.txt"
 	// DefaultSrcDir is where we look for the source code is no other location is provided
 	DefaultSrcDir = "/src"
-
-	cmdTmplFindBugs       = "java -jar %s -textui -xml:withMessages -effort:max -output %s %s"
-	cmdTmplFindBugsText   = "java -jar %s -textui                   -effort:max -output %s %s"
-	cmdTmplCheckstyle     = "java -jar %s -c %s -f xml %s"
-	cmdTmplCheckstyleText = "java -jar %s -c %s %s"
 )
 
+// javaCommand returns the command running the jar with the arguments. They are passed to java as they are,
+// without a shell, so paths holding spaces, quotes or $(...) reach the tool unchanged.
+func javaCommand(jarLoc string, args ...string) *exec.Cmd {
+	return exec.Command("java", append([]string{"-jar", jarLoc}, args...)...)
+}
+
+// outputs returns the stdout and stderr of a tool run over srcDir, and the function closing them
+// once it exited.
+func (t toolOutput) outputs(srcDir string, status func(string)) (stdout, stderr *boundedOutput, done func(), err error) {
+	limit := t.MaxOutput
+	if limit == 0 {
+		limit = DefaultMaxOutput
+	}
+	stdout, stderr = newBoundedOutput(limit, nil), newBoundedOutput(limit, nil)
+	path := t.LogFile
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(srcDir, path)
+	}
+	done, err = streamOutput(stdout, stderr, path, t.StreamOutput, status)
+	return stdout, stderr, done, err
+}
+
 // This line forces the compiler to check the method
 // sets of the findbugsStep and checkstyleStep types
 // to ensure that they both fulfill the javacmd interface
@@ -115,8 +147,18 @@ func (fb *findbugsStep) setSrcDir(request *pipeline.Request) error {
 func (fb *findbugsStep) launchCmd() (string, error) {
 
 	cmd := fb.Cmd()
-	_, err := cmd.Output()
+	// The report goes to outputLoc: keep what FindBugs prints to debug a failure
+	stdout, stderr, done, err := fb.outputs(fb.srcDir, fb.Status)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	span := startCmdSpan(fb.jobCtx(), "findbugs", cmd.Args)
+	err = fb.procs.run(fb.jobCtx(), cmd, cgroup.Limits{})
+	done()
+	endCmdSpan(span, cmd, err)
 	if err != nil {
+		fb.log.Warnf("FindBugs failed: %v\n%v\n%v", err, stdout, stderr)
 		return "", err
 	}
 
@@ -135,6 +177,7 @@ func (fb *findbugsStep) Exec(request *pipeline.Request) *pipeline.Result {
 	contents, err := fb.launchCmd()
 	nextMap := fromMap(request.KeyVal)
 	nextMap["findbugs"] = contents
+	recordUsage(nextMap, "findbugs", fb.procs.usage)
 
 	return &pipeline.Result{
 		Error:  err,
@@ -142,26 +185,18 @@ func (fb *findbugsStep) Exec(request *pipeline.Request) *pipeline.Result {
 	}
 }
 
+// Cancel stops FindBugs along with its JVM. See CommandStep.Cancel.
 func (fb *findbugsStep) Cancel() error {
 	fb.Status("Cancel")
-	return nil
+	return fb.procs.cancel()
 }
 
 func (fb *findbugsStep) Cmd() *exec.Cmd {
-	var strTmpl = cmdTmplFindBugs
-
+	args := []string{"-textui", "-xml:withMessages", "-effort:max", "-output", fb.outputLoc, fb.srcDir}
 	if fb.text {
-		strTmpl = cmdTmplFindBugsText
+		args = []string{"-textui", "-effort:max", "-output", fb.outputLoc, fb.srcDir}
 	}
-
-	cmd := fmt.Sprintf(
-		strTmpl,
-		fb.jarLoc,
-		fb.outputLoc,
-		fb.srcDir,
-	)
-
-	return exec.Command("bash", "-c", cmd)
+	return javaCommand(fb.jarLoc, args...)
 }
 
 func fromMap(m map[string]interface{}) map[string]interface{} {
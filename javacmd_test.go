@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/RobbieMcKinstry/pipeline"
@@ -125,3 +127,67 @@ func TestCanReadSchema2(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestJavaCmdArgs(t *testing.T) {
+	const srcDir = `/tmp/my "repo" $(rm -rf ~)`
+
+	var cases = []struct {
+		step     javacmd
+		expected []string
+	}{
+		{
+			NewCheckstyleStep("checkstyle.jar", srcDir, "checks.xml", "", false, logrus.New()),
+			[]string{"java", "-jar", "checkstyle.jar", "-c", "checks.xml", "-f", "xml", srcDir},
+		},
+		{
+			NewFindbugsStep("findbugs.jar", "out.xml", srcDir, true, logrus.New()).(javacmd),
+			[]string{"java", "-jar", "findbugs.jar", "-textui", "-effort:max", "-output", "out.xml", srcDir},
+		},
+	}
+	for _, c := range cases {
+		if args := c.step.Cmd().Args; !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("expected %q, observed %q", c.expected, args)
+		}
+	}
+}
+
+func TestJavaCmdOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "javacmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, stepType := range []string{"checkstyle", "findbugs"} {
+		spec := StepSpec{Type: stepType, Params: map[string]interface{}{"max_output": 1, "log_file": stepType + ".log", "stream": true}}
+		step, err := DefaultRegistry.Build(spec, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output toolOutput
+		switch step := step.(type) {
+		case *CheckstyleStep:
+			output = step.toolOutput
+		case *findbugsStep:
+			output = step.toolOutput
+		}
+		if output != (toolOutput{MaxOutput: 1024, LogFile: stepType + ".log", StreamOutput: true}) {
+			t.Fatalf("%v: unexpected output parameters %+v", stepType, output)
+		}
+
+		var lines []string
+		stdout, stderr, done, err := output.outputs(dir, func(line string) { lines = append(lines, line) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(stdout, "%s\n", strings.Repeat("x", 2000))
+		fmt.Fprintln(stderr, "warning")
+		done()
+		if len(stdout.String()) > 1100 || len(lines) != 2 || lines[1] != "stderr: warning" {
+			t.Errorf("%v: expected a bounded output streamed to the status, observed %v bytes and %q", stepType, len(stdout.String()), lines)
+		}
+		if log, err := ioutil.ReadFile(filepath.Join(dir, stepType+".log")); err != nil || len(log) != 2009 {
+			t.Errorf("%v: expected the whole output in the log file, observed %v bytes: %v", stepType, len(log), err)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package jobs
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+const day = 24 * time.Hour
+
+// LatePolicy decides how much of a score is lost for a late submission.
+type LatePolicy interface {
+	// Penalty returns the fraction of the score, between 0 and 1, deducted for a
+	// submission that is late by the given duration. It is never called with a duration <= 0.
+	Penalty(late time.Duration) float64
+	// String describes the policy in words a student can understand.
+	String() string
+}
+
+// HardCutoff gives no credit at all to late submissions.
+type HardCutoff struct{}
+
+// Penalty always deducts the full score.
+func (HardCutoff) Penalty(late time.Duration) float64 {
+	return 1
+}
+
+func (HardCutoff) String() string {
+	return "no credit after the deadline"
+}
+
+// PercentPerDay deducts Percent of the score for each day, or part of a day, that a submission is late.
+type PercentPerDay struct {
+	Percent float64
+}
+
+// Validate checks that Percent is more than 0 and at most 100.
+func (p PercentPerDay) Validate() error {
+	if !(p.Percent > 0 && p.Percent <= 100) {
+		return fmt.Errorf("late penalty of %v%% per day is not between 0 and 100", p.Percent)
+	}
+	return nil
+}
+
+// Penalty deducts Percent for every started day, capped at the full score.
+func (p PercentPerDay) Penalty(late time.Duration) float64 {
+	days := math.Ceil(float64(late) / float64(day))
+	return math.Max(0, math.Min(1, days*p.Percent/100))
+}
+
+func (p PercentPerDay) String() string {
+	return fmt.Sprintf("%v%% off per day late", p.Percent)
+}
+
+// GracePeriod forgives submissions that are less than Grace late, and applies Policy
+// to the lateness in excess of the grace period otherwise. A nil Policy is a HardCutoff.
+type GracePeriod struct {
+	Grace  time.Duration
+	Policy LatePolicy
+}
+
+// Penalty applies the wrapped policy to the time beyond the grace period.
+func (g GracePeriod) Penalty(late time.Duration) float64 {
+	if late <= g.Grace {
+		return 0
+	}
+	return g.policy().Penalty(late - g.Grace)
+}
+
+func (g GracePeriod) String() string {
+	return fmt.Sprintf("%v after a %v grace period", g.policy(), g.Grace)
+}
+
+func (g GracePeriod) policy() LatePolicy {
+	if g.Policy == nil {
+		return HardCutoff{}
+	}
+	return g.Policy
+}
+
+// Extensions maps a student identifier to their personal deadline.
+type Extensions map[string]time.Time
+
+// LoadExtensions reads per-student extensions from a CSV file. See ReadExtensions for the format.
+func LoadExtensions(path string, deadline time.Time) (Extensions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadExtensions(f, deadline)
+}
+
+// ReadExtensions parses per-student extensions from CSV. The first row is a header which must
+// contain a "student" column and either a "deadline" column holding an RFC 3339 timestamp
+// or an "hours" column holding the number of hours added to the assignment deadline.
+// A student whose cells are both empty has no extension.
+func ReadExtensions(r io.Reader, deadline time.Time) (Extensions, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return Extensions{}, nil
+	}
+
+	cols := map[string]int{}
+	for i, name := range rows[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	studentCol, ok := cols["student"]
+	if !ok {
+		return nil, errors.New("extensions file has no student column")
+	}
+	deadlineCol, hasDeadline := cols["deadline"]
+	hoursCol, hasHours := cols["hours"]
+	if !hasDeadline && !hasHours {
+		return nil, errors.New("extensions file needs a deadline or hours column")
+	}
+
+	ext := Extensions{}
+	for line, row := range rows[1:] {
+		student := strings.TrimSpace(row[studentCol])
+		if student == "" {
+			continue
+		}
+		if hasDeadline && strings.TrimSpace(row[deadlineCol]) != "" {
+			t, err := time.Parse(time.RFC3339, strings.TrimSpace(row[deadlineCol]))
+			if err != nil {
+				return nil, fmt.Errorf("extensions line %v: %v", line+2, err)
+			}
+			ext[student] = t
+			continue
+		}
+		if hasHours && strings.TrimSpace(row[hoursCol]) != "" {
+			hours, err := strconv.ParseFloat(strings.TrimSpace(row[hoursCol]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("extensions line %v: %v", line+2, err)
+			}
+			ext[student] = deadline.Add(time.Duration(hours * float64(time.Hour)))
+		}
+	}
+	return ext, nil
+}
+
+// Lateness records how late a submission was and the penalty it earned.
+type Lateness struct {
+	Student   string
+	Submitted time.Time
+	Deadline  time.Time
+	Extended  bool
+	Late      time.Duration
+	Penalty   float64
+	Policy    string
+}
+
+// Apply returns the score after deducting the late penalty.
+func (l *Lateness) Apply(score float64) float64 {
+	return score * (1 - l.Penalty)
+}
+
+// String explains the lateness to the student.
+func (l *Lateness) String() string {
+	if l.Late <= 0 {
+		return "Submitted on time."
+	}
+	deadline := "the deadline"
+	if l.Extended {
+		deadline = "your extended deadline"
+	}
+	return fmt.Sprintf(
+		"Submitted %v after %v (%v). Late policy: %v. Penalty: %v%% of the score.",
+		l.Late.Round(time.Minute), deadline, l.Deadline.Format(time.RFC1123), l.Policy, math.Round(l.Penalty*100),
+	)
+}
+
+// LatenessStep compares the commit timestamp of the graded SHA against the assignment deadline.
+// The computed *Lateness is stored under "lateness". If an earlier step stored a "score", the penalty
+// is applied to it, leaving a float64, and the unpenalized score is kept under "raw_score".
+type LatenessStep struct {
+	deadline   time.Time
+	policy     LatePolicy
+	extensions Extensions
+	client     *github.Client
+	log        *logrus.Logger
+	jobContext
+	pipeline.StepContext
+}
+
+// NewLatenessStep creates a step which applies the policy to submissions made after the deadline.
+// Students are identified by the STUDENT key, falling back to OWNER. The commit time is read from
+// "commit_time" if an earlier step set it, otherwise it is looked up on GitHub from OWNER, REPO, and SHA.
+func NewLatenessStep(deadline time.Time, policy LatePolicy, extensions Extensions, client *github.Client, logger *logrus.Logger) *LatenessStep {
+	if policy == nil {
+		policy = HardCutoff{}
+	}
+	return &LatenessStep{
+		deadline:   deadline,
+		policy:     policy,
+		extensions: extensions,
+		client:     client,
+		log:        logger,
+	}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (l *LatenessStep) Exec(request *pipeline.Request) *pipeline.Result {
+	submitted, err := l.commitTime(request.KeyVal)
+	if err != nil {
+		l.Status("Failed to determine the commit time")
+		return &pipeline.Result{Error: err}
+	}
+
+	lateness := l.compute(extractStudent(request.KeyVal), submitted)
+	l.log.Infof("Lateness for %v: %v", lateness.Student, lateness)
+
+	nextMap := fromMap(request.KeyVal)
+	nextMap["lateness"] = lateness
+	if score, ok := extractScore(nextMap); ok {
+		nextMap["raw_score"] = nextMap["score"]
+		nextMap["score"] = lateness.Apply(score)
+	}
+
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+func (l *LatenessStep) compute(student string, submitted time.Time) *Lateness {
+	lateness := &Lateness{
+		Student:   student,
+		Submitted: submitted,
+		Deadline:  l.deadline,
+		Policy:    l.policy.String(),
+	}
+	if extended, ok := l.extensions[student]; ok {
+		lateness.Deadline = extended
+		lateness.Extended = true
+	}
+	if late := submitted.Sub(lateness.Deadline); late > 0 {
+		lateness.Late = late
+		lateness.Penalty = l.policy.Penalty(late)
+	}
+	return lateness
+}
+
+func (l *LatenessStep) commitTime(keyval map[string]interface{}) (time.Time, error) {
+	if t, ok := keyval["commit_time"].(time.Time); ok {
+		return t, nil
+	}
+	if l.client == nil {
+		return time.Time{}, errors.New("no commit_time set and no GitHub client to look it up")
+	}
+
+	var owner, repo, sha string
+	var err error
+	if owner, err = extractStr(keyval, "OWNER"); err != nil {
+		return time.Time{}, err
+	}
+	if repo, err = extractStr(keyval, "REPO"); err != nil {
+		return time.Time{}, err
+	}
+	if sha, err = extractStr(keyval, "SHA"); err != nil {
+		return time.Time{}, err
+	}
+
+	commit, _, err := l.client.Repositories.GetCommit(l.jobCtx(), owner, repo, sha)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if commit.Commit == nil || commit.Commit.Committer == nil || commit.Commit.Committer.Date == nil {
+		return time.Time{}, errors.New("commit " + sha + " has no committer date")
+	}
+	return *commit.Commit.Committer.Date, nil
+}
+
+// Cancel is a no-op
+func (l *LatenessStep) Cancel() error {
+	l.Status("cancel step")
+	return nil
+}
@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLatePolicies(t *testing.T) {
+	var cases = []struct {
+		policy  LatePolicy
+		late    time.Duration
+		penalty float64
+	}{
+		{HardCutoff{}, time.Minute, 1},
+		{PercentPerDay{Percent: 10}, time.Minute, 0.1},
+		{PercentPerDay{Percent: 10}, 25 * time.Hour, 0.2},
+		{PercentPerDay{Percent: 40}, 80 * time.Hour, 1},
+		{GracePeriod{Grace: 2 * time.Hour, Policy: HardCutoff{}}, time.Hour, 0},
+		{GracePeriod{Grace: 2 * time.Hour, Policy: PercentPerDay{Percent: 10}}, 26 * time.Hour, 0.1},
+		{GracePeriod{Grace: 2 * time.Hour}, 3 * time.Hour, 1},
+	}
+
+	for _, c := range cases {
+		if penalty := c.policy.Penalty(c.late); penalty != c.penalty {
+			t.Errorf("%v late by %v: expected %v, observed %v", c.policy, c.late, c.penalty, penalty)
+		}
+	}
+}
+
+func TestReadExtensions(t *testing.T) {
+	deadline := time.Date(2017, 5, 1, 23, 59, 0, 0, time.UTC)
+	csv := "student,hours,deadline\nalice,48,\nbob,,2017-05-10T12:00:00Z\ncarol,,\n"
+
+	ext, err := ReadExtensions(strings.NewReader(csv), deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := deadline.Add(48 * time.Hour); !ext["alice"].Equal(expected) {
+		t.Errorf("expected %v, observed %v", expected, ext["alice"])
+	}
+	if expected := time.Date(2017, 5, 10, 12, 0, 0, 0, time.UTC); !ext["bob"].Equal(expected) {
+		t.Errorf("expected %v, observed %v", expected, ext["bob"])
+	}
+
+	if _, ok := ext["carol"]; ok {
+		t.Errorf("expected no extension for empty cells, observed %v", ext["carol"])
+	}
+
+	if _, err := ReadExtensions(strings.NewReader("name,hours\n"), deadline); err == nil {
+		t.Error("expected an error for a file without a student column")
+	}
+}
+
+func TestLatenessStep(t *testing.T) {
+	const name = "test pipeline 1"
+
+	var (
+		deadline  = time.Date(2017, 5, 1, 23, 59, 0, 0, time.UTC)
+		submitted = deadline.Add(30 * time.Hour)
+		ext       = Extensions{"carol": deadline.Add(24 * time.Hour)}
+		seed      = NewSeedStep(map[string]interface{}{"OWNER": "carol", "commit_time": submitted, "score": 80.0})
+		late      = NewLatenessStep(deadline, PercentPerDay{Percent: 10}, ext, nil, logrus.New())
+		workpipe  = pipeline.New(name, 10000)
+		stage     = pipeline.NewStage(name, false, false)
+	)
+
+	stage.AddStep(seed)
+	stage.AddStep(late)
+	workpipe.AddStage(stage)
+
+	res := workpipe.Run()
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	lateness, ok := res.KeyVal["lateness"].(*Lateness)
+	if !ok {
+		t.Fatal("no *Lateness in the response KeyVal")
+	}
+	if !lateness.Extended || lateness.Late != 6*time.Hour {
+		t.Errorf("expected 6h past the extension, observed %+v", lateness)
+	}
+	if score := res.KeyVal["score"]; score != 72.0 {
+		t.Errorf("expected a penalized score of 72, observed %v", score)
+	}
+	if raw := res.KeyVal["raw_score"]; raw != 80.0 {
+		t.Errorf("expected a raw score of 80, observed %v", raw)
+	}
+}
+
+func TestLatenessIntScore(t *testing.T) {
+	var (
+		deadline = time.Date(2017, 5, 1, 23, 59, 0, 0, time.UTC)
+		late     = NewLatenessStep(deadline, PercentPerDay{Percent: 10}, nil, nil, logrus.New())
+		request  = &pipeline.Request{KeyVal: map[string]interface{}{
+			"OWNER":       "dave",
+			"commit_time": deadline.Add(time.Hour),
+			"score":       80,
+		}}
+	)
+
+	res := late.Exec(request)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if score := res.KeyVal["score"]; score != 72.0 {
+		t.Errorf("expected a penalized score of 72, observed %v", score)
+	}
+	if raw := res.KeyVal["raw_score"]; raw != 80 {
+		t.Errorf("expected a raw score of 80, observed %v", raw)
+	}
+}
+
+func TestLatenessPercent(t *testing.T) {
+	var cases = []struct {
+		params   string
+		expected string
+	}{
+		{"{deadline: 2017-05-01T23:59:00Z, policy: percent}", "missing parameter"},
+		{"{deadline: 2017-05-01T23:59:00Z, policy: percent, percent: 0}", "not between 0 and 100"},
+		{"{deadline: 2017-05-01T23:59:00Z, policy: percent, percent: 150}", "not between 0 and 100"},
+		{"{deadline: 2017-05-01T23:59:00Z, policy: weekly}", "unknown late policy"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseJobSpec([]byte("name: x\nstages: [{name: a, steps: [{type: lateness, params: " + c.params + "}]}]"))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%v: expected an error containing %q, observed %v", c.params, c.expected, err)
+		}
+	}
+	if _, err := ParseJobSpec([]byte("name: x\nstages: [{name: a, steps: [{type: lateness, params: {deadline: 2017-05-01T23:59:00Z, policy: percent, percent: 10}}]}]")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,342 @@
+package jobs
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// LocalSourceStep grades a directory on disk instead of a GitHub repo, e.g. during office hours.
+// Like GithubFetchStep it stores the location of the source under "archive". It also stores a content
+// hash of the source under "source_hash", and under "SHA" unless one was already set,
+// so that reports look the same as for a GitHub submission.
+//
+// The source is always copied, so that later steps cannot modify the directory. Call Cleanup
+// to remove the copies once the pipeline is done with them.
+type LocalSourceStep struct {
+	path       string
+	gitignore  bool
+	log        *logrus.Logger
+	mu         sync.Mutex
+	workspaces []string
+	pipeline.StepContext
+}
+
+// NewLocalSourceStep creates a step which copies the directory at path into a fresh workspace.
+// If gitignore is true, files matched by the .gitignore files of the directory are left out.
+func NewLocalSourceStep(path string, gitignore bool, logger *logrus.Logger) *LocalSourceStep {
+	return &LocalSourceStep{
+		path:      path,
+		gitignore: gitignore,
+		log:       logger,
+	}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (l *LocalSourceStep) Exec(request *pipeline.Request) *pipeline.Result {
+	src, err := filepath.Abs(l.path)
+	if err != nil {
+		return &pipeline.Result{Error: err}
+	}
+	if info, err := os.Stat(src); err != nil {
+		return &pipeline.Result{Error: err}
+	} else if !info.IsDir() {
+		return &pipeline.Result{Error: fmt.Errorf("%v is not a directory", src)}
+	}
+
+	files, err := l.listFiles(src)
+	if err != nil {
+		l.Status("Failed to list the source files")
+		return &pipeline.Result{Error: err}
+	}
+
+	hash, err := hashFiles(src, files)
+	if err != nil {
+		l.Status("Failed to hash the source files")
+		return &pipeline.Result{Error: err}
+	}
+
+	l.Status("Copying the source into the workspace...")
+	workspace, err := copyFiles(src, files)
+	if err != nil {
+		l.Status("Failed to copy the source")
+		return &pipeline.Result{Error: err}
+	}
+	l.mu.Lock()
+	l.workspaces = append(l.workspaces, workspace)
+	l.mu.Unlock()
+	archive := filepath.Join(workspace, filepath.Base(src))
+	l.log.Infof("Grading %v files from %v at %v (hash %v)", len(files), src, archive, hash)
+
+	nextMap := fromMap(request.KeyVal)
+	nextMap["archive"] = archive
+	nextMap["source_hash"] = hash
+	if sha, _ := extractStr(nextMap, "SHA"); sha == "" {
+		nextMap["SHA"] = hash
+	}
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+// Cancel is a no-op
+func (l *LocalSourceStep) Cancel() error {
+	l.Status("cancel step")
+	return nil
+}
+
+// Cleanup removes the copies of the source made by every run of the step.
+func (l *LocalSourceStep) Cleanup() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, workspace := range l.workspaces {
+		if rmErr := os.RemoveAll(workspace); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	l.workspaces = nil
+	return err
+}
+
+// listFiles returns the slash separated paths, relative to root, of the regular files to grade in sorted order.
+// The .git directory is always left out.
+func (l *LocalSourceStep) listFiles(root string) ([]string, error) {
+	var (
+		files []string
+		rules = map[string][]ignoreRule{}
+	)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if rel == "." {
+				rel = ""
+			}
+			if info.Name() == ".git" || (rel != "" && l.gitignore && ignored(rules, rel, true)) {
+				return filepath.SkipDir
+			}
+			if l.gitignore {
+				dirRules, err := readIgnoreFile(filepath.Join(path, ".gitignore"))
+				if err != nil {
+					return err
+				}
+				rules[rel] = dirRules
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || (l.gitignore && ignored(rules, rel, false)) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+
+	sort.Strings(files)
+	return files, err
+}
+
+// hashFiles computes a SHA-1 over the names and contents of the files, so that identical sources get identical hashes.
+func hashFiles(root string, files []string) (string, error) {
+	tree := sha1.New()
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		blob := sha1.New()
+		_, err = io.Copy(blob, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(tree, "%s\x00%x\n", rel, blob.Sum(nil))
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// copyFiles copies the files into a directory named like root in a new temporary workspace, returning the workspace.
+func copyFiles(root string, files []string) (string, error) {
+	workspace, err := ioutil.TempDir("", "local-")
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(workspace, filepath.Base(root))
+
+	err = os.MkdirAll(dest, 0755)
+	for _, rel := range files {
+		if err != nil {
+			break
+		}
+		err = copyFile(filepath.Join(root, filepath.FromSlash(rel)), filepath.Join(dest, filepath.FromSlash(rel)))
+	}
+	if err != nil {
+		os.RemoveAll(workspace)
+		return "", err
+	}
+	return workspace, nil
+}
+
+func copyFile(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ignoreRule is a single pattern of a .gitignore file.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// readIgnoreFile parses the .gitignore at path, if there is one.
+func readIgnoreFile(path string) ([]ignoreRule, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// A pattern containing a slash is relative to the directory of the .gitignore,
+		// otherwise it matches a name at any depth.
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+
+		re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad pattern %q: %v", path, scanner.Text(), err)
+		}
+		rule.pattern = re
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignored applies the rules of every directory above rel, deepest last; the last matching rule wins.
+func ignored(rules map[string][]ignoreRule, rel string, isDir bool) bool {
+	var (
+		result = false
+		dirs   = []string{""}
+		parts  = strings.Split(rel, "/")
+	)
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[:i], "/"))
+	}
+
+	for _, dir := range dirs {
+		name := rel
+		if dir != "" {
+			name = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range rules[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(name) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result
+}
+
+// globToRegexp translates a gitignore glob into a regular expression over slash separated paths.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**"):
+			re.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(glob[i:], ']'); end > 0 {
+				re.WriteString(glob[i : i+end+1])
+				i += end
+			} else {
+				re.WriteString(`\[`)
+			}
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
@@ -0,0 +1,116 @@
+package jobs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalSourceStep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "hw1")
+	writeTree(t, src, map[string]string{
+		".gitignore":           "*.class\nbuild/\n!Keep.class\n/notes.txt\n",
+		"Main.java":            "class Main {}",
+		"Main.class":           "binary",
+		"Keep.class":           "binary",
+		"notes.txt":            "todo",
+		"lib/notes.txt":        "kept",
+		"lib/.gitignore":       "*.tmp\n",
+		"lib/Util.java":        "class Util {}",
+		"lib/scratch.tmp":      "tmp",
+		"build/out.jar":        "jar",
+		".git/HEAD":            "ref: refs/heads/master",
+		"test/deep/Test.class": "binary",
+	})
+
+	step := NewLocalSourceStep(src, true, logrus.New())
+	defer step.Cleanup()
+	res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{}})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	archive, _ := extractStr(res.KeyVal, "archive")
+	if archive == src {
+		t.Fatal("expected the source to be copied")
+	}
+
+	files, err := (&LocalSourceStep{}).listFiles(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".gitignore", "Keep.class", "Main.java", "lib/.gitignore", "lib/Util.java", "lib/notes.txt"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the files %v, observed %v", expected, files)
+	}
+
+	sha, _ := extractStr(res.KeyVal, "SHA")
+	if len(sha) != 40 || sha != res.KeyVal["source_hash"] {
+		t.Errorf("expected a content hash under SHA, observed %q", sha)
+	}
+
+	// Ignored files do not change the hash, but graded files do.
+	writeTree(t, src, map[string]string{"Other.class": "binary"})
+	if res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{}}); res.KeyVal["SHA"] != sha {
+		t.Error("expected an ignored file to leave the hash unchanged")
+	}
+	writeTree(t, src, map[string]string{"Main.java": "class Main { }"})
+	if res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{}}); res.KeyVal["SHA"] == sha {
+		t.Error("expected an edited file to change the hash")
+	}
+}
+
+func TestLocalSourceStepCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{"Main.java": "class Main {}"})
+
+	step := NewLocalSourceStep(dir, false, logrus.New())
+	res := step.Exec(&pipeline.Request{KeyVal: map[string]interface{}{"SHA": "abc123"}})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res.KeyVal["SHA"] != "abc123" {
+		t.Errorf("expected the given SHA to be kept, observed %v", res.KeyVal["SHA"])
+	}
+	archive, _ := extractStr(res.KeyVal, "archive")
+	if err := step.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Errorf("expected the copy %v to be removed, observed %v", archive, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Main.java")); err != nil {
+		t.Errorf("expected the source to be left alone, observed %v", err)
+	}
+
+	if res := NewLocalSourceStep(filepath.Join(dir, "Main.java"), false, logrus.New()).Exec(&pipeline.Request{}); res.Error == nil {
+		t.Error("expected an error for a path which is not a directory")
+	}
+}
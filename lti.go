@@ -0,0 +1,325 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AGSScoreScope is the OAuth2 scope needed to publish scores to a line item.
+	AGSScoreScope = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
+
+	agsScoreContentType = "application/vnd.ims.lis.v1.score+json"
+	jwtBearerAssertion  = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// AGSScore is the score payload of the LTI Assignment and Grade Services specification.
+type AGSScore struct {
+	UserID           string  `json:"userId"`
+	ScoreGiven       float64 `json:"scoreGiven"`
+	ScoreMaximum     float64 `json:"scoreMaximum"`
+	Comment          string  `json:"comment,omitempty"`
+	Timestamp        string  `json:"timestamp"`
+	ActivityProgress string  `json:"activityProgress"`
+	GradingProgress  string  `json:"gradingProgress"`
+}
+
+// AGSClient publishes scores to an LTI 1.3 platform (Moodle, Blackboard, D2L, ...).
+// It authenticates with the OAuth2 client credentials grant, using a JWT signed by the tool's private key
+// as the client assertion, and caches the access token until it expires.
+type AGSClient struct {
+	tokenURL string
+	clientID string
+	keyID    string
+	key      *rsa.PrivateKey
+	client   *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewAGSClient creates a client for the platform whose OAuth2 token endpoint is tokenURL. The clientID is the
+// one the platform assigned to the tool, and keyID identifies the key in the tool's JWKS.
+// If client is nil, the client of the context of each request is used, see WithHTTPClient.
+func NewAGSClient(tokenURL, clientID, keyID string, key *rsa.PrivateKey, client *http.Client) *AGSClient {
+	return &AGSClient{
+		tokenURL: tokenURL,
+		clientID: clientID,
+		keyID:    keyID,
+		key:      key,
+		client:   client,
+	}
+}
+
+// LoadRSAPrivateKey reads a PEM encoded PKCS #1 or PKCS #8 RSA private key.
+func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(blob)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key in " + path + " is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Token returns an access token with the score scope, requesting a new one if the cached token has expired.
+func (a *AGSClient) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Before(a.expiry) {
+		return a.token, nil
+	}
+
+	assertion, err := a.assertion()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {jwtBearerAssertion},
+		"client_assertion":      {assertion},
+		"scope":                 {AGSScoreScope},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient(ctx, a.client).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("token request", resp); err != nil {
+		return "", err
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("platform returned an empty access token")
+	}
+
+	a.token = token.AccessToken
+	// Refresh a little early so the token does not expire in flight, or halfway through a short-lived one
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	margin := 30 * time.Second
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	a.expiry = time.Now().Add(lifetime - margin)
+	return a.token, nil
+}
+
+// PublishScore posts the score to the line item, e.g. https://lms.example.edu/api/lti/courses/1/lineitems/2.
+func (a *AGSClient) PublishScore(ctx context.Context, lineItem string, score *AGSScore) error {
+	token, err := a.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := scoresURL(lineItem)
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(score)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", agsScoreContentType)
+	resp, err := httpClient(ctx, a.client).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse("score publish", resp)
+}
+
+// assertion creates the RS256 signed JWT identifying the tool to the platform.
+func (a *AGSClient) assertion() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": a.clientID,
+		"sub": a.clientID,
+		"aud": a.tokenURL,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"jti": hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// scoresURL appends /scores to the line item path, keeping any query string.
+func scoresURL(lineItem string) (string, error) {
+	u, err := url.Parse(lineItem)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/scores"
+	return u.String(), nil
+}
+
+func checkResponse(what string, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%v failed with %v: %s", what, resp.Status, body)
+	if transientStatus(resp.StatusCode) {
+		return &TransientError{Err: err}
+	}
+	return err
+}
+
+// LoadLTIRoster reads a roster mapping GitHub usernames to LTI user IDs (the "sub" of the student's
+// launch) from a CSV file with a "github" and an "lti_user_id" column.
+func LoadLTIRoster(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRoster(f, "github", "lti_user_id")
+}
+
+// AGSGradeStep publishes the computed "score" and a feedback comment to an LTI line item.
+type AGSGradeStep struct {
+	client   *AGSClient
+	lineItem string
+	maxScore float64
+	roster   map[string]string
+	dryRun   bool
+	log      *logrus.Logger
+	jobContext
+	pipeline.StepContext
+}
+
+// NewAGSGradeStep creates a step which publishes scores out of maxScore to the line item. The student is looked
+// up in the roster by the STUDENT key, falling back to OWNER. In dry-run mode the payloads are only logged.
+func NewAGSGradeStep(client *AGSClient, lineItem string, maxScore float64, roster map[string]string, dryRun bool, logger *logrus.Logger) *AGSGradeStep {
+	return &AGSGradeStep{
+		client:   client,
+		lineItem: lineItem,
+		maxScore: maxScore,
+		roster:   roster,
+		dryRun:   dryRun,
+		log:      logger,
+	}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (s *AGSGradeStep) Exec(request *pipeline.Request) *pipeline.Result {
+	student := extractStudent(request.KeyVal)
+	userID, ok := s.roster[student]
+	if !ok {
+		s.Status("Student is missing from the LTI roster")
+		return &pipeline.Result{Error: fmt.Errorf("no LTI user for GitHub user %q", student)}
+	}
+
+	given, ok := extractScore(request.KeyVal)
+	if !ok {
+		return &pipeline.Result{Error: errors.New("no score has been computed")}
+	}
+
+	score := &AGSScore{
+		UserID:           userID,
+		ScoreGiven:       given,
+		ScoreMaximum:     s.maxScore,
+		Comment:          feedback(request.KeyVal),
+		Timestamp:        time.Now().Format(time.RFC3339),
+		ActivityProgress: "Completed",
+		GradingProgress:  "FullyGraded",
+	}
+
+	if s.dryRun {
+		s.log.Infof("Dry run: publish %+v to %v", score, s.lineItem)
+	} else {
+		s.Status("Publishing score to the LMS...")
+		if err := s.client.PublishScore(s.jobCtx(), s.lineItem, score); err != nil {
+			s.Status("Failed to publish the score")
+			return &pipeline.Result{Error: err}
+		}
+	}
+
+	nextMap := fromMap(request.KeyVal)
+	nextMap["ags"] = score
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+// Cancel is a no-op
+func (s *AGSGradeStep) Cancel() error {
+	s.Status("cancel step")
+	return nil
+}
@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// fakePlatform is a minimal LTI platform issuing tokens to a single tool and recording published scores.
+type fakePlatform struct {
+	*httptest.Server
+	t         *testing.T
+	toolKey   *rsa.PublicKey
+	expiresIn int
+	tokens    int
+	published []AGSScore
+}
+
+func newFakePlatform(t *testing.T, toolKey *rsa.PublicKey) *fakePlatform {
+	p := &fakePlatform{t: t, toolKey: toolKey, expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/lineitems/9/scores", p.scores)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakePlatform) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("scope") != AGSScoreScope {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+	if len(parts) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(p.toolKey, crypto.SHA256, digest[:], sig); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	blob, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(blob, &claims)
+	if claims["iss"] != "tool-1" || claims["aud"] != p.URL+"/token" {
+		p.t.Errorf("unexpected claims %v", claims)
+	}
+
+	p.tokens++
+	fmt.Fprintf(w, `{"access_token": "platform-token", "token_type": "Bearer", "expires_in": %d}`, p.expiresIn)
+}
+
+func (p *fakePlatform) scores(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer platform-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Type") != agsScoreContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	var score AGSScore
+	if err := json.NewDecoder(r.Body).Decode(&score); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.published = append(p.published, score)
+}
+
+func TestAGSGradeStep(t *testing.T) {
+	const name = "test pipeline 1"
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform := newFakePlatform(t, &key.PublicKey)
+	defer platform.Close()
+
+	var (
+		client   = NewAGSClient(platform.URL+"/token", "tool-1", "key-1", key, nil)
+		seed     = NewSeedStep(map[string]interface{}{"OWNER": "bob", "score": 7.0})
+		step     = NewAGSGradeStep(client, platform.URL+"/lineitems/9", 10, map[string]string{"bob": "lti-bob"}, false, logrus.New())
+		workpipe = pipeline.New(name, 10000)
+		stage    = pipeline.NewStage(name, false, false)
+	)
+
+	stage.AddStep(seed)
+	stage.AddStep(step)
+	workpipe.AddStage(stage)
+
+	if res := workpipe.Run(); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(platform.published) != 1 {
+		t.Fatalf("expected one published score, observed %v", len(platform.published))
+	}
+	if score := platform.published[0]; score.UserID != "lti-bob" || score.ScoreGiven != 7 || score.ScoreMaximum != 10 {
+		t.Errorf("unexpected score %+v", score)
+	}
+
+	// A second publish reuses the cached token
+	if err := client.PublishScore(context.Background(), platform.URL+"/lineitems/9", &AGSScore{UserID: "lti-bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if platform.tokens != 1 {
+		t.Errorf("expected a single token request, observed %v", platform.tokens)
+	}
+}
+
+func TestAGSClientShortToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform := newFakePlatform(t, &key.PublicKey)
+	defer platform.Close()
+
+	// A token living less than the refresh margin is still cached, for half of its life
+	platform.expiresIn = 20
+	client := NewAGSClient(platform.URL+"/token", "tool-1", "key-1", key, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Token(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if platform.tokens != 1 {
+		t.Errorf("expected a single token request, observed %v", platform.tokens)
+	}
+	if left := time.Until(client.expiry); left <= 9*time.Second || left > 10*time.Second {
+		t.Errorf("expected the token to be cached for 10s, observed %v", left)
+	}
+}
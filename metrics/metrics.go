@@ -0,0 +1,205 @@
+// Package metrics exposes Prometheus metrics about the steps and jobs of a grader,
+// so that a slow step holding up the queue during a deadline rush shows up on a dashboard.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the name of every metric.
+const Namespace = "alligrader"
+
+// The outcomes of a step.
+const (
+	OutcomeOK             = "ok"
+	OutcomeStudentFailure = "student_failure"
+	OutcomeInfraFailure   = "infra_failure"
+	OutcomeTimeout        = "timeout"
+)
+
+// Metrics holds the collectors of a grader, registered with their own registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	stepDuration *prometheus.HistogramVec
+	stepResults  *prometheus.CounterVec
+	stepMemory   *prometheus.HistogramVec
+	stepCPU      *prometheus.CounterVec
+	jobDuration  *prometheus.HistogramVec
+	jobResults   *prometheus.CounterVec
+	requests     *prometheus.CounterVec
+	rateLimit    *prometheus.GaugeVec
+}
+
+// New creates and registers the collectors, along with the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "step_duration_seconds",
+			Help:      "Time taken by a step, by stage and step type.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"stage", "type"}),
+		stepResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "step_results_total",
+			Help:      "Steps run, by step type and outcome: ok, student_failure, infra_failure or timeout.",
+		}, []string{"type", "outcome"}),
+		stepMemory: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "step_memory_peak_bytes",
+			Help:      "Peak memory use of the commands of a step run in a cgroup, by step type.",
+			Buckets:   prometheus.ExponentialBuckets(16<<20, 2, 10),
+		}, []string{"type"}),
+		stepCPU: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "step_cpu_seconds_total",
+			Help:      "CPU time used by the commands of steps run in a cgroup, by step type.",
+		}, []string{"type"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "job_duration_seconds",
+			Help:      "Time taken by a run of a job, by assignment.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"assignment"}),
+		jobResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "job_results_total",
+			Help:      "Runs of jobs, by assignment and outcome.",
+		}, []string{"assignment", "outcome"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "external_requests_total",
+			Help:      "HTTP requests to external APIs such as GitHub, by host, method and status code.",
+		}, []string{"host", "method", "code"}),
+		rateLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "rate_limit_remaining",
+			Help:      "Requests left in the rate limit window of an API, as last reported by its X-RateLimit-Remaining header.",
+		}, []string{"host"}),
+	}
+
+	m.registry.MustRegister(
+		m.stepDuration, m.stepResults, m.stepMemory, m.stepCPU, m.jobDuration, m.jobResults, m.requests, m.rateLimit,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format. Mount it on /metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Wrap measures the step. It is a jobs.StepWrapper.
+func (m *Metrics) Wrap(stage string, spec jobs.StepSpec, step pipeline.Step) pipeline.Step {
+	return jobs.Use(spec.Name(), step, m.measure(stage, spec.Type))
+}
+
+// measure measures the runs of a step of the type.
+func (m *Metrics) measure(stage, stepType string) jobs.Middleware {
+	return func(name string, step pipeline.Step, next jobs.ExecFunc) jobs.ExecFunc {
+		return func(request *pipeline.Request) *pipeline.Result {
+			start := time.Now()
+			res := next(request)
+			m.stepDuration.WithLabelValues(stage, stepType).Observe(time.Since(start).Seconds())
+
+			var err error
+			if res != nil {
+				err = res.Error
+				m.observeUsage(name, stepType, res.KeyVal)
+			}
+			m.stepResults.WithLabelValues(stepType, Outcome(err)).Inc()
+			return res
+		}
+	}
+}
+
+// observeUsage records what the commands of the step used, if they ran in a cgroup. See jobs.WithCgroup.
+func (m *Metrics) observeUsage(name, stepType string, keyVal map[string]interface{}) {
+	resources, _ := keyVal["resources"].(map[string]*cgroup.Usage)
+	usage, ok := resources[name]
+	if !ok {
+		return
+	}
+	if usage.MemoryPeak > 0 {
+		m.stepMemory.WithLabelValues(stepType).Observe(float64(usage.MemoryPeak))
+	}
+	m.stepCPU.WithLabelValues(stepType).Add(usage.CPU.Seconds())
+}
+
+// Started is a no-op. Metrics is a queue.Observer.
+func (m *Metrics) Started(job *queue.Job, rec *history.Recorder) {}
+
+// Status is a no-op.
+func (m *Metrics) Status(job *queue.Job, line string) {}
+
+// Finished counts the run and records its duration.
+func (m *Metrics) Finished(job *queue.Job, run *history.Run) {
+	m.jobDuration.WithLabelValues(run.Assignment).Observe(run.Duration)
+	m.jobResults.WithLabelValues(run.Assignment, run.Status).Inc()
+}
+
+// Lister lists the jobs of a queue, such as a queue.BoltQueue.
+type Lister interface {
+	List(states ...queue.State) ([]*queue.Job, error)
+}
+
+// WatchQueue reports the number of pending and running jobs of the queue when the metrics are collected.
+func (m *Metrics) WatchQueue(q Lister) error {
+	return m.registry.Register(&queueCollector{
+		queue: q,
+		depth: prometheus.NewDesc(prometheus.BuildFQName(Namespace, "queue", "jobs"),
+			"Jobs in the queue, by state.", []string{"state"}, nil),
+	})
+}
+
+type queueCollector struct {
+	queue Lister
+	depth *prometheus.Desc
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	list, err := c.queue.List(queue.Pending, queue.Running)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.depth, err)
+		return
+	}
+	counts := map[queue.State]int{queue.Pending: 0, queue.Running: 0}
+	for _, job := range list {
+		counts[job.State]++
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(n), string(state))
+	}
+}
+
+// Outcome classifies the error of a step.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case jobs.IsStudentError(err):
+		return OutcomeStudentFailure
+	case jobs.IsTimeout(err):
+		return OutcomeTimeout
+	default:
+		return OutcomeInfraFailure
+	}
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/queue"
+)
+
+// failStep fails with the given error.
+type failStep struct {
+	err error
+	pipeline.StepContext
+}
+
+func (f *failStep) Exec(request *pipeline.Request) *pipeline.Result {
+	return &pipeline.Result{Error: f.err}
+}
+
+func (f *failStep) Cancel() error {
+	return nil
+}
+
+type fakeQueue []*queue.Job
+
+func (f fakeQueue) List(states ...queue.State) ([]*queue.Job, error) {
+	return f, nil
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+
+	usage := map[string]*cgroup.Usage{"checkstyle": {MemoryPeak: 100 << 20, CPU: 1500 * time.Millisecond}}
+	steps := []pipeline.Step{
+		m.Wrap("lint", jobs.StepSpec{Type: "checkstyle"}, jobs.NewSeedStep(map[string]interface{}{"resources": usage})),
+		m.Wrap("lint", jobs.StepSpec{Type: "command"}, jobs.NewSeedStep(nil)),
+		m.Wrap("lint", jobs.StepSpec{Type: "command"}, &failStep{err: &jobs.StudentError{Err: errors.New("exit status 1")}}),
+		m.Wrap("fetch", jobs.StepSpec{Type: "github"}, &failStep{err: errors.New("no such host")}),
+	}
+	for _, step := range steps {
+		step.Exec(&pipeline.Request{})
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Write([]byte("{}"))
+	}))
+	defer api.Close()
+	client := &http.Client{Transport: m.InstrumentTransport(nil)}
+	resp, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err := m.WatchQueue(fakeQueue{{State: queue.Pending}, {State: queue.Pending}, {State: queue.Running}}); err != nil {
+		t.Fatal(err)
+	}
+
+	host := strings.TrimPrefix(api.URL, "http://")
+	out := scrape(t, m)
+	for _, expected := range []string{
+		`alligrader_step_results_total{outcome="ok",type="command"} 1`,
+		`alligrader_step_results_total{outcome="student_failure",type="command"} 1`,
+		`alligrader_step_results_total{outcome="infra_failure",type="github"} 1`,
+		`alligrader_step_duration_seconds_count{stage="lint",type="command"} 2`,
+		`alligrader_step_memory_peak_bytes_bucket{type="checkstyle",le="1.34217728e+08"} 1`,
+		`alligrader_step_cpu_seconds_total{type="checkstyle"} 1.5`,
+		`alligrader_external_requests_total{code="200",host="` + host + `",method="GET"} 1`,
+		`alligrader_rate_limit_remaining{host="` + host + `"} 4999`,
+		`alligrader_queue_jobs{state="pending"} 2`,
+		`alligrader_queue_jobs{state="running"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %v in the metrics", expected)
+		}
+	}
+}
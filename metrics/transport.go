@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// InstrumentTransport returns a RoundTripper counting the requests made through next, which defaults to
+// http.DefaultTransport, and recording the rate limit left as reported by APIs such as GitHub's.
+func (m *Metrics) InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{next: next, metrics: m}
+}
+
+type transport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+			t.metrics.rateLimit.WithLabelValues(r.URL.Host).Set(float64(remaining))
+		}
+	}
+	t.metrics.requests.WithLabelValues(r.URL.Host, r.Method, code).Inc()
+	return resp, err
+}
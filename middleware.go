@@ -0,0 +1,182 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryDelay is the wait before running again a step of a spec which failed with a transient error.
+// It doubles with every run.
+var RetryDelay = time.Second
+
+// ExecFunc runs a step, like the Exec method of a pipeline.Step.
+type ExecFunc func(request *pipeline.Request) *pipeline.Result
+
+// Middleware decorates the runs of a step named name: the ExecFunc it returns runs next, which
+// runs the rest of the chain then the step, and may act before and after it, or instead of it.
+// The step is there for its Status, e.g. step.Status("retrying").
+type Middleware func(name string, step pipeline.Step, next ExecFunc) ExecFunc
+
+// Use decorates the step with the middleware, the first one running first. The step returned forwards
+// the context set by the pipeline to the step, so that its status lines still arrive, along with the
+// context of a ContextStep and its Cancel.
+func Use(name string, step pipeline.Step, middleware ...Middleware) pipeline.Step {
+	exec := ExecFunc(step.Exec)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		exec = middleware[i](name, step, exec)
+	}
+	return &chainedStep{Step: step, exec: exec}
+}
+
+// Chain returns a StepWrapper decorating every step with the middleware, e.g. for a queue.Runner.
+func Chain(middleware ...Middleware) StepWrapper {
+	return func(stage string, spec StepSpec, step pipeline.Step) pipeline.Step {
+		return Use(spec.Name(), step, middleware...)
+	}
+}
+
+// chainedStep runs a step through its middleware.
+type chainedStep struct {
+	pipeline.Step
+	exec ExecFunc
+}
+
+// Exec runs the middleware, then the step.
+func (s *chainedStep) Exec(request *pipeline.Request) *pipeline.Result {
+	return s.exec(request)
+}
+
+// SetContext gives the context to the step if it is a ContextStep.
+func (s *chainedStep) SetContext(ctx context.Context) {
+	SetContext(s.Step, ctx)
+}
+
+// Recover turns a panic of the step into a *PanicError, so that it fails the job instead of the worker.
+// It must come after the middleware running the step in a goroutine of its own, if any.
+func Recover(name string, step pipeline.Step, next ExecFunc) ExecFunc {
+	return func(request *pipeline.Request) (res *pipeline.Result) {
+		defer func() {
+			if v := recover(); v != nil {
+				res = &pipeline.Result{
+					Error:  &PanicError{Step: name, Value: v, Stack: debug.Stack()},
+					KeyVal: request.KeyVal,
+				}
+			}
+		}()
+		return next(request)
+	}
+}
+
+// ReportStatus sends a status line when the step starts, and another with its duration when it ends.
+func ReportStatus(name string, step pipeline.Step, next ExecFunc) ExecFunc {
+	return func(request *pipeline.Request) *pipeline.Result {
+		step.Status(fmt.Sprintf("%v started", name))
+		start := time.Now()
+		res := next(request)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err := resultError(res); err != nil {
+			step.Status(fmt.Sprintf("%v failed after %v: %v", name, elapsed, err))
+		} else {
+			step.Status(fmt.Sprintf("%v finished in %v", name, elapsed))
+		}
+		return res
+	}
+}
+
+// Logging logs the start of the step at the debug level, and its end with its duration and error, if any.
+func Logging(logger *logrus.Logger) Middleware {
+	return func(name string, step pipeline.Step, next ExecFunc) ExecFunc {
+		return func(request *pipeline.Request) *pipeline.Result {
+			entry := logger.WithField("step", name)
+			entry.Debug("Step started")
+			start := time.Now()
+			res := next(request)
+
+			entry = entry.WithField("duration", time.Since(start))
+			switch err := resultError(res); {
+			case err == nil:
+				entry.Debug("Step finished")
+			case IsStudentError(err) || IsTimeout(err) || err == ErrCancelled:
+				entry.WithError(err).Info("Step failed")
+			default:
+				if panicErr, ok := err.(*PanicError); ok {
+					entry = entry.WithField("stack", string(panicErr.Stack))
+				}
+				entry.WithError(err).Warn("Step failed")
+			}
+			return res
+		}
+	}
+}
+
+// Timing stores how long the step ran under "timings", a map[string]time.Duration keyed by step name.
+// A result without a KeyVal, as that of many failed steps, is left alone, so that it does not pass
+// for a KeyVal holding only the timings.
+func Timing(name string, step pipeline.Step, next ExecFunc) ExecFunc {
+	return func(request *pipeline.Request) *pipeline.Result {
+		start := time.Now()
+		res := next(request)
+		elapsed := time.Since(start)
+		if res == nil || res.KeyVal == nil {
+			return res
+		}
+
+		keyVal := fromMap(res.KeyVal)
+		// Steps building a new KeyVal do not carry the timings of the steps before them
+		if _, ok := keyVal["timings"]; !ok {
+			if prev, ok := request.KeyVal["timings"]; ok {
+				keyVal["timings"] = prev
+			}
+		}
+		recordTiming(keyVal, name, elapsed)
+		timed := *res
+		timed.KeyVal = keyVal
+		return &timed
+	}
+}
+
+// recordTiming adds the duration of the step to the copy of the timings of the KeyVal.
+func recordTiming(keyVal map[string]interface{}, name string, elapsed time.Duration) {
+	timings := map[string]time.Duration{}
+	if prev, ok := keyVal["timings"].(map[string]time.Duration); ok {
+		for step, d := range prev {
+			timings[step] = d
+		}
+	}
+	timings[name] = elapsed
+	keyVal["timings"] = timings
+}
+
+// Retry runs the step again, up to attempts runs in all, while it fails with an error for which
+// IsTransient holds. It waits delay before the second run, doubling the wait every run after.
+func Retry(attempts int, delay time.Duration) Middleware {
+	return func(name string, step pipeline.Step, next ExecFunc) ExecFunc {
+		return func(request *pipeline.Request) *pipeline.Result {
+			wait := delay
+			for attempt := 1; ; attempt++ {
+				res := next(request)
+				err := resultError(res)
+				if attempt >= attempts || !IsTransient(err) {
+					return res
+				}
+				step.Status(fmt.Sprintf("%v failed, retrying in %v: %v", name, wait, err))
+				time.Sleep(wait)
+				wait *= 2
+			}
+		}
+	}
+}
+
+// resultError returns the error of the result, or an error if there is no result.
+func resultError(res *pipeline.Result) error {
+	if res == nil {
+		return errors.New("step returned no result")
+	}
+	return res.Error
+}
@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// flakyStep fails with each of its errors in turn, then succeeds.
+type flakyStep struct {
+	errs []error
+	runs int
+	pipeline.StepContext
+}
+
+func (s *flakyStep) Exec(request *pipeline.Request) *pipeline.Result {
+	s.runs++
+	if s.runs <= len(s.errs) {
+		return &pipeline.Result{Error: s.errs[s.runs-1], KeyVal: request.KeyVal}
+	}
+	return &pipeline.Result{KeyVal: fromMap(request.KeyVal)}
+}
+
+func (s *flakyStep) Cancel() error {
+	return nil
+}
+
+// panicStep panics.
+type panicStep struct {
+	pipeline.StepContext
+}
+
+func (s *panicStep) Exec(request *pipeline.Request) *pipeline.Result {
+	var keyVal map[string]interface{}
+	keyVal["score"] = 1
+	return nil
+}
+
+func (s *panicStep) Cancel() error {
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	request := &pipeline.Request{KeyVal: map[string]interface{}{
+		"timings": map[string]time.Duration{"fetch": time.Second},
+	}}
+
+	var panicErr *PanicError
+	res := Use("grade", &panicStep{}, Recover).Exec(request)
+	if !errors.As(res.Error, &panicErr) || panicErr.Step != "grade" || len(panicErr.Stack) == 0 {
+		t.Errorf("expected the panic as an error, observed %v", res.Error)
+	}
+
+	transient := &TransientError{Err: errors.New("canvas responded 503 Service Unavailable")}
+	flaky := &flakyStep{errs: []error{transient, transient}}
+	res = Use("canvas", flaky, Timing, Retry(3, time.Millisecond)).Exec(request)
+	if res.Error != nil || flaky.runs != 3 {
+		t.Errorf("expected the step to succeed on its third run, observed %v after %v runs", res.Error, flaky.runs)
+	}
+	timings, _ := res.KeyVal["timings"].(map[string]time.Duration)
+	if timings["fetch"] != time.Second || timings["canvas"] <= 0 {
+		t.Errorf("expected the timings of both steps, observed %v", res.KeyVal["timings"])
+	}
+	if len(request.KeyVal["timings"].(map[string]time.Duration)) != 1 {
+		t.Error("expected the timings of the request to be left alone")
+	}
+	failed := func(*pipeline.Request) *pipeline.Result { return &pipeline.Result{Error: errors.New("no such file")} }
+	if res := Timing("fetch", flaky, failed)(request); res.KeyVal != nil {
+		t.Errorf("expected a result without a KeyVal to be left alone, observed %v", res.KeyVal)
+	}
+
+	var cases = []struct {
+		err  error
+		runs int
+	}{
+		{&StudentError{Err: errors.New("exit status 1")}, 1},
+		{&TimeoutError{Step: "canvas", Timeout: time.Minute}, 1},
+		{transient, 2},
+	}
+	for _, c := range cases {
+		flaky = &flakyStep{errs: []error{c.err, c.err, c.err}}
+		res = Use("canvas", flaky, Retry(2, time.Millisecond)).Exec(request)
+		if res.Error != c.err || flaky.runs != c.runs {
+			t.Errorf("expected %v to fail after %v runs, observed %v after %v", c.err, c.runs, res.Error, flaky.runs)
+		}
+	}
+}
+
+func TestSpecMiddleware(t *testing.T) {
+	spec, err := ParseJobSpec([]byte(`
+name: middleware
+stages:
+  - name: run
+    steps:
+      - {type: command, params: {name: hello, args: [echo, hello]}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workpipe, err := spec.Pipeline(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	res := RunWithStatus(workpipe, func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, line)
+	})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if timings, _ := res.KeyVal["timings"].(map[string]time.Duration); timings["hello"] <= 0 {
+		t.Errorf("expected the duration of the step, observed %v", res.KeyVal["timings"])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	log := strings.Join(lines, "\n")
+	if !strings.Contains(log, "hello started") || !strings.Contains(log, "hello finished in") {
+		t.Errorf("expected the start and end of the step in its status, observed %q", log)
+	}
+}
@@ -0,0 +1,235 @@
+package jobs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// MaxLogFile is the size past which the LogFile of a CommandStep, or of a Checkstyle or FindBugs step, is truncated.
+const MaxLogFile = 64 << 20
+
+// maxStreamedLine is the length past which a line streamed to the status of a step is cut.
+const maxStreamedLine = 1024
+
+// maxStreamedLines is how many lines of its output a step streams to its status, so that a program
+// printing in a loop cannot flood the status of the job. The LogFile still receives the whole output.
+const maxStreamedLines = 1000
+
+// boundedOutput keeps the head and the tail of the output of a command, however much it prints,
+// and counts its bytes. It copies every byte to its stream, if any.
+type boundedOutput struct {
+	mu      sync.Mutex
+	head    []byte
+	tail    []byte
+	next    int
+	tailCap int
+	total   int64
+	stream  io.Writer
+}
+
+// newBoundedOutput keeps up to limit bytes, half of them from the head of the output.
+func newBoundedOutput(limit int, stream io.Writer) *boundedOutput {
+	return &boundedOutput{
+		head:    make([]byte, 0, limit/2),
+		tailCap: limit - limit/2,
+		stream:  stream,
+	}
+}
+
+// Write never fails, so that neither the limit nor the stream stop the command.
+func (b *boundedOutput) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total += int64(len(p))
+	if b.stream != nil {
+		b.stream.Write(p)
+	}
+
+	n := cap(b.head) - len(b.head)
+	if n > len(p) {
+		n = len(p)
+	}
+	b.head = append(b.head, p[:n]...)
+	rest := p[n:]
+
+	// The tail is a ring buffer once full, next being its oldest byte
+	if len(rest) >= b.tailCap {
+		b.tail = append(b.tail[:0], rest[len(rest)-b.tailCap:]...)
+		b.next = 0
+		return len(p), nil
+	}
+	if free := b.tailCap - len(b.tail); free > 0 {
+		if free > len(rest) {
+			free = len(rest)
+		}
+		b.tail = append(b.tail, rest[:free]...)
+		rest = rest[free:]
+	}
+	for len(rest) > 0 {
+		copied := copy(b.tail[b.next:], rest)
+		rest = rest[copied:]
+		b.next = (b.next + copied) % b.tailCap
+	}
+	return len(p), nil
+}
+
+// String returns the head and the tail, with a marker counting the bytes left out between them, if any.
+func (b *boundedOutput) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out bytes.Buffer
+	out.Write(b.head)
+	if dropped := b.total - int64(len(b.head)+len(b.tail)); dropped > 0 {
+		fmt.Fprintf(&out, "\n[... %d bytes truncated ...]\n", dropped)
+	}
+	out.Write(b.tail[b.next:])
+	out.Write(b.tail[:b.next])
+	return out.String()
+}
+
+// Total returns the number of bytes written, kept or not.
+func (b *boundedOutput) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// lineWriter passes every line written to it to emit, cutting those longer than maxStreamedLine,
+// while its budget, if any, lasts.
+type lineWriter struct {
+	emit    func(line string)
+	budget  *lineBudget
+	partial []byte
+	cut     bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		switch {
+		case c == '\n':
+			w.flush()
+		case len(w.partial) < maxStreamedLine:
+			w.partial = append(w.partial, c)
+		default:
+			w.cut = true
+		}
+	}
+	return len(p), nil
+}
+
+// flush emits the line written so far, if any.
+func (w *lineWriter) flush() {
+	line := string(w.partial)
+	if w.cut {
+		line += " [...]"
+	}
+	if line != "" && w.budget.take() {
+		w.emit(line)
+	}
+	w.partial, w.cut = w.partial[:0], false
+}
+
+// lineBudget is how many more lines the lineWriters sharing it may emit.
+type lineBudget struct {
+	mu      sync.Mutex
+	left    int
+	dropped int
+}
+
+// take reports whether another line may be emitted, counting those which may not. A nil budget is unlimited.
+func (b *lineBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.left <= 0 {
+		b.dropped++
+		return false
+	}
+	b.left--
+	return true
+}
+
+// Dropped returns the number of lines which were not emitted.
+func (b *lineBudget) Dropped() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// logFile is a file shared by the output streams of a command, truncated past its limit.
+type logFile struct {
+	mu   sync.Mutex
+	file *os.File
+	left int64
+}
+
+func openLogFile(path string, limit int64) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{file: file, left: limit}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.left <= 0 {
+		return len(p), nil
+	}
+	if int64(len(p)) > l.left {
+		l.file.Write(p[:l.left])
+		l.file.WriteString("\n[... truncated ...]\n")
+		l.left = 0
+		return len(p), nil
+	}
+	l.left -= int64(len(p))
+	return l.file.Write(p)
+}
+
+func (l *logFile) Close() error {
+	return l.file.Close()
+}
+
+// streamOutput copies the output of a program to the log file at path, unless it is "", and, if lines is set,
+// to the status, line by line, up to maxStreamedLines of them. The function returned flushes and closes them
+// once the program exited.
+func streamOutput(stdout, stderr *boundedOutput, path string, lines bool, status func(string)) (func(), error) {
+	var (
+		outs, errs []io.Writer
+		closers    []func()
+	)
+	if lines {
+		budget := &lineBudget{left: maxStreamedLines}
+		outLines := &lineWriter{emit: func(line string) { status("stdout: " + line) }, budget: budget}
+		errLines := &lineWriter{emit: func(line string) { status("stderr: " + line) }, budget: budget}
+		outs, errs = append(outs, outLines), append(errs, errLines)
+		closers = append(closers, outLines.flush, errLines.flush, func() {
+			if dropped := budget.Dropped(); dropped > 0 {
+				status(fmt.Sprintf("%d more lines of output were not streamed", dropped))
+			}
+		})
+	}
+	if path != "" {
+		log, err := openLogFile(path, MaxLogFile)
+		if err != nil {
+			return nil, err
+		}
+		outs, errs = append(outs, log), append(errs, log)
+		closers = append(closers, func() { log.Close() })
+	}
+
+	if len(outs) > 0 {
+		stdout.stream, stderr.stream = io.MultiWriter(outs...), io.MultiWriter(errs...)
+	}
+	return func() {
+		for _, done := range closers {
+			done()
+		}
+	}, nil
+}
@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBoundedOutput(t *testing.T) {
+	var cases = []struct {
+		writes   []string
+		expected string
+	}{
+		{[]string{"short"}, "short"},
+		{[]string{"0123456789"}, "0123456789"},
+		{[]string{"0123456789abcdef"}, "01234\n[... 6 bytes truncated ...]\nbcdef"},
+		// Small writes wrap around the tail
+		{strings.Split("0123456789abcdefghij", ""), "01234\n[... 10 bytes truncated ...]\nfghij"},
+		{[]string{"0123", "456789abc", "defghij"}, "01234\n[... 10 bytes truncated ...]\nfghij"},
+	}
+
+	for _, c := range cases {
+		out := newBoundedOutput(10, nil)
+		for _, w := range c.writes {
+			out.Write([]byte(w))
+		}
+		if observed := out.String(); observed != c.expected {
+			t.Errorf("%q: expected %q, observed %q", c.writes, c.expected, observed)
+		}
+		if total := out.Total(); total != int64(len(strings.Join(c.writes, ""))) {
+			t.Errorf("%q: expected every byte to be counted, observed %v", c.writes, total)
+		}
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{emit: func(line string) { lines = append(lines, line) }}
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\n\n" + strings.Repeat("x", maxStreamedLine+10) + "\nlast"))
+	w.flush()
+
+	expected := []string{"first", "second", strings.Repeat("x", maxStreamedLine) + " [...]", "last"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %q, observed %q", expected, lines)
+	}
+
+	// The writers of a step share its budget
+	lines = nil
+	budget := &lineBudget{left: 3}
+	out := &lineWriter{emit: func(line string) { lines = append(lines, "out: "+line) }, budget: budget}
+	errs := &lineWriter{emit: func(line string) { lines = append(lines, "err: "+line) }, budget: budget}
+	out.Write([]byte("a\nb\n"))
+	errs.Write([]byte("c\nd\n"))
+	out.Write([]byte("e\n"))
+	expected = []string{"out: a", "out: b", "err: c"}
+	if !reflect.DeepEqual(lines, expected) || budget.Dropped() != 2 {
+		t.Errorf("expected %q and 2 lines dropped, observed %q and %v", expected, lines, budget.Dropped())
+	}
+}
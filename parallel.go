@@ -0,0 +1,220 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs/cgroup"
+)
+
+// ParallelStep runs independent steps concurrently, such as Checkstyle and FindBugs, which only read
+// the source and store their reports under different keys.
+//
+// Each step gets a copy of the KeyVal of the request, and the keys they add or change are merged into it.
+// Two steps setting a key to different values fail the ParallelStep with a ConflictError, except for
+// "resources" and "timings", where each step records its own usage and duration. The outputs of a step
+// running a command, such as "stdout" and "exit_code", are its own: they are stored under "outputs", keyed by
+// step name, e.g. {{.outputs.lint.stdout}}, and the keys themselves keep their values from before the ParallelStep.
+// Every step runs to completion: if more than one fails, the ParallelStep fails with their StepErrors.
+type ParallelStep struct {
+	names     []string
+	steps     []pipeline.Step
+	mu        sync.Mutex
+	pipes     []*pipeline.Pipeline
+	cancelled bool
+	pipeline.StepContext
+}
+
+// NewParallelStep creates a ParallelStep. Add the steps it runs with AddStep.
+func NewParallelStep() *ParallelStep {
+	return &ParallelStep{}
+}
+
+// AddStep adds a step, named in errors and in the status of the ParallelStep.
+func (p *ParallelStep) AddStep(name string, step pipeline.Step) {
+	p.names = append(p.names, name)
+	p.steps = append(p.steps, step)
+}
+
+// SetContext gives the context of the job to the steps.
+func (p *ParallelStep) SetContext(ctx context.Context) {
+	for _, step := range p.steps {
+		SetContext(step, ctx)
+	}
+}
+
+// Exec runs the steps, each in a pipeline of its own, and merges their results.
+func (p *ParallelStep) Exec(request *pipeline.Request) *pipeline.Result {
+	results := make([]*pipeline.Result, len(p.steps))
+	var wg sync.WaitGroup
+	for i, step := range p.steps {
+		// The seed stage hands the KeyVal of the request over to the step
+		seed := pipeline.NewStage("seed", false, false)
+		seed.AddStep(NewSeedStep(request.KeyVal))
+		stage := pipeline.NewStage(p.names[i], false, false)
+		stage.AddStep(step)
+		workpipe := pipeline.New(p.names[i], DefaultOutBufferLen)
+		workpipe.AddStage(seed, stage)
+		if !p.start(workpipe) {
+			wg.Wait()
+			return &pipeline.Result{Error: ErrCancelled}
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = RunWithStatus(workpipe, p.Status)
+		}(i)
+	}
+	wg.Wait()
+	return p.merge(request, results)
+}
+
+// start records the pipeline of a step, so that Cancel reaches it, unless the ParallelStep was cancelled.
+func (p *ParallelStep) start(workpipe *pipeline.Pipeline) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancelled {
+		return false
+	}
+	p.pipes = append(p.pipes, workpipe)
+	return true
+}
+
+// commandOutputs are the keys a CommandStep sets, which a ParallelStep stores under "outputs".
+var commandOutputs = []string{"command", "stdout", "stderr", "exit_code", "sandbox"}
+
+// merge merges the KeyVals of the results into that of the request, and combines their errors.
+func (p *ParallelStep) merge(request *pipeline.Request, results []*pipeline.Result) *pipeline.Result {
+	var (
+		keyVal  = fromMap(request.KeyVal)
+		setBy   = map[string]string{}
+		outputs = map[string]map[string]interface{}{}
+		errs    StepErrors
+	)
+	for i, res := range results {
+		name := p.names[i]
+		if res == nil {
+			errs = append(errs, &StepError{Step: name, Err: errors.New("pipeline returned no result")})
+			continue
+		}
+		if res.Error == ErrCancelled {
+			return &pipeline.Result{Error: ErrCancelled, KeyVal: keyVal}
+		}
+		if res.Error != nil {
+			errs = append(errs, &StepError{Step: name, Err: res.Error})
+		}
+
+		// A step which ran a command has a CommandResult of its own
+		if !reflect.DeepEqual(request.KeyVal["command"], res.KeyVal["command"]) {
+			outputs[name] = map[string]interface{}{}
+			for _, key := range commandOutputs {
+				if val, ok := res.KeyVal[key]; ok {
+					outputs[name][key] = val
+				}
+			}
+		}
+		for key, val := range res.KeyVal {
+			if isCommandOutput(key) {
+				continue
+			}
+			if prev, ok := request.KeyVal[key]; ok && reflect.DeepEqual(prev, val) {
+				continue
+			}
+			other, ok := setBy[key]
+			switch {
+			case !ok:
+				keyVal[key], setBy[key] = val, name
+			case key == "resources":
+				keyVal[key] = mergeResources(keyVal[key], val)
+			case key == "timings":
+				keyVal[key] = mergeTimings(keyVal[key], val)
+			case key == "outputs":
+				keyVal[key] = mergeOutputs(keyVal[key], val)
+			case !reflect.DeepEqual(keyVal[key], val):
+				// Running the job again would repeat the conflict
+				errs = append(errs, &SpecError{Err: &ConflictError{Key: key, Steps: [2]string{other, name}}})
+			}
+		}
+	}
+	if len(outputs) > 0 {
+		keyVal["outputs"] = mergeOutputs(keyVal["outputs"], outputs)
+	}
+
+	res := &pipeline.Result{KeyVal: keyVal}
+	switch len(errs) {
+	case 0:
+	case 1:
+		res.Error = errs[0]
+	default:
+		res.Error = errs
+	}
+	return res
+}
+
+// isCommandOutput reports whether a CommandStep sets the key. See commandOutputs.
+func isCommandOutput(key string) bool {
+	for _, output := range commandOutputs {
+		if key == output {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeOutputs merges the outputs recorded by two steps under "outputs".
+func mergeOutputs(a, b interface{}) interface{} {
+	merged := map[string]map[string]interface{}{}
+	for _, outputs := range []interface{}{a, b} {
+		m, _ := outputs.(map[string]map[string]interface{})
+		for step, out := range m {
+			merged[step] = out
+		}
+	}
+	return merged
+}
+
+// mergeResources merges the usages recorded by two steps under "resources".
+func mergeResources(a, b interface{}) interface{} {
+	merged := map[string]*cgroup.Usage{}
+	for _, resources := range []interface{}{a, b} {
+		m, _ := resources.(map[string]*cgroup.Usage)
+		for step, usage := range m {
+			merged[step] = usage
+		}
+	}
+	return merged
+}
+
+// mergeTimings merges the durations recorded by two steps under "timings". See Timing.
+func mergeTimings(a, b interface{}) interface{} {
+	merged := map[string]time.Duration{}
+	for _, timings := range []interface{}{a, b} {
+		m, _ := timings.(map[string]time.Duration)
+		for step, d := range m {
+			merged[step] = d
+		}
+	}
+	return merged
+}
+
+// Cancel cancels the steps which started, and keeps the others from starting.
+func (p *ParallelStep) Cancel() error {
+	p.Status("cancel step")
+	p.mu.Lock()
+	p.cancelled = true
+	pipes := p.pipes
+	p.mu.Unlock()
+
+	var err error
+	for _, workpipe := range pipes {
+		if cancelErr := workpipe.Cancel(); cancelErr != nil {
+			err = cancelErr
+		}
+	}
+	return err
+}
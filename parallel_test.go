@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// sleepStep sets the keys after sleeping, then fails with its error, if any.
+type sleepStep struct {
+	keyVal map[string]interface{}
+	err    error
+	pipeline.StepContext
+}
+
+func (s *sleepStep) Exec(request *pipeline.Request) *pipeline.Result {
+	time.Sleep(200 * time.Millisecond)
+	nextMap := fromMap(request.KeyVal)
+	for key, val := range s.keyVal {
+		nextMap[key] = val
+	}
+	return &pipeline.Result{Error: s.err, KeyVal: nextMap}
+}
+
+func (s *sleepStep) Cancel() error {
+	return nil
+}
+
+func TestParallelStep(t *testing.T) {
+	request := &pipeline.Request{KeyVal: map[string]interface{}{"archive": "/src"}}
+
+	step := NewParallelStep()
+	step.AddStep("checkstyle", &sleepStep{keyVal: map[string]interface{}{"checkstyle": 1}})
+	step.AddStep("findbugs", &sleepStep{keyVal: map[string]interface{}{"findbugs": 2}})
+	start := time.Now()
+	res := step.Exec(request)
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("expected the steps to run concurrently, observed %v", elapsed)
+	}
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res.KeyVal["archive"] != "/src" || res.KeyVal["checkstyle"] != 1 || res.KeyVal["findbugs"] != 2 {
+		t.Errorf("expected the merged KeyVal, observed %v", res.KeyVal)
+	}
+
+	step = NewParallelStep()
+	step.AddStep("a", &sleepStep{keyVal: map[string]interface{}{"score": 1}})
+	step.AddStep("b", &sleepStep{keyVal: map[string]interface{}{"score": 2}})
+	var conflict *ConflictError
+	if res := step.Exec(request); !errors.As(res.Error, &conflict) || conflict.Key != "score" || !IsSpecError(res.Error) || IsTransient(res.Error) {
+		t.Errorf("expected a conflict on score, which is not retried, observed %v", res.Error)
+	}
+
+	// The outputs of commands are stored under the name of their step instead of conflicting
+	step = NewParallelStep()
+	step.AddStep("a", NewStepFromCommand("a", "echo a"))
+	step.AddStep("b", NewStepFromCommand("b", "echo b; exit 1"))
+	step.AddStep("env", &sleepStep{keyVal: map[string]interface{}{"env": true}})
+	request.KeyVal["stdout"] = "before\n"
+	res = step.Exec(request)
+	outputs, _ := res.KeyVal["outputs"].(map[string]map[string]interface{})
+	if _, ok := res.Error.(*StepError); !ok || len(outputs) != 2 || outputs["a"]["stdout"] != "a\n" || outputs["b"]["exit_code"] != 1 ||
+		res.KeyVal["stdout"] != "before\n" || res.KeyVal["env"] != true {
+		t.Errorf("expected the failure of b and the outputs of a and b under their names, observed %v and %v", res.Error, res.KeyVal)
+	}
+	delete(request.KeyVal, "stdout")
+
+	var cases = []struct {
+		errs    []error
+		student bool
+	}{
+		{[]error{&StudentError{Err: errors.New("exit status 1")}, &StudentError{Err: errors.New("exit status 2")}}, true},
+		{[]error{&StudentError{Err: errors.New("exit status 1")}, errors.New("no such file")}, false},
+	}
+	for _, c := range cases {
+		step = NewParallelStep()
+		step.AddStep("a", &sleepStep{err: c.errs[0]})
+		step.AddStep("b", &sleepStep{err: c.errs[1]})
+		res := step.Exec(request)
+		if _, ok := res.Error.(StepErrors); !ok || IsStudentError(res.Error) != c.student {
+			t.Errorf("expected both errors, the fault of the student: %v, observed %v", c.student, res.Error)
+		}
+		if msg := res.Error.Error(); !strings.Contains(msg, "a: "+c.errs[0].Error()) || !strings.Contains(msg, "b: "+c.errs[1].Error()) {
+			t.Errorf("expected the errors of both steps, observed %q", msg)
+		}
+	}
+}
+
+func TestParallelSpec(t *testing.T) {
+	os.Setenv("PARALLEL_A", "a")
+	os.Setenv("PARALLEL_B", "b")
+	defer os.Unsetenv("PARALLEL_A")
+	defer os.Unsetenv("PARALLEL_B")
+
+	spec, err := ParseJobSpec([]byte(`
+name: parallel
+stages:
+  - name: run
+    steps:
+      - {type: env, parallel: true, params: {vars: [PARALLEL_A]}}
+      - {type: env, parallel: true, params: {vars: [PARALLEL_B]}}
+      - {type: command, params: {args: [echo, "{{.PARALLEL_A}}{{.PARALLEL_B}}"]}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workpipe, err := spec.Pipeline(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := workpipe.Run()
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if stdout := res.KeyVal["stdout"]; stdout != "ab\n" {
+		t.Errorf("expected the step after the parallel ones to see both of their keys, observed %q", stdout)
+	}
+}
@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/alligrader/jobs/cgroup"
+)
+
+// CancelGracePeriod is how long a cancelled command has to exit after SIGTERM before it is killed.
+const CancelGracePeriod = 5 * time.Second
+
+// ErrCancelled is returned by the Exec of a step which was cancelled, or whose context was done, while its command ran.
+var ErrCancelled = errors.New("step cancelled")
+
+// cgroupKey is the key of the cgroupConfig of a context.
+type cgroupKey struct{}
+
+// cgroupConfig is where the commands of steps run, and how much they may use.
+type cgroupConfig struct {
+	parent *cgroup.Parent
+	limits cgroup.Limits
+}
+
+// WithCgroup returns a context under which the steps run each of their commands in a cgroup of its own,
+// created under parent with the limits. They record what their commands used under "resources", a
+// map[string]*cgroup.Usage keyed by the name of the step.
+func WithCgroup(parent context.Context, cgroups *cgroup.Parent, limits cgroup.Limits) context.Context {
+	return context.WithValue(parent, cgroupKey{}, cgroupConfig{parent: cgroups, limits: limits})
+}
+
+// recordUsage adds the usage of the command of the named step to "resources", if it was measured.
+func recordUsage(keyVal map[string]interface{}, name string, usage *cgroup.Usage) {
+	if usage == nil {
+		return
+	}
+	resources := map[string]*cgroup.Usage{}
+	if prev, ok := keyVal["resources"].(map[string]*cgroup.Usage); ok {
+		for step, u := range prev {
+			resources[step] = u
+		}
+	}
+	resources[name] = usage
+	keyVal["resources"] = resources
+}
+
+// procGroup runs the command of a step in its own process group, so that cancelling
+// the step stops the command along with every process it started, such as a JVM.
+type procGroup struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+	// cancelled stops the command running, or else the next one started. The command it stopped,
+	// or did not let start, resets it, so that a step which runs again, e.g. when retried, starts its command again.
+	cancelled bool
+	grace     time.Duration
+	group     *cgroup.Group
+	// usage is what the command which exited last used, if it ran in a cgroup.
+	usage *cgroup.Usage
+}
+
+// start starts the command in a new process group, unless the step was cancelled since its last command.
+// The command is cancelled once the context is done, and runs in a cgroup if the context says so,
+// under the tighter of its limits and of those given. Limits on memory or processes need a cgroup.
+func (p *procGroup) start(ctx context.Context, cmd *exec.Cmd, limits cgroup.Limits) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancelled || ctx.Err() != nil {
+		p.cancelled = false
+		return ErrCancelled
+	}
+
+	var group *cgroup.Group
+	config, ok := ctx.Value(cgroupKey{}).(cgroupConfig)
+	switch {
+	case ok:
+		var err error
+		if group, err = config.parent.New(tighten(config.limits, limits)); err != nil {
+			return err
+		}
+	case limits.Memory > 0 || limits.Processes > 0:
+		return errors.New("limiting the memory or processes of a command needs a cgroup, see WithCgroup")
+	}
+	setProcessGroup(cmd)
+	if group != nil {
+		// Start the command in the cgroup, rather than move it there, so that none of its children escapes
+		dir, err := os.Open(group.Path())
+		if err == nil {
+			defer dir.Close()
+			err = startInCgroup(cmd, dir)
+		}
+		if err != nil {
+			group.Close()
+			return err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		if group != nil {
+			group.Close()
+		}
+		return err
+	}
+	exited := make(chan struct{})
+	p.cmd, p.exited, p.group, p.usage = cmd, exited, group, nil
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.cancel()
+		case <-exited:
+		}
+	}()
+	return nil
+}
+
+// wait waits for the command started last to exit. It returns ErrCancelled if the step was cancelled meanwhile,
+// and a cgroup.OOMError if the command failed after running out of memory in its cgroup.
+// The cgroup is then removed, killing the processes the command left behind.
+func (p *procGroup) wait() error {
+	err := p.cmd.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.exited)
+	if p.group != nil {
+		// Usage that cannot be read is left out rather than failing the step
+		p.usage, _ = p.group.Usage()
+		p.group.Close()
+		p.group = nil
+	}
+	if p.cancelled {
+		p.cancelled = false
+		return ErrCancelled
+	}
+	if err != nil && p.usage != nil && p.usage.OOMKills > 0 {
+		return &cgroup.OOMError{Usage: p.usage}
+	}
+	return err
+}
+
+// run starts the command and waits for it.
+func (p *procGroup) run(ctx context.Context, cmd *exec.Cmd, limits cgroup.Limits) error {
+	if err := p.start(ctx, cmd, limits); err != nil {
+		return err
+	}
+	return p.wait()
+}
+
+// cancel sends SIGTERM to the process group of the running command, and SIGKILL
+// if it still runs after the grace period. It does not wait for the command to exit.
+func (p *procGroup) cancel() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancelled {
+		return nil
+	}
+	p.cancelled = true
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+
+	cmd, exited, grace := p.cmd, p.exited, p.grace
+	if grace == 0 {
+		grace = CancelGracePeriod
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			killGroup(cmd)
+		}
+	}()
+	return terminateGroup(cmd)
+}
+
+// tighten returns the tighter of each of the limits, a zero limit being none.
+func tighten(limits, other cgroup.Limits) cgroup.Limits {
+	if other.Memory > 0 && (limits.Memory == 0 || other.Memory < limits.Memory) {
+		limits.Memory = other.Memory
+	}
+	if other.CPUs > 0 && (limits.CPUs == 0 || other.CPUs < limits.CPUs) {
+		limits.CPUs = other.CPUs
+	}
+	if other.Processes > 0 && (limits.Processes == 0 || other.Processes < limits.Processes) {
+		limits.Processes = other.Processes
+	}
+	return limits
+}
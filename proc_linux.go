@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package jobs
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startInCgroup makes the command start in the cgroup whose directory is open as dir. It needs Linux 5.7.
+func startInCgroup(cmd *exec.Cmd, dir *os.File) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, int(dir.Fd())
+	return nil
+}
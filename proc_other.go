@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package jobs
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// startInCgroup fails: cgroups are only supported on Linux.
+func startInCgroup(cmd *exec.Cmd, dir *os.File) error {
+	return errors.New("cgroups are only supported on Linux")
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package jobs
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Windows has neither process groups nor SIGTERM: cancelling kills the command itself.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
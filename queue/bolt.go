@@ -0,0 +1,270 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket    = []byte("jobs")
+	pendingBucket = []byte("pending")
+)
+
+// BoltQueue is a Queue stored in a BoltDB file, which survives restarts.
+// The "jobs" bucket maps the ID of every job to the job, and the "pending" bucket
+// indexes the pending jobs by the order they were enqueued or retried in.
+type BoltQueue struct {
+	db  *bolt.DB
+	log *logrus.Logger
+
+	// MaxAttempts bounds the number of leases of a job, defaults to DefaultMaxAttempts. A job abandoned
+	// that many times, e.g. because it crashes the worker, ends Failed instead of being leased again.
+	MaxAttempts int
+}
+
+// OpenBoltQueue opens or creates the queue stored at path.
+// BoltDB locks the file, so only a single process may open it. Therefore every job still
+// Running was abandoned by a process which died, and goes back to Pending to be run again.
+func OpenBoltQueue(path string, logger *logrus.Logger) (*BoltQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open the queue %v: %v", path, err)
+	}
+
+	q := &BoltQueue{db: db, log: logger, MaxAttempts: DefaultMaxAttempts}
+	if err := q.recover(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Close closes the database.
+func (q *BoltQueue) Close() error {
+	return q.db.Close()
+}
+
+func (q *BoltQueue) recover() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		jobs, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		pending, err := tx.CreateBucketIfNotExists(pendingBucket)
+		if err != nil {
+			return err
+		}
+
+		var abandoned []*Job
+		err = jobs.ForEach(func(k, v []byte) error {
+			job, err := decode(v)
+			if err == nil && job.State == Running {
+				abandoned = append(abandoned, job)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, job := range abandoned {
+			q.log.Warnf("Job %v was abandoned by %v, it will run again", job.ID, job.Lease)
+			job.State, job.Lease, job.Updated = Pending, "", time.Now().UTC()
+			if err := putPending(jobs, pending, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Enqueue adds a pending job. A job without an ID is given one.
+func (q *BoltQueue) Enqueue(job *Job) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		jobs, pending := tx.Bucket(jobsBucket), tx.Bucket(pendingBucket)
+		if job.ID == "" {
+			seq, err := jobs.NextSequence()
+			if err != nil {
+				return err
+			}
+			job.ID = fmt.Sprintf("job-%v", seq)
+		}
+		if jobs.Get([]byte(job.ID)) != nil {
+			q.log.Infof("Job %v is already queued", job.ID)
+			return nil
+		}
+
+		if job.Received.IsZero() {
+			job.Received = time.Now().UTC()
+		}
+		job.State, job.Updated = Pending, time.Now().UTC()
+		return putPending(jobs, pending, job)
+	})
+}
+
+// Lease marks the oldest pending job which is due as Running, and returns it. It returns nil if there is none.
+// Pending jobs which already ran MaxAttempts times end Failed on the way.
+func (q *BoltQueue) Lease(worker string) (*Job, error) {
+	var leased *Job
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		jobs, pending := tx.Bucket(jobsBucket), tx.Bucket(pendingBucket)
+		now := time.Now().UTC()
+
+		c := pending.Cursor()
+		for k, id := c.First(); k != nil; k, id = c.Next() {
+			job, err := decode(jobs.Get(id))
+			if err != nil {
+				return err
+			}
+			if job.NotBefore.After(now) {
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+
+			if q.MaxAttempts > 0 && job.Attempts >= q.MaxAttempts {
+				q.log.Errorf("Job %v was abandoned %v times, giving up", job.ID, job.Attempts)
+				job.State, job.Updated = Failed, now
+				job.Error = fmt.Sprintf("abandoned after %v attempts", job.Attempts)
+				if err := put(jobs, job); err != nil {
+					return err
+				}
+				continue
+			}
+			job.State, job.Lease, job.Updated = Running, worker+"/"+randomID(), now
+			job.Attempts++
+			leased = job
+			return put(jobs, job)
+		}
+		return nil
+	})
+	return leased, err
+}
+
+// Complete ends a leased job as Done.
+func (q *BoltQueue) Complete(job *Job, err error) error {
+	return q.finish(job, func(stored *Job) {
+		stored.State, stored.Error = Done, errString(err)
+	}, nil)
+}
+
+// Retry returns a leased job to Pending, to be leased again at the given time.
+func (q *BoltQueue) Retry(job *Job, at time.Time, err error) error {
+	return q.finish(job, func(stored *Job) {
+		stored.State, stored.Error, stored.NotBefore = Pending, errString(err), at.UTC()
+	}, putPending)
+}
+
+// Fail ends a leased job as Failed.
+func (q *BoltQueue) Fail(job *Job, err error) error {
+	return q.finish(job, func(stored *Job) {
+		stored.State, stored.Error = Failed, errString(err)
+	}, nil)
+}
+
+// Get returns the job with the given ID, or nil.
+func (q *BoltQueue) Get(id string) (*Job, error) {
+	var job *Job
+	err := q.db.View(func(tx *bolt.Tx) error {
+		blob := tx.Bucket(jobsBucket).Get([]byte(id))
+		if blob == nil {
+			return nil
+		}
+		var err error
+		job, err = decode(blob)
+		return err
+	})
+	return job, err
+}
+
+// List returns every job in the given states, or every job if none are given.
+func (q *BoltQueue) List(states ...State) ([]*Job, error) {
+	var list []*Job
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			job, err := decode(v)
+			if err != nil {
+				return err
+			}
+			for _, state := range states {
+				if job.State == state {
+					list = append(list, job)
+					return nil
+				}
+			}
+			if len(states) == 0 {
+				list = append(list, job)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+// finish updates a job leased by the caller, as checked by its lease, and stores it with store if given.
+func (q *BoltQueue) finish(job *Job, update func(stored *Job), store func(jobs, pending *bolt.Bucket, job *Job) error) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		jobs, pending := tx.Bucket(jobsBucket), tx.Bucket(pendingBucket)
+		blob := jobs.Get([]byte(job.ID))
+		if blob == nil {
+			return fmt.Errorf("no job %v", job.ID)
+		}
+		stored, err := decode(blob)
+		if err != nil {
+			return err
+		}
+		if stored.State != Running || stored.Lease != job.Lease {
+			return ErrNotLeased
+		}
+
+		update(stored)
+		stored.Lease, stored.Updated = "", time.Now().UTC()
+		*job = *stored
+		if store == nil {
+			return put(jobs, stored)
+		}
+		return store(jobs, pending, stored)
+	})
+}
+
+// putPending stores the job and indexes it as pending behind every other pending job.
+func putPending(jobs, pending *bolt.Bucket, job *Job) error {
+	seq, err := pending.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := pending.Put(key, []byte(job.ID)); err != nil {
+		return err
+	}
+	return put(jobs, job)
+}
+
+func put(jobs *bolt.Bucket, job *Job) error {
+	blob, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return jobs.Put([]byte(job.ID), blob)
+}
+
+func decode(blob []byte) (*Job, error) {
+	var job Job
+	err := json.Unmarshal(blob, &job)
+	return &job, err
+}
+
+func randomID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
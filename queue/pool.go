@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alligrader/jobs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxAttempts is the number of times a job failing from infrastructure errors is run.
+	DefaultMaxAttempts = 3
+	// DefaultPollInterval is how long an idle worker waits before leasing again.
+	DefaultPollInterval = time.Second
+	// DefaultBackoff is the wait before the first retry; every retry waits twice as long as the last.
+	DefaultBackoff = 30 * time.Second
+	// maxBackoff caps the wait between retries.
+	maxBackoff = 30 * time.Minute
+)
+
+// RunFunc runs a job. An error satisfying jobs.IsStudentError means that the submission failed,
+// and ends the job, as does a timeout. A jobs.SpecError fails the job at once. Any other error is an infrastructure
+// failure, and the job is retried.
+type RunFunc func(job *Job) error
+
+// Pool is a fixed number of workers leasing jobs from a queue.
+type Pool struct {
+	queue   Queue
+	run     RunFunc
+	workers int
+	log     *logrus.Logger
+
+	// MaxAttempts bounds the number of runs of a job, defaults to DefaultMaxAttempts.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, defaults to DefaultBackoff.
+	Backoff time.Duration
+	// PollInterval is how long an idle worker waits before leasing again, defaults to DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// NewPool creates a pool of workers running the jobs of the queue with run.
+func NewPool(queue Queue, run RunFunc, workers int, logger *logrus.Logger) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{
+		queue:        queue,
+		run:          run,
+		workers:      workers,
+		log:          logger,
+		MaxAttempts:  DefaultMaxAttempts,
+		Backoff:      DefaultBackoff,
+		PollInterval: DefaultPollInterval,
+	}
+}
+
+// Run runs jobs until the context is done, then waits for the running jobs to end.
+func (p *Pool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			p.work(ctx, worker)
+		}(fmt.Sprintf("worker-%v", i+1))
+	}
+	wg.Wait()
+}
+
+func (p *Pool) work(ctx context.Context, worker string) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := p.queue.Lease(worker)
+		if err != nil {
+			p.log.Errorf("%v could not lease a job: %v", worker, err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.PollInterval):
+			}
+			continue
+		}
+
+		p.log.Infof("%v is running job %v (attempt %v)", worker, job.ID, job.Attempts)
+		p.finish(job, p.safeRun(job))
+	}
+}
+
+// safeRun runs the job, turning a panic into an infrastructure failure.
+func (p *Pool) safeRun(job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return p.run(job)
+}
+
+func (p *Pool) finish(job *Job, runErr error) {
+	var err error
+	switch {
+	case runErr == nil || jobs.IsStudentError(runErr) || jobs.IsTimeout(runErr):
+		err = p.queue.Complete(job, runErr)
+	case jobs.IsSpecError(runErr):
+		// Running the job again would fail the same way
+		p.log.Errorf("Job %v failed because of its spec: %v", job.ID, runErr)
+		err = p.queue.Fail(job, runErr)
+	case job.Attempts < p.MaxAttempts:
+		wait := p.backoff(job.Attempts)
+		p.log.Warnf("Job %v failed, retrying in %v: %v", job.ID, wait, runErr)
+		err = p.queue.Retry(job, time.Now().Add(wait), runErr)
+	default:
+		p.log.Errorf("Job %v failed %v times, giving up: %v", job.ID, job.Attempts, runErr)
+		err = p.queue.Fail(job, runErr)
+	}
+	if err != nil {
+		p.log.Errorf("Could not record the outcome of job %v: %v", job.ID, err)
+	}
+}
+
+// backoff returns the wait after the given number of attempts.
+func (p *Pool) backoff(attempts int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
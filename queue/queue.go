@@ -0,0 +1,66 @@
+// Package queue holds grading jobs until a worker is free to run them, so that a deadline rush
+// is graded at the pace of the workers instead of the pace of the pushes.
+package queue
+
+import (
+	"errors"
+	"time"
+)
+
+// State is the stage of the life of a job.
+type State string
+
+// The states of a job. A job is Pending until a worker leases it, then Running.
+// It ends Done when its pipeline ran, even if the submission failed, or Failed when the grader
+// itself kept failing. An infrastructure failure sends it back to Pending until it runs out of attempts.
+const (
+	Pending State = "pending"
+	Running State = "running"
+	Done    State = "done"
+	Failed  State = "failed"
+)
+
+// ErrNotLeased is returned when completing a job which is not leased by the caller,
+// e.g. because its lease was lost to a restart.
+var ErrNotLeased = errors.New("job is not leased")
+
+// Job is a grading job: a job spec and the KeyVal seeding it, such as the OWNER, REPO and SHA of the submission.
+type Job struct {
+	// ID identifies the job. Enqueueing a job with a known ID is a no-op,
+	// so that a redelivered webhook, which keeps its delivery ID, is not graded twice.
+	ID       string                 `json:"id"`
+	Event    string                 `json:"event,omitempty"`
+	Spec     string                 `json:"spec"`
+	KeyVal   map[string]interface{} `json:"keyval"`
+	Received time.Time              `json:"received"`
+
+	State     State     `json:"state"`
+	Attempts  int       `json:"attempts"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	Lease     string    `json:"lease,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Queue stores jobs until they are graded.
+type Queue interface {
+	// Enqueue adds a pending job.
+	Enqueue(job *Job) error
+	// Lease marks the oldest pending job which is due as Running, and returns it. It returns nil if there is none.
+	Lease(worker string) (*Job, error)
+	// Complete ends a leased job as Done, recording err, the failure of the submission if any.
+	Complete(job *Job, err error) error
+	// Retry returns a leased job to Pending after an infrastructure failure, to be leased again at the given time.
+	Retry(job *Job, at time.Time, err error) error
+	// Fail ends a leased job as Failed.
+	Fail(job *Job, err error) error
+	// Get returns the job with the given ID, or nil.
+	Get(id string) (*Job, error)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alligrader/jobs"
+	"github.com/sirupsen/logrus"
+)
+
+func openTestQueue(t *testing.T) (*BoltQueue, string) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "queue.db")
+	q, err := OpenBoltQueue(path, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, path
+}
+
+func TestBoltQueue(t *testing.T) {
+	q, path := openTestQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := q.Enqueue(&Job{ID: id, Spec: "hw1.yml", KeyVal: map[string]interface{}{"OWNER": id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if list, _ := q.List(Pending); len(list) != 2 {
+		t.Fatalf("expected a duplicate ID to be ignored, observed %v pending jobs", len(list))
+	}
+
+	a, err := q.Lease("w1")
+	if err != nil || a == nil || a.ID != "a" || a.State != Running || a.Attempts != 1 {
+		t.Fatalf("expected to lease job a, observed %+v (%v)", a, err)
+	}
+	if err := q.Retry(a, time.Now().Add(time.Hour), errors.New("network is down")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is not due for an hour, so b comes first.
+	b, _ := q.Lease("w1")
+	if b == nil || b.ID != "b" {
+		t.Fatalf("expected to lease job b, observed %+v", b)
+	}
+	if next, _ := q.Lease("w2"); next != nil {
+		t.Fatalf("expected no due job, observed %+v", next)
+	}
+
+	// A restart gives the abandoned job b back to the workers, so a stale worker may not complete it.
+	q.Close()
+	if q, err = OpenBoltQueue(path, logrus.New()); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Complete(b, nil); err != ErrNotLeased {
+		t.Errorf("expected %v, observed %v", ErrNotLeased, err)
+	}
+
+	again, _ := q.Lease("w3")
+	if again == nil || again.ID != "b" || again.Attempts != 2 {
+		t.Fatalf("expected to lease job b again, observed %+v", again)
+	}
+	if err := q.Complete(again, &jobs.StudentError{Err: errors.New("exit status 1")}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := q.Get("b"); stored.State != Done || stored.Error != "exit status 1" || stored.KeyVal["OWNER"] != "b" {
+		t.Errorf("unexpected job %+v", stored)
+	}
+}
+
+func TestBoltQueueAbandoned(t *testing.T) {
+	q, path := openTestQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	q.MaxAttempts = 2
+	if err := q.Enqueue(&Job{ID: "crash", Spec: "hw1.yml"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job crashes the worker every time it runs
+	for attempt := 1; attempt <= 2; attempt++ {
+		if job, _ := q.Lease("w1"); job == nil || job.Attempts != attempt {
+			t.Fatalf("expected attempt %v of the job, observed %+v", attempt, job)
+		}
+		q.Close()
+		var err error
+		if q, err = OpenBoltQueue(path, logrus.New()); err != nil {
+			t.Fatal(err)
+		}
+		q.MaxAttempts = 2
+	}
+	defer q.Close()
+
+	if job, _ := q.Lease("w1"); job != nil {
+		t.Errorf("expected the job not to be leased a third time, observed %+v", job)
+	}
+	if stored, _ := q.Get("crash"); stored.State != Failed || stored.Attempts != 2 {
+		t.Errorf("expected the job to fail after 2 attempts, observed %+v", stored)
+	}
+}
+
+func TestPool(t *testing.T) {
+	q, path := openTestQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer q.Close()
+
+	var (
+		mu   sync.Mutex
+		runs = map[string]int{}
+	)
+	run := func(job *Job) error {
+		mu.Lock()
+		runs[job.ID]++
+		n := runs[job.ID]
+		mu.Unlock()
+
+		switch job.ID {
+		case "flaky":
+			if n == 1 {
+				return errors.New("GitHub is down")
+			}
+		case "student":
+			return &jobs.StudentError{Err: errors.New("does not compile")}
+		case "spec":
+			return &jobs.SpecError{Err: errors.New("steps both set score")}
+		case "broken":
+			panic("grader bug")
+		}
+		return nil
+	}
+
+	for _, id := range []string{"ok", "flaky", "student", "spec", "broken"} {
+		q.Enqueue(&Job{ID: id})
+	}
+
+	pool := NewPool(q, run, 2, logrus.New())
+	pool.Backoff = time.Millisecond
+	pool.PollInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if pending, _ := q.List(Pending, Running); len(pending) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	var expected = []struct {
+		id    string
+		state State
+		runs  int
+	}{
+		{"ok", Done, 1},
+		{"flaky", Done, 2},
+		{"student", Done, 1},
+		{"spec", Failed, 1},
+		{"broken", Failed, DefaultMaxAttempts},
+	}
+	for _, e := range expected {
+		job, _ := q.Get(e.id)
+		if job.State != e.state || runs[e.id] != e.runs {
+			t.Errorf("%v: expected %v after %v runs, observed %v after %v runs", e.id, e.state, e.runs, job.State, runs[e.id])
+		}
+	}
+}
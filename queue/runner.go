@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"github.com/alligrader/jobs/cgroup"
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Observer follows the runs of a Runner as they happen, e.g. to show their progress live.
+type Observer interface {
+	// Started is called before the pipeline runs. The recorder holds the status of its steps.
+	Started(job *Job, rec *history.Recorder)
+	// Status is called with every status line emitted by a step.
+	Status(job *Job, line string)
+	// Finished is called with the record of the run.
+	Finished(job *Job, run *history.Run)
+}
+
+// Runner runs the job spec of a job, seeded with its KeyVal.
+type Runner struct {
+	// History records every run, if not nil.
+	History history.Store
+	// Observers follow every run.
+	Observers []Observer
+	// Wrap decorates every step built from the spec, if not nil, e.g. to measure it.
+	Wrap jobs.StepWrapper
+	// Timeout limits the runs of jobs whose spec sets no timeout, if not zero.
+	Timeout time.Duration
+	// Cgroups holds a cgroup for the commands of every step, limited by Limits, if not nil.
+	Cgroups *cgroup.Parent
+	Limits  cgroup.Limits
+	// Client sends the requests of the steps to GitHub and other APIs, if not nil, e.g. to measure them.
+	Client *http.Client
+	log    *logrus.Logger
+}
+
+// NewRunner creates a Runner. Its Run method is the RunFunc of a Pool.
+func NewRunner(store history.Store, logger *logrus.Logger) *Runner {
+	return &Runner{History: store, log: logger}
+}
+
+// Run runs the job, traced by the global OpenTelemetry tracer provider.
+// A spec which cannot be loaded fails the job like any other infrastructure failure.
+func (r *Runner) Run(job *Job) (err error) {
+	spec, err := jobs.LoadJobSpec(job.Spec)
+	if err != nil {
+		return err
+	}
+
+	timeout := spec.Timeout
+	if timeout == 0 {
+		timeout = r.Timeout
+	}
+	ctx, cancel := jobs.WithJobTimeout(context.Background(), timeout)
+	defer cancel()
+	if r.Cgroups != nil {
+		ctx = jobs.WithCgroup(ctx, r.Cgroups, r.Limits)
+	}
+	if r.Client != nil {
+		ctx = jobs.WithHTTPClient(ctx, r.Client)
+	}
+
+	trace := tracing.StartJob(ctx, spec.Name, job.KeyVal,
+		tracing.AttrJob.String(job.ID), tracing.AttrAttempt.Int(job.Attempts))
+	defer func() { trace.End(err) }()
+
+	rec := history.NewRecorder(job.ID, job.Attempts, job.Spec, spec, job.KeyVal)
+	wrap := func(stage string, stepSpec jobs.StepSpec, step pipeline.Step) pipeline.Step {
+		step = trace.Wrap(stage, stepSpec, step)
+		step = rec.Wrap(stage, stepSpec, step)
+		if r.Wrap != nil {
+			step = r.Wrap(stage, stepSpec, step)
+		}
+		return step
+	}
+	workpipe, err := spec.WrappedPipeline(r.log, wrap, jobs.NewSeedStep(job.KeyVal))
+	if err != nil {
+		r.save(job, rec.Finish(nil, err))
+		return err
+	}
+
+	for _, o := range r.Observers {
+		o.Started(job, rec)
+	}
+	res := jobs.RunContext(ctx, workpipe, func(line string) {
+		r.log.Debugf("[%v] %v", job.ID, line)
+		rec.Status(line)
+		for _, o := range r.Observers {
+			o.Status(job, line)
+		}
+	})
+	if res == nil {
+		err = fmt.Errorf("pipeline returned no result")
+	} else {
+		err = res.Error
+	}
+	r.save(job, rec.Finish(res, err))
+	return err
+}
+
+func (r *Runner) save(job *Job, run *history.Run) {
+	if r.History != nil {
+		if err := r.History.Save(run); err != nil {
+			r.log.Errorf("Could not record run %v: %v", run.ID, err)
+		}
+	}
+	for _, o := range r.Observers {
+		o.Finished(job, run)
+	}
+}
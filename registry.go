@@ -0,0 +1,295 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+// ParamType is the type of a step parameter in a job spec.
+type ParamType string
+
+// The parameter types understood by the registry.
+const (
+	ParamString   ParamType = "string"
+	ParamBool     ParamType = "bool"
+	ParamNumber   ParamType = "number"
+	ParamStrings  ParamType = "strings"
+	ParamDuration ParamType = "duration"
+	ParamTime     ParamType = "time"
+)
+
+// Param documents a parameter accepted by a step type.
+type Param struct {
+	Name     string    `json:"name"`
+	Type     ParamType `json:"type"`
+	Required bool      `json:"required"`
+	Doc      string    `json:"doc"`
+}
+
+// StepFactory creates a step from parameters which have already been checked against the step type's schema.
+type StepFactory func(params Params, logger *logrus.Logger) (pipeline.Step, error)
+
+// StepType is a kind of step which can be declared by name in a job spec.
+type StepType struct {
+	Name   string      `json:"name"`
+	Doc    string      `json:"doc"`
+	Params []Param     `json:"params"`
+	New    StepFactory `json:"-"`
+	// Check, if not nil, validates the parameters together, e.g. that one of two is set.
+	Check func(params Params) error `json:"-"`
+}
+
+// Usage documents the step type and its parameters.
+func (t StepType) Usage() string {
+	lines := []string{t.Name + ": " + t.Doc}
+	for _, p := range t.Params {
+		required := ""
+		if p.Required {
+			required = ", required"
+		}
+		lines = append(lines, fmt.Sprintf("    %v (%v%v): %v", p.Name, p.Type, required, p.Doc))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t StepType) param(name string) (Param, bool) {
+	for _, p := range t.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// Registry holds the step types that job specs can refer to. It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	types map[string]StepType
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{types: map[string]StepType{}}
+}
+
+// DefaultRegistry holds the steps of this package, and any registered by other packages with Register.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a step type to the DefaultRegistry. It is meant to be called from the init function of
+// packages providing their own steps, and panics if the type is invalid or its name is already taken.
+func Register(t StepType) {
+	if err := DefaultRegistry.Register(t); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds a step type to the registry.
+func (r *Registry) Register(t StepType) error {
+	if t.Name == "" {
+		return errors.New("step type has no name")
+	}
+	if t.New == nil {
+		return errors.New("step type " + t.Name + " has no constructor")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[t.Name]; ok {
+		return errors.New("step type " + t.Name + " is already registered")
+	}
+	r.types[t.Name] = t
+	return nil
+}
+
+// Lookup returns the step type registered under the name.
+func (r *Registry) Lookup(name string) (StepType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// List returns all registered step types, sorted by name.
+func (r *Registry) List() []StepType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]StepType, 0, len(r.types))
+	for _, t := range r.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+func (r *Registry) names() []string {
+	var names []string
+	for _, t := range r.List() {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// Validate checks the step's parameters against the schema of its type.
+func (r *Registry) Validate(spec StepSpec) error {
+	_, err := r.params(spec)
+	return err
+}
+
+// Build creates the step declared by the spec.
+func (r *Registry) Build(spec StepSpec, logger *logrus.Logger) (pipeline.Step, error) {
+	params, err := r.params(spec)
+	if err != nil {
+		return nil, err
+	}
+	t, _ := r.Lookup(spec.Type)
+	step, err := t.New(params, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%v step: %v", spec.Type, err)
+	}
+	return step, nil
+}
+
+// params checks the raw parameters of the spec and converts them to the types declared by the schema.
+func (r *Registry) params(spec StepSpec) (Params, error) {
+	t, ok := r.Lookup(spec.Type)
+	if !ok {
+		return nil, fmt.Errorf("unknown step type %q (known types: %v)", spec.Type, strings.Join(r.names(), ", "))
+	}
+
+	params := Params{}
+	for key, raw := range spec.Params {
+		p, ok := t.param(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %q for step type %q", key, spec.Type)
+		}
+		val, err := convertParam(p.Type, raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q of step type %q: %v", key, spec.Type, err)
+		}
+		params[key] = val
+	}
+
+	for _, p := range t.Params {
+		if _, ok := params[p.Name]; p.Required && !ok {
+			return nil, fmt.Errorf("missing parameter %q for step type %q", p.Name, spec.Type)
+		}
+	}
+	if t.Check != nil {
+		if err := t.Check(params); err != nil {
+			return nil, fmt.Errorf("%v for step type %q", err, spec.Type)
+		}
+	}
+	return params, nil
+}
+
+func convertParam(typ ParamType, raw interface{}) (interface{}, error) {
+	switch typ {
+	case ParamString:
+		switch val := raw.(type) {
+		case string:
+			return val, nil
+		case int:
+			return strconv.Itoa(val), nil
+		}
+	case ParamBool:
+		if val, ok := raw.(bool); ok {
+			return val, nil
+		}
+	case ParamNumber:
+		switch val := raw.(type) {
+		case int:
+			return float64(val), nil
+		case float64:
+			return val, nil
+		}
+	case ParamStrings:
+		if list, ok := raw.([]interface{}); ok {
+			strs := make([]string, 0, len(list))
+			for _, elem := range list {
+				str, ok := elem.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a list of strings, found a %T", elem)
+				}
+				strs = append(strs, str)
+			}
+			return strs, nil
+		}
+	case ParamDuration:
+		if str, ok := raw.(string); ok {
+			return time.ParseDuration(str)
+		}
+	case ParamTime:
+		switch val := raw.(type) {
+		case time.Time:
+			return val, nil
+		case string:
+			return time.Parse(time.RFC3339, val)
+		}
+	default:
+		return nil, fmt.Errorf("unknown parameter type %q", typ)
+	}
+	return nil, fmt.Errorf("expected a %v, found a %T", typ, raw)
+}
+
+// Params holds the parameters of a step, converted to the types declared by its StepType.
+// Parameters which were not set read as the zero value.
+type Params map[string]interface{}
+
+// Has reports whether the parameter was set in the job spec.
+func (p Params) Has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+// String returns a ParamString parameter.
+func (p Params) String(name string) string {
+	str, _ := p[name].(string)
+	return str
+}
+
+// StringOr returns a ParamString parameter, or def if it is not set or empty.
+func (p Params) StringOr(name, def string) string {
+	if str := p.String(name); str != "" {
+		return str
+	}
+	return def
+}
+
+// Bool returns a ParamBool parameter.
+func (p Params) Bool(name string) bool {
+	b, _ := p[name].(bool)
+	return b
+}
+
+// Number returns a ParamNumber parameter.
+func (p Params) Number(name string) float64 {
+	f, _ := p[name].(float64)
+	return f
+}
+
+// Strings returns a ParamStrings parameter.
+func (p Params) Strings(name string) []string {
+	strs, _ := p[name].([]string)
+	return strs
+}
+
+// Duration returns a ParamDuration parameter.
+func (p Params) Duration(name string) time.Duration {
+	d, _ := p[name].(time.Duration)
+	return d
+}
+
+// Time returns a ParamTime parameter.
+func (p Params) Time(name string) time.Time {
+	t, _ := p[name].(time.Time)
+	return t
+}
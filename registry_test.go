@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRegistry(t *testing.T) {
+	var (
+		registry = NewRegistry()
+		built    Params
+		seed     = StepType{
+			Name: "seed",
+			Doc:  "Seeds the KeyVal.",
+			Params: []Param{
+				{Name: "key", Type: ParamString, Required: true, Doc: "key to set"},
+				{Name: "timeout", Type: ParamDuration, Doc: "unused"},
+				{Name: "weight", Type: ParamNumber, Doc: "unused"},
+			},
+			New: func(p Params, logger *logrus.Logger) (pipeline.Step, error) {
+				built = p
+				return NewSeedStep(map[string]interface{}{p.String("key"): true}), nil
+			},
+		}
+	)
+
+	if err := registry.Register(seed); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(seed); err == nil {
+		t.Error("expected an error registering the same name twice")
+	}
+
+	spec := StepSpec{Type: "seed", Params: map[string]interface{}{"key": "ready", "timeout": "2m", "weight": 3}}
+	step, err := registry.Build(spec, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if built.Duration("timeout") != 2*time.Minute || built.Number("weight") != 3 {
+		t.Errorf("parameters were not converted to their schema types: %#v", built)
+	}
+	if res := step.Exec(&pipeline.Request{}); res.KeyVal["ready"] != true {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	if err := registry.Validate(StepSpec{Type: "seed", Params: map[string]interface{}{"key": []interface{}{}}}); err == nil {
+		t.Error("expected a type error")
+	}
+
+	list := registry.List()
+	if len(list) != 1 || !strings.Contains(list[0].Usage(), "key (string, required): key to set") {
+		t.Errorf("unexpected listing %+v", list)
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	for _, name := range []string{"env", "command", "github", "checkstyle", "findbugs", "comment", "lateness", "gradescope", "canvas", "lti"} {
+		if _, ok := DefaultRegistry.Lookup(name); !ok {
+			t.Errorf("step type %q is not registered", name)
+		}
+	}
+}
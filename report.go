@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+)
+
+// jobFailure is the first failure of the steps of a spec with reporters. The steps after it are skipped,
+// but the reporters still run, so that a failed submission gets its results too.
+type jobFailure struct {
+	mu sync.Mutex
+	// err is the failure of the stages, report that of the reporters.
+	err, report error
+}
+
+// runs reports whether a step may run: a step of the stages if nothing failed,
+// a reporter if no reporter failed.
+func (f *jobFailure) runs(reporter bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if reporter {
+		return f.report == nil
+	}
+	return f.err == nil && f.report == nil
+}
+
+// record records the failure of a step, unless another step failed before it.
+func (f *jobFailure) record(err error, reporter bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case reporter && f.report == nil:
+		f.report = err
+	case !reporter && f.err == nil:
+		f.err = err
+	}
+}
+
+// stagesError returns the failure of the stages, if any.
+func (f *jobFailure) stagesError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Err returns the failure of the job: that of the stages, that of the reporters, or both.
+func (f *jobFailure) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.err != nil && f.report != nil:
+		return StepErrors{f.err, f.report}
+	case f.err != nil:
+		return f.err
+	default:
+		return f.report
+	}
+}
+
+// deferredStep runs a step of a spec with reporters unless the job failed before it, and records
+// its failure instead of ending the pipeline, so that the reporters run. A reporter finds the failure
+// of the stages under "error". See WrappedPipeline.
+type deferredStep struct {
+	pipeline.Step
+	failure  *jobFailure
+	reporter bool
+	jobContext
+}
+
+// SetContext gives the context of the job to the step. See RunContext.
+func (d *deferredStep) SetContext(ctx context.Context) {
+	d.jobContext.SetContext(ctx)
+	SetContext(d.Step, ctx)
+}
+
+// Exec runs the step, if it may run. The reporters of a cancelled job do not.
+func (d *deferredStep) Exec(request *pipeline.Request) *pipeline.Result {
+	if !d.failure.runs(d.reporter) || d.reporter && jobCancelled(d.jobCtx()) {
+		return &pipeline.Result{Data: request.Data, KeyVal: request.KeyVal}
+	}
+	if err := d.failure.stagesError(); d.reporter && err != nil {
+		keyVal := fromMap(request.KeyVal)
+		keyVal["error"] = err
+		request = &pipeline.Request{Data: request.Data, KeyVal: keyVal}
+	}
+
+	res := d.Step.Exec(request)
+	err := resultError(res)
+	if err == nil {
+		return res
+	}
+	if timeout, ok := jobTimedOut(d.jobCtx()); ok && err == ErrCancelled {
+		err = &TimeoutError{Timeout: timeout}
+	}
+	d.failure.record(err, d.reporter)
+	skipped := &pipeline.Result{Data: request.Data, KeyVal: request.KeyVal}
+	if res != nil && res.KeyVal != nil {
+		skipped.KeyVal = res.KeyVal
+	}
+	return skipped
+}
+
+// jobTimedOut returns the timeout of the job if its context expired. See WithJobTimeout.
+func jobTimedOut(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(timeoutKey{}).(time.Duration)
+	return timeout, ok && ctx.Err() == context.DeadlineExceeded
+}
+
+// jobCancelled reports whether the job was cancelled, rather than timed out.
+func jobCancelled(ctx context.Context) bool {
+	_, timedOut := jobTimedOut(ctx)
+	return ctx.Err() != nil && !timedOut
+}
+
+// detachedStep runs a reporter under the context of the job without its deadline,
+// so that it publishes the results of a job which ran out of time too.
+type detachedStep struct {
+	pipeline.Step
+	jobContext
+}
+
+// SetContext gives the context, without its deadline, to the step.
+func (d *detachedStep) SetContext(ctx context.Context) {
+	d.jobContext.SetContext(ctx)
+	SetContext(d.Step, context.WithoutCancel(ctx))
+}
+
+// Cancel cancels the step, unless the job only ran out of time.
+func (d *detachedStep) Cancel() error {
+	if _, timedOut := jobTimedOut(d.jobCtx()); timedOut {
+		return nil
+	}
+	return d.Step.Cancel()
+}
+
+// failStep ends the pipeline with the failure of the job, once the reporters ran.
+type failStep struct {
+	failure *jobFailure
+	pipeline.StepContext
+}
+
+// Exec returns the failure, if any, with the KeyVal of the request.
+func (f *failStep) Exec(request *pipeline.Request) *pipeline.Result {
+	keyVal := fromMap(request.KeyVal)
+	delete(keyVal, "error")
+	return &pipeline.Result{Error: f.failure.Err(), Data: request.Data, KeyVal: keyVal}
+}
+
+// Cancel is a no-op
+func (f *failStep) Cancel() error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TestResult is the outcome of a single test case run against the student's code.
+// Steps which run tests store a []TestResult under "tests" so that reporters can find them.
+type TestResult struct {
+	Name     string
+	Score    float64
+	MaxScore float64
+	Passed   bool
+	Output   string
+	Hidden   bool
+}
+
+// extractStudent identifies the student by the STUDENT key, falling back to OWNER.
+func extractStudent(keyval map[string]interface{}) string {
+	if student, err := extractStr(keyval, "STUDENT"); err == nil && student != "" {
+		return student
+	}
+	owner, _ := extractStr(keyval, "OWNER")
+	return owner
+}
+
+func extractTests(keyval map[string]interface{}) []TestResult {
+	tests, _ := keyval["tests"].([]TestResult)
+	return tests
+}
+
+// extractScore returns the computed score and whether one has been computed.
+func extractScore(keyval map[string]interface{}) (float64, bool) {
+	switch score := keyval["score"].(type) {
+	case float64:
+		return score, true
+	case int:
+		return float64(score), true
+	}
+	return 0, false
+}
+
+func extractLateness(keyval map[string]interface{}) *Lateness {
+	lateness, _ := keyval["lateness"].(*Lateness)
+	return lateness
+}
+
+// extractTimeout returns the timeout of the step or job which failed, if the reporters run after one.
+// See WrappedPipeline.
+func extractTimeout(keyval map[string]interface{}) *TimeoutError {
+	err, _ := keyval["error"].(error)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		return nil
+	}
+	return timeoutErr
+}
+
+// timeoutMessage tells the student which step ran out of time, and after how long.
+func timeoutMessage(timeoutErr *TimeoutError) string {
+	if timeoutErr.Step == "" {
+		return fmt.Sprintf("Grading timed out after %v; the results are incomplete.", timeoutErr.Timeout)
+	}
+	return fmt.Sprintf("Step %q timed out after %v; the results are incomplete.", timeoutErr.Step, timeoutErr.Timeout)
+}
+
+// extractFindbugs parses the FindBugs report, returning nil if there is none or it is not XML.
+func extractFindbugs(keyval map[string]interface{}) *FindbugsReport {
+	str, err := extractStr(keyval, "findbugs")
+	if err != nil || str == "" {
+		return nil
+	}
+	report, err := ParseFindbugs(str)
+	if err != nil {
+		return nil
+	}
+	return report
+}
+
+// feedback summarizes the grading results in a short plain text comment for the student.
+func feedback(keyval map[string]interface{}) string {
+	var lines []string
+
+	if timeoutErr := extractTimeout(keyval); timeoutErr != nil {
+		lines = append(lines, timeoutMessage(timeoutErr))
+	}
+
+	if score, ok := extractScore(keyval); ok {
+		lines = append(lines, fmt.Sprintf("Score: %v", formatFloat(score)))
+	}
+
+	if tests := extractTests(keyval); tests != nil {
+		passed := 0
+		for _, test := range tests {
+			if test.Passed {
+				passed++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("Tests passed: %v of %v", passed, len(tests)))
+	}
+
+	if check, err := extractCheckstyle(keyval, "checkstyle"); err == nil {
+		count := 0
+		for _, f := range check.File {
+			count += len(f.Error)
+		}
+		lines = append(lines, fmt.Sprintf("Checkstyle problems: %v", count))
+	}
+
+	if fb := extractFindbugs(keyval); fb != nil {
+		lines = append(lines, fmt.Sprintf("FindBugs problems: %v", len(fb.BugInstance)))
+	}
+
+	if lateness := extractLateness(keyval); lateness != nil {
+		lines = append(lines, lateness.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
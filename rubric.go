@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"math"
+
+	"github.com/RobbieMcKinstry/pipeline"
+)
+
+// Rubric awards points for the results that earlier steps stored in the KeyVal. A criterion worth
+// no points is left out, and a criterion whose results are missing, e.g. because its step did not run, earns nothing.
+type Rubric struct {
+	// Compiled is awarded if "compiled" is true, as stored by a CommandStep whose Sets is "compiled".
+	Compiled float64
+	// Tests is awarded in proportion to the score of the tests under "tests", or to the tests passed
+	// if none has a MaxScore, as a CommandStep with Tests finds them.
+	Tests float64
+	// Checkstyle is awarded minus CheckstyleDeduct per finding of the report under "checkstyle", down to zero.
+	Checkstyle       float64
+	CheckstyleDeduct float64
+	// Findbugs is awarded minus FindbugsDeduct per bug of the report under "findbugs", down to zero.
+	Findbugs       float64
+	FindbugsDeduct float64
+}
+
+// RubricScore is the points earned for a criterion of a Rubric.
+type RubricScore struct {
+	Criterion string  `json:"criterion"`
+	Points    float64 `json:"points"`
+	Max       float64 `json:"max"`
+}
+
+// Grade returns the points earned for every criterion of the rubric, and their sum.
+func (r Rubric) Grade(keyval map[string]interface{}) ([]RubricScore, float64) {
+	var (
+		scores []RubricScore
+		total  float64
+	)
+	add := func(criterion string, points, worth float64) {
+		if worth <= 0 {
+			return
+		}
+		points = math.Max(0, math.Min(worth, points))
+		scores = append(scores, RubricScore{Criterion: criterion, Points: points, Max: worth})
+		total += points
+	}
+
+	compiled := 0.0
+	if ok, _ := keyval["compiled"].(bool); ok {
+		compiled = r.Compiled
+	}
+	add("compiled", compiled, r.Compiled)
+	add("tests", r.Tests*testFraction(extractTests(keyval)), r.Tests)
+	if check, err := extractCheckstyle(keyval, "checkstyle"); err == nil {
+		findings := 0
+		for _, f := range check.File {
+			findings += len(f.Error)
+		}
+		add("checkstyle", r.Checkstyle-r.CheckstyleDeduct*float64(findings), r.Checkstyle)
+	} else {
+		add("checkstyle", 0, r.Checkstyle)
+	}
+	if fb := extractFindbugs(keyval); fb != nil {
+		add("findbugs", r.Findbugs-r.FindbugsDeduct*float64(len(fb.BugInstance)), r.Findbugs)
+	} else {
+		add("findbugs", 0, r.Findbugs)
+	}
+	return scores, total
+}
+
+// testFraction is the share of the score of the tests that they earned.
+func testFraction(tests []TestResult) float64 {
+	if len(tests) == 0 {
+		return 0
+	}
+	var score, possible float64
+	passed := 0
+	for _, test := range tests {
+		score, possible = score+test.Score, possible+test.MaxScore
+		if test.Passed {
+			passed++
+		}
+	}
+	if possible > 0 {
+		return score / possible
+	}
+	return float64(passed) / float64(len(tests))
+}
+
+// RubricStep grades the results of the earlier steps with a Rubric. It stores the sum of the points
+// under "score", as a float64, and the points of each criterion under "rubric", as a []RubricScore.
+type RubricStep struct {
+	rubric Rubric
+	pipeline.StepContext
+}
+
+// NewRubricStep creates a step grading with the rubric.
+func NewRubricStep(rubric Rubric) *RubricStep {
+	return &RubricStep{rubric: rubric}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (r *RubricStep) Exec(request *pipeline.Request) *pipeline.Result {
+	scores, total := r.rubric.Grade(request.KeyVal)
+	nextMap := fromMap(request.KeyVal)
+	nextMap["score"] = total
+	nextMap["rubric"] = scores
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+// Cancel is a no-op
+func (r *RubricStep) Cancel() error {
+	r.Status("cancel step")
+	return nil
+}
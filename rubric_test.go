@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRubric(t *testing.T) {
+	rubric := Rubric{Compiled: 10, Tests: 60, Findbugs: 30, FindbugsDeduct: 20}
+	var cases = []struct {
+		keyval map[string]interface{}
+		score  float64
+	}{
+		{map[string]interface{}{}, 0},
+		{map[string]interface{}{"compiled": true, "tests": []TestResult{{Passed: true}, {Passed: true}, {}}}, 50},
+		{map[string]interface{}{"tests": []TestResult{{Score: 3, MaxScore: 4}, {Score: 0, MaxScore: 2}}}, 30},
+		{map[string]interface{}{"findbugs": `<BugCollection><BugInstance priority="1"/></BugCollection>`}, 10},
+		{map[string]interface{}{"findbugs": `<BugCollection><BugInstance/><BugInstance/></BugCollection>`}, 0},
+	}
+
+	for _, c := range cases {
+		scores, score := rubric.Grade(c.keyval)
+		if score != c.score || len(scores) != 3 {
+			t.Errorf("%v: expected %v points over 3 criteria, observed %v over %+v", c.keyval, c.score, score, scores)
+		}
+	}
+}
+
+func TestRubricReporters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rubric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.json")
+
+	spec, err := ParseJobSpec([]byte(`
+name: rubric
+stages:
+  - name: build
+    steps:
+      - {type: command, params: {name: compile, command: "true", sets: compiled}}
+      - {type: command, params: {name: test, command: "printf '1..2\\nok 1 - a\\nnot ok 2 - b\\n'; exit 1", tests: tap}}
+  - name: grade
+    steps:
+      - {type: rubric, params: {compiled: 10, tests: 90}}
+reporters:
+  - {type: gradescope, params: {path: "` + path + `"}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workpipe, err := spec.Pipeline(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := workpipe.Run()
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if score := res.KeyVal["score"]; score != 55.0 {
+		t.Errorf("expected 55 points, observed %v", score)
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results struct{ Score float64 }
+	if err := json.Unmarshal(blob, &results); err != nil || results.Score != 55 {
+		t.Errorf("expected the reporter to publish 55 points, observed %s (%v)", blob, err)
+	}
+
+	spec.Stages[0].Name = ReportStage
+	if err := spec.Validate(); err == nil {
+		t.Error("expected an error for a stage named like that of the reporters")
+	}
+}
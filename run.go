@@ -0,0 +1,46 @@
+package jobs
+
+import "github.com/RobbieMcKinstry/pipeline"
+
+// RunWithStatus runs the pipeline, passing every status line emitted by its steps to status as it arrives.
+func RunWithStatus(workpipe *pipeline.Pipeline, status func(line string)) *pipeline.Result {
+	out, err := workpipe.Out()
+	if err != nil || status == nil {
+		return workpipe.Run()
+	}
+
+	var (
+		done      = make(chan struct{})
+		forwarded = make(chan struct{})
+	)
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case line, ok := <-out:
+				if !ok {
+					return
+				}
+				status(line)
+			case <-done:
+				// Forward whatever was buffered before the pipeline finished
+				for {
+					select {
+					case line, ok := <-out:
+						if !ok {
+							return
+						}
+						status(line)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	res := workpipe.Run()
+	close(done)
+	<-forwarded
+	return res
+}
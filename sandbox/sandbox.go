@@ -0,0 +1,134 @@
+// Package sandbox runs untrusted commands, such as the programs of students, under resource limits,
+// as an unprivileged user, and in Linux namespaces: without network, seeing only their own processes,
+// with a private /tmp and /dev/shm, and with every file system read-only except the workspace of the
+// command. The command gets a minimal environment rather than the one of the worker, which holds its secrets.
+// Setting up a sandbox needs root: the worker runs as root and the command as nobody.
+//
+// A sandboxed command is started through the binary running it, which sets up the sandbox, then starts
+// the command and waits for it as the init process of the sandbox. Such binaries must call Init first
+// thing in main:
+//
+//	func main() {
+//		sandbox.Init()
+//		...
+//	}
+//
+// Sandboxes are only supported on Linux.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alligrader/jobs/cgroup"
+)
+
+// NobodyID is the UID and GID of the user nobody.
+const NobodyID = 65534
+
+// ErrNotRoot is returned by Command when the worker does not run as root, which setting up a sandbox needs.
+var ErrNotRoot = errors.New("sandboxes need the worker to run as root")
+
+// ExitInitFailure is the exit code of a command whose sandbox could not be set up.
+const ExitInitFailure = 125
+
+// The limits a command can run into, as found in Result.Exceeded.
+const (
+	ExceededCPU       = "cpu"
+	ExceededFileSize  = "file_size"
+	ExceededMemory    = "memory"
+	ExceededProcesses = "processes"
+)
+
+// Limits bounds the resources of a sandboxed command. A zero limit leaves the resource unlimited.
+type Limits struct {
+	// CPU is the CPU time of each process, after which it gets SIGXCPU, then SIGKILL a second later.
+	CPU time.Duration `json:"cpu,omitempty"`
+	// Memory is the memory of the command and its children, in bytes, past which they are killed.
+	// It is enforced by the cgroup the command runs in, see CgroupLimits.
+	Memory int64 `json:"memory,omitempty"`
+	// FileSize is the size of the largest file a process may write, in bytes.
+	FileSize int64 `json:"file_size,omitempty"`
+	// Processes is the number of processes and threads the command and its children may have at once.
+	// It is enforced by the cgroup the command runs in, see CgroupLimits.
+	Processes int `json:"processes,omitempty"`
+}
+
+// CgroupLimits returns the limits which the cgroup of the command must enforce. The sandbox does not
+// enforce them itself: a per-process limit on memory or on the processes of a user is not per command.
+func (l Limits) CgroupLimits() cgroup.Limits {
+	return cgroup.Limits{Memory: l.Memory, Processes: l.Processes}
+}
+
+// Sandbox describes how to confine a command.
+type Sandbox struct {
+	Limits
+	// UID and GID run the command. The workspace is lent to them while the command runs.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+	// Network keeps the network of the worker. Otherwise the command only has a loopback interface.
+	Network bool `json:"network,omitempty"`
+	// Workspace is the only directory the command may write to, besides a private /tmp.
+	// It defaults to the directory of the command.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// Default returns the sandbox of untrusted commands: run by nobody without network,
+// for a minute of CPU time, in 4 GiB of memory, writing files of up to 64 MiB, with up to 256 processes.
+func Default() *Sandbox {
+	return &Sandbox{
+		Limits: Limits{
+			CPU:       time.Minute,
+			Memory:    4 << 30,
+			FileSize:  64 << 20,
+			Processes: 256,
+		},
+		UID: NobodyID,
+		GID: NobodyID,
+	}
+}
+
+// Result is the outcome of a sandboxed command.
+type Result struct {
+	ExitCode int `json:"exit_code"`
+	// Signal names the signal which killed the command, if any.
+	Signal string `json:"signal,omitempty"`
+	// Exceeded names the limit the command ran into, if any, e.g. ExceededCPU.
+	Exceeded string `json:"exceeded,omitempty"`
+	// CPU is the CPU time used by the command and its children.
+	CPU time.Duration `json:"cpu"`
+	// MaxRSS is the largest resident set of the command or one of its children, in bytes.
+	MaxRSS int64 `json:"max_rss"`
+}
+
+// LimitError reports that a sandboxed command was stopped by one of its limits.
+type LimitError struct {
+	Result *Result
+}
+
+func (e *LimitError) Error() string {
+	switch e.Result.Exceeded {
+	case ExceededCPU:
+		return fmt.Sprintf("exceeded the CPU time limit after %v", e.Result.CPU)
+	case ExceededFileSize:
+		return "exceeded the file size limit"
+	case ExceededProcesses:
+		return "exceeded the limit on processes"
+	default:
+		return fmt.Sprintf("exceeded the %v limit", e.Result.Exceeded)
+	}
+}
+
+// inspectCgroup names the limit of the cgroup which the command ran into, if it failed and none of its own did.
+func (r *Result) inspectCgroup(usage *cgroup.Usage) {
+	if usage == nil || r.Exceeded != "" || r.ExitCode == 0 {
+		return
+	}
+	switch {
+	case usage.OOMKills > 0:
+		r.Exceeded = ExceededMemory
+	case usage.ForksRefused > 0:
+		r.Exceeded = ExceededProcesses
+	}
+}
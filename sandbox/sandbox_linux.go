@@ -0,0 +1,389 @@
+//go:build linux
+// +build linux
+
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alligrader/jobs/cgroup"
+)
+
+const (
+	// initArg is the argv[0] telling Init to set up the sandbox.
+	initArg = "alligrader-sandbox-init"
+	// configEnv passes the configuration of the sandbox to Init.
+	configEnv = "ALLIGRADER_SANDBOX"
+	// defaultPath is the PATH of the command, unless its environment sets one.
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// initConfig is what Init needs to know to set up the sandbox and start the command.
+type initConfig struct {
+	Sandbox   Sandbox  `json:"sandbox"`
+	Workspace string   `json:"workspace"`
+	Dir       string   `json:"dir"`
+	Path      string   `json:"path"`
+	Args      []string `json:"args"`
+}
+
+// Command rewrites the command so that it runs in the sandbox once started. The command gets the
+// variables of cmd.Env alone, along with PATH and HOME, the workspace, unless set there.
+// The workspace is lent to the user of the sandbox: the function returned hands it back to its owners,
+// and must be called once the command exited.
+func (s *Sandbox) Command(cmd *exec.Cmd) (func() error, error) {
+	if os.Geteuid() != 0 {
+		return nil, ErrNotRoot
+	}
+	path := cmd.Path
+	if !filepath.IsAbs(path) {
+		var err error
+		if path, err = exec.LookPath(path); err != nil {
+			return nil, err
+		}
+	}
+
+	config := initConfig{
+		Sandbox:   *s,
+		Workspace: s.Workspace,
+		Dir:       cmd.Dir,
+		Path:      path,
+		Args:      cmd.Args,
+	}
+	if config.Workspace == "" {
+		config.Workspace = cmd.Dir
+	}
+	blob, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := func() error { return nil }
+	if config.Workspace != "" {
+		if restore, err = lend(config.Workspace, s.UID, s.GID); err != nil {
+			return nil, err
+		}
+	}
+
+	home := config.Workspace
+	if home == "" {
+		home = "/tmp"
+	}
+	// The variables of cmd.Env come last, so that they win
+	env := append([]string{"PATH=" + defaultPath, "HOME=" + home}, cmd.Env...)
+	cmd.Env = append(env, configEnv+"="+string(blob))
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{initArg}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID
+	if !s.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return restore, nil
+}
+
+// Init sets up the sandbox and runs the command when the process was started by Command,
+// and never returns then. Otherwise it returns right away.
+func Init() {
+	if len(os.Args) == 0 || os.Args[0] != initArg {
+		return
+	}
+
+	var config initConfig
+	if err := json.Unmarshal([]byte(os.Getenv(configEnv)), &config); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: bad configuration: %v\n", err)
+		os.Exit(ExitInitFailure)
+	}
+	os.Unsetenv(configEnv)
+
+	if err := setup(&config); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(ExitInitFailure)
+	}
+	os.Exit(supervise(&config))
+}
+
+// setup mounts the file systems of the sandbox, applies its limits and drops privileges.
+func setup(config *initConfig) error {
+	// Open the workspace before the private /tmp hides it, should it live there
+	var workspace *os.File
+	if config.Workspace != "" {
+		var err error
+		if workspace, err = os.Open(config.Workspace); err != nil {
+			return err
+		}
+		defer workspace.Close()
+	}
+
+	// Keep the mounts below from propagating to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making / private: %v", err)
+	}
+	writable := []string{"/tmp"}
+	if _, err := os.Stat("/dev/shm"); err == nil {
+		writable = append(writable, "/dev/shm")
+	}
+	for _, dir := range writable {
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting %v: %v", dir, err)
+		}
+	}
+	if workspace != nil {
+		if err := os.MkdirAll(config.Workspace, 0755); err != nil {
+			return err
+		}
+		src := fmt.Sprintf("/proc/self/fd/%d", workspace.Fd())
+		if err := syscall.Mount(src, config.Workspace, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("mounting the workspace: %v", err)
+		}
+		writable = append(writable, config.Workspace)
+	}
+	// A fresh /proc, showing the processes of the sandbox alone, replaces the mounts of /proc
+	if err := remountReadOnly(append(writable, "/proc")); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+	if config.Dir != "" {
+		// Enter the directory again, now that it may be a different mount
+		if err := os.Chdir(config.Dir); err != nil {
+			return err
+		}
+	}
+
+	if err := setLimits(config.Sandbox.Limits); err != nil {
+		return err
+	}
+
+	if err := syscall.Setgroups([]int{config.Sandbox.GID}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(config.Sandbox.GID); err != nil {
+		return err
+	}
+	return syscall.Setuid(config.Sandbox.UID)
+}
+
+// mountFlags maps the options of a mount in /proc/self/mountinfo to the flags keeping them on a remount.
+var mountFlags = map[string]uintptr{
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// remountReadOnly makes every mount read-only and nosuid, except those at or below the writable directories.
+func remountReadOnly(writable []string) error {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var points []string
+	flags := map[string]uintptr{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		point := unescapeMount(fields[4])
+		if below(point, writable) {
+			continue
+		}
+		if _, ok := flags[point]; !ok {
+			points = append(points, point)
+		}
+		flags[point] = 0
+		for _, opt := range strings.Split(fields[5], ",") {
+			flags[point] |= mountFlags[opt]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, point := range points {
+		err := syscall.Mount("", point, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|flags[point], "")
+		// A mount hidden below another one cannot be reached anyway
+		if err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("making %v read-only: %v", point, err)
+		}
+	}
+	return nil
+}
+
+// below tells whether the path is one of the directories, or inside one of them.
+func below(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMount decodes the octal escapes of a path in /proc/self/mountinfo, such as \040 for a space.
+func unescapeMount(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func setLimits(limits Limits) error {
+	set := func(resource int, cur, max uint64) error {
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: cur, Max: max}); err != nil {
+			return fmt.Errorf("setting limit %v: %v", resource, err)
+		}
+		return nil
+	}
+
+	if limits.CPU > 0 {
+		secs := uint64((limits.CPU + time.Second - 1) / time.Second)
+		// SIGXCPU at the limit, SIGKILL for those which ignore it
+		if err := set(syscall.RLIMIT_CPU, secs, secs+1); err != nil {
+			return err
+		}
+	}
+	if limits.FileSize > 0 {
+		if err := set(syscall.RLIMIT_FSIZE, uint64(limits.FileSize), uint64(limits.FileSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervise starts the command and waits for it as the init process of the sandbox, reaping the orphans it
+// leaves behind. It forwards the signals stopping a process to the command, and returns its exit code,
+// or 128 plus the signal which killed it, as a shell does. The kernel ignores these signals for an init
+// process without a handler, which is why the command does not run as the init process itself.
+func supervise(config *initConfig) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	proc, err := os.StartProcess(config.Path, config.Args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			proc.Signal(sig)
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "sandbox: waiting for the command: %v\n", err)
+			return ExitInitFailure
+		case pid != proc.Pid:
+			continue
+		case status.Signaled():
+			return 128 + int(status.Signal())
+		default:
+			return status.ExitStatus()
+		}
+	}
+}
+
+// owner is the owner of a file.
+type owner struct {
+	uid, gid int
+}
+
+// lend hands the tree over to the user, and returns the function handing it back: the files which
+// were there get their owners back, and those written meanwhile go to the owner of root.
+func lend(root string, uid, gid int) (func() error, error) {
+	owners := map[string]owner{}
+	restore := func() error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			o, ok := owners[path]
+			if !ok {
+				o = owners[root]
+			}
+			return os.Lchown(path, o.uid, o.gid)
+		})
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			owners[path] = owner{uid: int(stat.Uid), gid: int(stat.Gid)}
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// Inspect describes how the command, run in the sandbox, ended. A command which ran into a limit
+// itself reports the signal which killed it by an exit code of 128 plus the signal. The usage of the
+// cgroup of the command, if any, tells whether it ran out of memory or processes.
+func (s *Sandbox) Inspect(state *os.ProcessState, usage *cgroup.Usage) *Result {
+	res := &Result{ExitCode: state.ExitCode(), CPU: state.UserTime() + state.SystemTime()}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		res.MaxRSS = rusage.Maxrss * 1024
+	}
+
+	var sig syscall.Signal
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		sig = status.Signal()
+	} else if res.ExitCode > 128 && res.ExitCode < 128+65 {
+		sig = syscall.Signal(res.ExitCode - 128)
+	}
+	if sig != 0 {
+		res.Signal = sig.String()
+		switch {
+		case sig == syscall.SIGXCPU:
+			res.Exceeded = ExceededCPU
+		case sig == syscall.SIGKILL && s.CPU > 0 && res.CPU >= s.CPU:
+			res.Exceeded = ExceededCPU
+		case sig == syscall.SIGXFSZ:
+			res.Exceeded = ExceededFileSize
+		}
+	}
+	res.inspectCgroup(usage)
+	return res
+}
@@ -0,0 +1,57 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLend(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("lending a directory needs root")
+	}
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kept := filepath.Join(dir, "kept")
+	if err := ioutil.WriteFile(kept, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(kept, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := lend(dir, NobodyID, NobodyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := func() map[string]uint32 {
+		found := map[string]uint32{}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				found[filepath.Base(path)] = info.Sys().(*syscall.Stat_t).Uid
+			}
+			return err
+		})
+		return found
+	}
+	if found := owners(); found["kept"] != NobodyID || found[filepath.Base(dir)] != NobodyID {
+		t.Errorf("expected the workspace to be lent to nobody, observed the owners %v", found)
+	}
+
+	written := filepath.Join(dir, "written")
+	if err := ioutil.WriteFile(written, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chown(written, NobodyID, NobodyID)
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if found := owners(); found["kept"] != 1000 || found["written"] != 0 || found[filepath.Base(dir)] != 0 {
+		t.Errorf("expected the workspace to be handed back, observed the owners %v", found)
+	}
+}
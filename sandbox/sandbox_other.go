@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/alligrader/jobs/cgroup"
+)
+
+// Command fails: sandboxes are only supported on Linux.
+func (s *Sandbox) Command(cmd *exec.Cmd) (func() error, error) {
+	return nil, errors.New("sandboxes are only supported on Linux")
+}
+
+// Init returns right away.
+func Init() {}
+
+// Inspect describes how the command ended.
+func (s *Sandbox) Inspect(state *os.ProcessState, usage *cgroup.Usage) *Result {
+	res := &Result{ExitCode: state.ExitCode(), CPU: state.UserTime() + state.SystemTime()}
+	res.inspectCgroup(usage)
+	return res
+}
@@ -0,0 +1,134 @@
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alligrader/jobs/cgroup"
+)
+
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+// run runs the shell script in the sandbox with the variables of env, skipping the test where sandboxes
+// cannot be set up.
+func run(t *testing.T, box *Sandbox, dir, script string, env ...string) (string, *Result) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandboxes are only supported on Linux")
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Dir, cmd.Stdout, cmd.Stderr, cmd.Env = dir, &out, &out, env
+	restore, err := box.Command(cmd)
+	if err == ErrNotRoot {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := restore(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Skipf("cannot create namespaces here: %v", err)
+		}
+		if cmd.ProcessState.ExitCode() == ExitInitFailure {
+			t.Skipf("cannot set up a sandbox here: %v", out.String())
+		}
+	}
+	return out.String(), box.Inspect(cmd.ProcessState, nil)
+}
+
+func TestIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("ALLIGRADER_TEST_SECRET", "leaked")
+	defer os.Unsetenv("ALLIGRADER_TEST_SECRET")
+
+	box := Default()
+	out, res := run(t, box, dir, `
+		touch /etc/sandboxed 2>/dev/null && echo wrote /etc
+		touch /tmp/sandboxed && echo wrote /tmp
+		touch sandboxed && echo wrote workspace
+		awk -v ws="$PWD" '{ ro[$5] = $6 ~ /^ro/ } END { for (m in ro) if (!ro[m] && m != "/tmp" && m != "/dev/shm" && m != "/proc" && m != ws) print "writable", m }' /proc/self/mountinfo
+		grep -c : /proc/net/dev
+		id -u
+		tr '\0' '\n' < /proc/1/cmdline
+		echo "${ALLIGRADER_TEST_SECRET:-no secret} $GRADE"
+	`, "GRADE=graded")
+	if res.ExitCode != 0 {
+		t.Fatalf("unexpected result %+v: %v", res, out)
+	}
+
+	if expected := "wrote /tmp\nwrote workspace\n1\n65534\nalligrader-sandbox-init\nno secret graded\n"; out != expected {
+		t.Errorf("expected read-only mounts, a private /tmp, a writable workspace, only a loopback interface, an unprivileged user, "+
+			"processes of its own and the variables of the command alone, observed\n%v", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sandboxed")); err != nil {
+		t.Error("expected the file written to the workspace to be kept")
+	}
+	if _, err := os.Stat("/tmp/sandboxed"); err == nil {
+		os.Remove("/tmp/sandboxed")
+		t.Error("expected /tmp to be private")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var cases = []struct {
+		limits   Limits
+		script   string
+		exceeded string
+	}{
+		{Limits{CPU: time.Second}, "while :; do :; done", ExceededCPU},
+		{Limits{FileSize: 1 << 20}, "head -c 2000000 /dev/zero > /tmp/big", ExceededFileSize},
+		{Limits{FileSize: 1 << 20}, "head -c 1000 /dev/zero > /tmp/small", ""},
+	}
+
+	for _, c := range cases {
+		box := &Sandbox{Limits: c.limits, UID: NobodyID, GID: NobodyID}
+		start := time.Now()
+		out, res := run(t, box, "", c.script)
+		if res.Exceeded != c.exceeded {
+			t.Errorf("%v: expected to exceed %q, observed %+v: %v", c.script, c.exceeded, res, out)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%v: ran for %v", c.script, elapsed)
+		}
+	}
+}
+
+func TestInspectCgroup(t *testing.T) {
+	var cases = []struct {
+		res      Result
+		usage    *cgroup.Usage
+		exceeded string
+	}{
+		{Result{ExitCode: 137}, &cgroup.Usage{OOMKills: 1}, ExceededMemory},
+		{Result{ExitCode: 1}, &cgroup.Usage{ForksRefused: 3}, ExceededProcesses},
+		{Result{ExitCode: 0}, &cgroup.Usage{ForksRefused: 3}, ""},
+		{Result{ExitCode: 152, Exceeded: ExceededCPU}, &cgroup.Usage{OOMKills: 1}, ExceededCPU},
+		{Result{ExitCode: 1}, nil, ""},
+	}
+	for _, c := range cases {
+		res := c.res
+		res.inspectCgroup(c.usage)
+		if res.Exceeded != c.exceeded {
+			t.Errorf("%+v with %+v: expected to exceed %q, observed %q", c.res, c.usage, c.exceeded, res.Exceeded)
+		}
+	}
+}
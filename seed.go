@@ -0,0 +1,32 @@
+package jobs
+
+import "github.com/RobbieMcKinstry/pipeline"
+
+// SeedStep stores fixed values in the KeyVal, such as the OWNER, REPO, and SHA of the submission to grade.
+type SeedStep struct {
+	keyVal map[string]interface{}
+	pipeline.StepContext
+}
+
+// NewSeedStep creates a step which adds the given values to the KeyVal.
+func NewSeedStep(keyVal map[string]interface{}) *SeedStep {
+	return &SeedStep{keyVal: keyVal}
+}
+
+// Exec runs the step. Should be run as part of the pipeline, not directly.
+func (s *SeedStep) Exec(request *pipeline.Request) *pipeline.Result {
+	nextMap := fromMap(request.KeyVal)
+	for key, val := range s.keyVal {
+		nextMap[key] = val
+	}
+	return &pipeline.Result{
+		Error:  nil,
+		KeyVal: nextMap,
+	}
+}
+
+// Cancel is a no-op
+func (s *SeedStep) Cancel() error {
+	s.Status("cancel step")
+	return nil
+}
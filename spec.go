@@ -0,0 +1,265 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultOutBufferLen is the size of the status buffer of pipelines built from a JobSpec.
+const DefaultOutBufferLen = 10000
+
+// JobSpec declares a grading pipeline, so that an assignment can be defined in a YAML or JSON file instead of Go.
+//
+//	name: hw1
+//	timeout: 10m
+//	stages:
+//	  - name: fetch
+//	    steps:
+//	      - type: env
+//	        params: {vars: [OWNER, REPO, REF]}
+//	  - name: lint
+//	    steps:
+//	      - type: checkstyle
+//	        parallel: true
+//	        params: {config: /checks/google.xml}
+//	      - type: findbugs
+//	        parallel: true
+//	        timeout: 2m
+//	      - type: rubric
+//	        params: {checkstyle: 10, checkstyle_deduct: 1, findbugs: 10, findbugs_deduct: 2}
+//	reporters:
+//	  - type: gradescope
+//
+// Timeouts are durations such as "90s", and limit the whole job or a single step.
+// A step with retries, e.g. one posting grades, runs again when it fails with a transient error.
+// Consecutive steps marked parallel run concurrently, as a ParallelStep.
+// The reporters, which publish the results, run in order in a last stage named ReportStage.
+type JobSpec struct {
+	Name      string        `yaml:"name" json:"name"`
+	Version   string        `yaml:"version,omitempty" json:"version,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Stages    []StageSpec   `yaml:"stages" json:"stages"`
+	Reporters []StepSpec    `yaml:"reporters,omitempty" json:"reporters,omitempty"`
+}
+
+// ReportStage is the name of the stage running the reporters of a JobSpec.
+const ReportStage = "report"
+
+// stages returns the stages of the spec followed by that of its reporters, if any.
+func (spec *JobSpec) stages() []StageSpec {
+	if len(spec.Reporters) == 0 {
+		return spec.Stages
+	}
+	stages := append([]StageSpec{}, spec.Stages...)
+	return append(stages, StageSpec{Name: ReportStage, Steps: spec.Reporters})
+}
+
+// StageSpec declares a pipeline.Stage.
+type StageSpec struct {
+	Name              string     `yaml:"name" json:"name"`
+	Concurrent        bool       `yaml:"concurrent,omitempty" json:"concurrent,omitempty"`
+	DisableStrictMode bool       `yaml:"disable_strict_mode,omitempty" json:"disable_strict_mode,omitempty"`
+	Steps             []StepSpec `yaml:"steps" json:"steps"`
+}
+
+// StepSpec declares a step by the name of its type and the parameters passed to its constructor.
+type StepSpec struct {
+	Type    string                 `yaml:"type" json:"type"`
+	Params  map[string]interface{} `yaml:"params,omitempty" json:"params,omitempty"`
+	Timeout time.Duration          `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Parallel runs the step along with the parallel steps next to it, which must not depend on one another.
+	// The steps of a Concurrent stage may not set it: use one or the other.
+	Parallel bool `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	// Retries is how many times the step runs again after failing with a transient error. See IsTransient.
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// Name is the "name" parameter of the step, or its type if it has none.
+func (s StepSpec) Name() string {
+	if name, _ := s.Params["name"].(string); name != "" {
+		return name
+	}
+	return s.Type
+}
+
+// LoadJobSpec reads a job spec from a YAML or JSON file and validates it.
+func LoadJobSpec(path string) (*JobSpec, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ParseJobSpec(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return spec, nil
+}
+
+// ParseJobSpec decodes a job spec written in YAML or JSON, which is a subset of YAML, and validates it.
+func ParseJobSpec(blob []byte) (*JobSpec, error) {
+	var spec JobSpec
+	if err := yaml.UnmarshalStrict(blob, &spec); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Validate checks the spec against the DefaultRegistry. See Registry.ValidateSpec.
+func (spec *JobSpec) Validate() error {
+	return DefaultRegistry.ValidateSpec(spec)
+}
+
+// StepWrapper decorates a step built from a spec, e.g. to record how long it runs.
+type StepWrapper func(stage string, spec StepSpec, step pipeline.Step) pipeline.Step
+
+// Pipeline builds the pipeline described by the spec from the DefaultRegistry. See Registry.Pipeline.
+func (spec *JobSpec) Pipeline(logger *logrus.Logger, setup ...pipeline.Step) (*pipeline.Pipeline, error) {
+	return DefaultRegistry.Pipeline(spec, logger, setup...)
+}
+
+// WrappedPipeline builds the pipeline described by the spec from the DefaultRegistry. See Registry.WrappedPipeline.
+func (spec *JobSpec) WrappedPipeline(logger *logrus.Logger, wrap StepWrapper, setup ...pipeline.Step) (*pipeline.Pipeline, error) {
+	return DefaultRegistry.WrappedPipeline(spec, logger, wrap, setup...)
+}
+
+// ValidateSpec checks that the spec describes a pipeline which can be built: every stage has steps,
+// and every step has a registered type and parameters matching its schema.
+func (r *Registry) ValidateSpec(spec *JobSpec) error {
+	if spec.Name == "" {
+		return errors.New("job has no name")
+	}
+	if len(spec.Stages) == 0 {
+		return errors.New("job has no stages")
+	}
+	if spec.Timeout < 0 {
+		return errors.New("job has a negative timeout")
+	}
+
+	for i, stage := range spec.stages() {
+		if stage.Name == "" {
+			return fmt.Errorf("stage %v has no name", i+1)
+		}
+		if stage.Name == ReportStage && i < len(spec.Stages) && len(spec.Reporters) > 0 {
+			return fmt.Errorf("stage %q is reserved for the reporters", ReportStage)
+		}
+		if len(stage.Steps) == 0 {
+			return fmt.Errorf("stage %q has no steps", stage.Name)
+		}
+		for j, step := range stage.Steps {
+			if err := r.Validate(step); err != nil {
+				return fmt.Errorf("stage %q, step %v: %v", stage.Name, j+1, err)
+			}
+			if step.Timeout < 0 {
+				return fmt.Errorf("stage %q, step %v: negative timeout", stage.Name, j+1)
+			}
+			if step.Retries < 0 {
+				return fmt.Errorf("stage %q, step %v: negative retries", stage.Name, j+1)
+			}
+			if step.Parallel && stage.Concurrent {
+				return fmt.Errorf("stage %q, step %v: parallel in a concurrent stage", stage.Name, j+1)
+			}
+		}
+	}
+	return nil
+}
+
+// Pipeline builds the pipeline described by the spec. If setup steps are given, the pipeline starts
+// with a "setup" stage running them in order, so that a single spec can grade many submissions,
+// e.g. with a SeedStep storing the OWNER and REPO, followed by a LocalSourceStep.
+func (r *Registry) Pipeline(spec *JobSpec, logger *logrus.Logger, setup ...pipeline.Step) (*pipeline.Pipeline, error) {
+	return r.WrappedPipeline(spec, logger, nil, setup...)
+}
+
+// WrappedPipeline builds the pipeline described by the spec like Pipeline, passing every step
+// built from the spec through wrap if it is not nil. The setup steps are not wrapped.
+//
+// Every step built from the spec reports its start and end in its status and in the log, stores its
+// duration under "timings", is retried on transient errors if the spec says so, and fails if it panics.
+//
+// The reporters run even when a step before them failed or timed out, which skips the other steps,
+// so that a failed submission gets its results too: they find the error under "error", and the pipeline
+// fails with it once they ran. They run without the deadline of the job, but not once it is cancelled.
+func (r *Registry) WrappedPipeline(spec *JobSpec, logger *logrus.Logger, wrap StepWrapper, setup ...pipeline.Step) (*pipeline.Pipeline, error) {
+	if err := r.ValidateSpec(spec); err != nil {
+		return nil, err
+	}
+
+	workpipe := pipeline.New(spec.Name, DefaultOutBufferLen)
+	if len(setup) > 0 {
+		stage := pipeline.NewStage("setup", false, false)
+		for _, step := range setup {
+			stage.AddStep(step)
+		}
+		workpipe.AddStage(stage)
+	}
+	var failure *jobFailure
+	if len(spec.Reporters) > 0 {
+		failure = &jobFailure{}
+	}
+	// defer lets the reporters run after a failure, if there are any
+	deferred := func(step pipeline.Step, reporter bool) pipeline.Step {
+		if failure == nil {
+			return step
+		}
+		return &deferredStep{Step: step, failure: failure, reporter: reporter}
+	}
+	for i, stageSpec := range spec.stages() {
+		reporters := i == len(spec.Stages)
+		stage := pipeline.NewStage(stageSpec.Name, stageSpec.Concurrent, stageSpec.DisableStrictMode)
+		var group *ParallelStep
+		for j, stepSpec := range stageSpec.Steps {
+			step, err := r.Build(stepSpec, logger)
+			if err != nil {
+				return nil, fmt.Errorf("stage %q, step %v: %v", stageSpec.Name, j+1, err)
+			}
+			step = Use(stepSpec.Name(), step, stepMiddleware(stepSpec, logger)...)
+			if stepSpec.Timeout > 0 {
+				step = NewTimeoutStep(step, stepSpec.Name(), stepSpec.Timeout)
+			}
+			if reporters {
+				step = &detachedStep{Step: step}
+			}
+			if wrap != nil {
+				step = wrap(stageSpec.Name, stepSpec, step)
+			}
+			if !stepSpec.Parallel {
+				group = nil
+				stage.AddStep(deferred(step, reporters))
+				continue
+			}
+			if group == nil {
+				group = NewParallelStep()
+				stage.AddStep(deferred(group, reporters))
+			}
+			group.AddStep(stepSpec.Name(), step)
+		}
+		if reporters {
+			stage.AddStep(&failStep{failure: failure})
+		}
+		workpipe.AddStage(stage)
+	}
+	return workpipe, nil
+}
+
+// stepMiddleware returns the middleware of a step built from the spec, which runs inside its timeout.
+func stepMiddleware(spec StepSpec, logger *logrus.Logger) []Middleware {
+	var middleware []Middleware
+	if logger != nil {
+		middleware = append(middleware, Logging(logger))
+	}
+	middleware = append(middleware, ReportStatus, Timing)
+	if spec.Retries > 0 {
+		middleware = append(middleware, Retry(spec.Retries+1, RetryDelay))
+	}
+	// A panic is not transient: it is not retried
+	return append(middleware, Recover)
+}
@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testSpec = `
+name: test pipeline 1
+stages:
+  - name: setup
+    steps:
+      - type: env
+        params:
+          vars: [SPEC_TEST_VAR]
+  - name: run
+    steps:
+      - type: command
+        params: {name: echo, command: echo hello world}
+`
+
+func TestJobSpecPipeline(t *testing.T) {
+	os.Setenv("SPEC_TEST_VAR", "xyz123")
+	defer os.Unsetenv("SPEC_TEST_VAR")
+
+	spec, err := ParseJobSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Stages) != 2 || spec.Stages[1].Steps[0].Type != "command" {
+		t.Fatalf("unexpected spec %+v", spec)
+	}
+
+	workpipe, err := spec.Pipeline(logrus.New(), NewSeedStep(map[string]interface{}{"REPO": "hw1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := workpipe.Run()
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if stdout := res.KeyVal["stdout"]; stdout != "hello world\n" {
+		t.Errorf("expected the command output, observed %q", stdout)
+	}
+}
+
+func TestJobSpecJSON(t *testing.T) {
+	const blob = `{"name": "json", "stages": [{"name": "env", "steps": [{"type": "env", "params": {"vars": ["A"]}}]}]}`
+	if _, err := ParseJobSpec([]byte(blob)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobSpecValidate(t *testing.T) {
+	var cases = []struct{ blob, expected string }{
+		{"name: x\nstages: [{name: a, steps: [{type: nope}]}]", "unknown step type"},
+		{"name: x\nstages: [{name: a, steps: [{type: command, params: {command: ls, shell: zsh}}]}]", "unknown parameter"},
+		{"name: x\nstages: [{name: a, steps: [{type: command}]}]", "missing parameter"},
+		{"name: x\nstages: [{name: a, steps: [{type: command, params: {command: ls, args: [ls]}}]}]", "exclude each other"},
+		{"name: x\nstages: [{name: a, steps: [{type: command, retries: -1, params: {command: ls}}]}]", "negative retries"},
+		{"name: x\nstages: [{name: a, concurrent: true, steps: [{type: command, parallel: true, params: {command: ls}}]}]", "parallel in a concurrent stage"},
+		{"name: x\nstages: [{name: a}]", "has no steps"},
+		{"stages: [{name: a, steps: [{type: env, params: {vars: [A]}}]}]", "job has no name"},
+		{"name: x\nstage: []", "field stage not found"},
+		{"name: x\nstages: [{name: a, steps: [{type: checkstyle, params: {text: maybe}}]}]", "expected a bool"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseJobSpec([]byte(c.blob))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected an error containing %q, observed %v", c.expected, err)
+		}
+	}
+}
+
+func TestJobSpecReportersAfterFailure(t *testing.T) {
+	var cases = []struct {
+		spec     string
+		timeout  time.Duration
+		expected string
+	}{
+		{"name: hw1\nstages: [{name: test, steps: [{type: command, params: {name: fail, command: 'exit 3'}}, {type: command, params: {name: skipped, command: 'echo skipped'}}]}]", 0, "exit status 3"},
+		{"name: hw1\ntimeout: 200ms\nstages: [{name: test, steps: [{type: command, params: {name: loop, command: 'sleep 30'}}, {type: command, params: {name: skipped, command: 'echo skipped'}}]}]", 200 * time.Millisecond, "timed out"},
+	}
+
+	for _, c := range cases {
+		spec, err := ParseJobSpec([]byte(c.spec + "\nreporters: [{type: command, params: {name: report, command: 'echo \"{{.error}}\"'}}]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		workpipe, err := spec.Pipeline(logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := WithJobTimeout(context.Background(), c.timeout)
+		defer cancel()
+
+		res := RunContext(ctx, workpipe, nil)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), c.expected) {
+			t.Errorf("expected the job to fail with %q, observed %v", c.expected, res.Error)
+		}
+		if stdout, _ := res.KeyVal["stdout"].(string); !strings.Contains(stdout, c.expected) {
+			t.Errorf("expected the reporter to get the error, observed %q", stdout)
+		}
+		if _, ok := res.KeyVal["error"]; ok {
+			t.Error("expected the error to be dropped from the KeyVal once reported")
+		}
+	}
+
+	// The reporters of a cancelled job do not run
+	spec, err := ParseJobSpec([]byte("name: hw1\nstages: [{name: test, steps: [{type: command, params: {command: 'sleep 30'}}]}]\nreporters: [{type: command, params: {command: 'echo reported'}}]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workpipe, err := spec.Pipeline(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res := RunContext(ctx, workpipe, nil)
+	if res.Error == nil || res.KeyVal["stdout"] == "reported\n" {
+		t.Errorf("expected the job to fail without reporting, observed %v and %v", res.Error, res.KeyVal)
+	}
+}
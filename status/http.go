@@ -0,0 +1,291 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/queue"
+	"github.com/sirupsen/logrus"
+)
+
+// The states of a job, as served.
+const (
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// pollInterval is how often the stream of a queued job checks whether it started.
+const pollInterval = time.Second
+
+// Jobs looks up the jobs of a queue, such as a queue.BoltQueue.
+type Jobs interface {
+	Get(id string) (*queue.Job, error)
+	List(states ...queue.State) ([]*queue.Job, error)
+}
+
+// JobStatus is the state of a job. While the job runs, Steps holds the status of each of its steps;
+// afterwards it holds those of its last run, whose outcome is Outcome.
+type JobStatus struct {
+	ID       string               `json:"id"`
+	State    string               `json:"state"`
+	Outcome  string               `json:"outcome,omitempty"`
+	Spec     string               `json:"spec"`
+	Owner    string               `json:"owner,omitempty"`
+	Repo     string               `json:"repo,omitempty"`
+	SHA      string               `json:"sha,omitempty"`
+	Attempts int                  `json:"attempts"`
+	Error    string               `json:"error,omitempty"`
+	Received time.Time            `json:"received"`
+	Updated  time.Time            `json:"updated"`
+	Steps    []history.StepRecord `json:"steps,omitempty"`
+	Score    *float64             `json:"score,omitempty"`
+	Run      string               `json:"run,omitempty"`
+}
+
+// Handler serves the state of jobs as JSON, and their status lines as Server-Sent Events:
+//
+//	GET /jobs?owner=cs101&repo=hw1-bob&sha=...   the jobs of a submission, or every unfinished job without a filter
+//	GET /jobs/{id}                               the state of a job and of its steps
+//	GET /jobs/{id}/events                        a stream of "status" events, ending with an "end" event
+type Handler struct {
+	hub     *Hub
+	jobs    Jobs
+	history history.Store
+	log     *logrus.Logger
+}
+
+// NewHandler creates a handler serving the jobs of the queue. The history, which may be nil,
+// holds the steps and logs of finished jobs. Mount it on both /jobs and /jobs/.
+func NewHandler(hub *Hub, jobs Jobs, store history.Store, logger *logrus.Logger) *Handler {
+	return &Handler{hub: hub, jobs: jobs, history: store, log: logger}
+}
+
+// ServeHTTP serves a request for jobs.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if path == "" {
+		h.list(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "events") {
+		http.NotFound(w, r)
+		return
+	}
+	job, err := h.jobs.Get(parts[0])
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	if job == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		h.stream(w, r, job)
+		return
+	}
+	status, err := h.status(job)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	var (
+		params = r.URL.Query()
+		filter = map[string]string{"OWNER": params.Get("owner"), "REPO": params.Get("repo"), "SHA": params.Get("sha")}
+		states []queue.State
+	)
+	if filter["OWNER"] == "" && filter["REPO"] == "" && filter["SHA"] == "" {
+		states = []queue.State{queue.Pending, queue.Running}
+	}
+
+	list, err := h.jobs.List(states...)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	statuses := []*JobStatus{}
+outer:
+	for _, job := range list {
+		for key, val := range filter {
+			if val != "" && job.KeyVal[key] != val {
+				continue outer
+			}
+		}
+		statuses = append(statuses, newJobStatus(job))
+	}
+	writeJSON(w, statuses)
+}
+
+// status returns the state of the job, with the steps of the running or last run.
+func (h *Handler) status(job *queue.Job) (*JobStatus, error) {
+	status := newJobStatus(job)
+	if run, ok := h.hub.Running(job.ID); ok {
+		status.State, status.Steps, status.Run = StateRunning, run.Steps, run.ID
+		return status, nil
+	}
+
+	run, err := h.lastRun(job.ID)
+	if err != nil || run == nil {
+		return status, err
+	}
+	status.Outcome, status.Steps, status.Score, status.Run = run.Status, run.Steps, run.Score, run.ID
+	return status, nil
+}
+
+func (h *Handler) lastRun(id string) (*history.Run, error) {
+	if h.history == nil {
+		return nil, nil
+	}
+	runs, err := h.history.List(history.Query{Job: id, Limit: 1})
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return h.history.Get(runs[0].ID)
+}
+
+// stream sends the status lines of the job as Server-Sent Events. A queued job is waited for.
+// A finished job gets the log of its last run.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request, job *queue.Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		backlog, events, cancel, ok := h.hub.Subscribe(job.ID)
+		if ok {
+			defer cancel()
+			for _, line := range backlog {
+				writeEvent(w, Event{Type: EventStatus, Data: line})
+			}
+			flusher.Flush()
+
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case ev, ok := <-events:
+					if !ok {
+						return
+					}
+					writeEvent(w, ev)
+					flusher.Flush()
+				}
+			}
+		}
+
+		current, err := h.jobs.Get(job.ID)
+		if err != nil {
+			h.log.Errorf("Could not look up job %v: %v", job.ID, err)
+			return
+		}
+		if current == nil {
+			// Removed from the queue meanwhile
+			writeEvent(w, Event{Type: EventEnd})
+			flusher.Flush()
+			return
+		}
+		if current.State == queue.Done || current.State == queue.Failed {
+			h.replay(w, job.ID)
+			flusher.Flush()
+			return
+		}
+
+		// Queued, or between attempts: wait for the next run
+		fmt.Fprintf(w, ": %v\n\n", StateQueued)
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// replay sends the log and outcome of the last run of a finished job.
+func (h *Handler) replay(w http.ResponseWriter, id string) {
+	run, err := h.lastRun(id)
+	if err != nil {
+		h.log.Errorf("Could not read the history of job %v: %v", id, err)
+	}
+	if run == nil {
+		writeEvent(w, Event{Type: EventEnd})
+		return
+	}
+	for _, line := range run.Log {
+		writeEvent(w, Event{Type: EventStatus, Data: line})
+	}
+	writeEvent(w, Event{Type: EventEnd, Data: run.Status})
+}
+
+func newJobStatus(job *queue.Job) *JobStatus {
+	status := &JobStatus{
+		ID:       job.ID,
+		Spec:     job.Spec,
+		Attempts: job.Attempts,
+		Error:    job.Error,
+		Received: job.Received,
+		Updated:  job.Updated,
+	}
+	status.Owner, _ = job.KeyVal["OWNER"].(string)
+	status.Repo, _ = job.KeyVal["REPO"].(string)
+	status.SHA, _ = job.KeyVal["SHA"].(string)
+
+	switch job.State {
+	case queue.Pending:
+		status.State = StateQueued
+	case queue.Running:
+		status.State = StateRunning
+	case queue.Done:
+		status.State = StateDone
+	case queue.Failed:
+		status.State = StateFailed
+	}
+	return status
+}
+
+// writeEvent writes a Server-Sent Event, splitting multi-line data across data fields.
+func writeEvent(w http.ResponseWriter, ev Event) {
+	fmt.Fprintf(w, "event: %v\n", ev.Type)
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(w, "data: %v\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.log.Errorf("Could not read the jobs: %v", err)
+	http.Error(w, "could not read the jobs", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
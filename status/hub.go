@@ -0,0 +1,137 @@
+// Package status answers "is my submission graded yet?": it serves the state of every job,
+// and streams the status lines of a running job as its steps emit them.
+package status
+
+import (
+	"sync"
+
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/queue"
+)
+
+// The types of the events of a job.
+const (
+	// EventStatus carries a status line emitted by a step.
+	EventStatus = "status"
+	// EventEnd carries the outcome of the run, e.g. history.StatusPassed, or Dropped. It is the last event of a run.
+	EventEnd = "end"
+)
+
+// Dropped is the data of the end event sent to a subscriber which fell too far behind, before its stream ends.
+const Dropped = "dropped"
+
+const (
+	// subscriberBuffer is the number of events a subscriber may fall behind before it is dropped.
+	subscriberBuffer = 256
+	// maxLines bounds the status lines kept per running job, like the log of a run.
+	maxLines = 10000
+)
+
+// Event is a step of the progress of a job.
+type Event struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// Hub tracks the running jobs. It is a queue.Observer.
+type Hub struct {
+	mu   sync.Mutex
+	live map[string]*liveJob
+}
+
+type liveJob struct {
+	rec   *history.Recorder
+	lines []string
+	subs  map[chan Event]bool
+}
+
+// NewHub creates a hub without running jobs.
+func NewHub() *Hub {
+	return &Hub{live: map[string]*liveJob{}}
+}
+
+// Started tracks the job until it finishes.
+func (h *Hub) Started(job *queue.Job, rec *history.Recorder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.live[job.ID] = &liveJob{rec: rec, subs: map[chan Event]bool{}}
+}
+
+// Status sends the line to the subscribers of the job.
+func (h *Hub) Status(job *queue.Job, line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	live, ok := h.live[job.ID]
+	if !ok {
+		return
+	}
+	if len(live.lines) < maxLines {
+		live.lines = append(live.lines, line)
+	}
+	h.send(live, Event{Type: EventStatus, Data: line})
+}
+
+// Finished sends the outcome of the run to the subscribers of the job, and ends their streams.
+func (h *Hub) Finished(job *queue.Job, run *history.Run) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	live, ok := h.live[job.ID]
+	if !ok {
+		return
+	}
+	h.send(live, Event{Type: EventEnd, Data: run.Status})
+	for sub := range live.subs {
+		delete(live.subs, sub)
+		close(sub)
+	}
+	delete(h.live, job.ID)
+}
+
+// Running returns the record so far of the job if it is running.
+func (h *Hub) Running(id string) (*history.Run, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	live, ok := h.live[id]
+	if !ok {
+		return nil, false
+	}
+	return live.rec.Run(), true
+}
+
+// Subscribe returns the lines already emitted by the running job and a channel of its next events,
+// which is closed after the end of the run. It returns false if the job is not running.
+// The caller must call cancel when it stops reading.
+func (h *Hub) Subscribe(id string) (backlog []string, events <-chan Event, cancel func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	live, ok := h.live[id]
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	sub := make(chan Event, subscriberBuffer)
+	live.subs[sub] = true
+	cancel = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if live.subs[sub] {
+			delete(live.subs, sub)
+			close(sub)
+		}
+	}
+	return append([]string(nil), live.lines...), sub, cancel, true
+}
+
+// send delivers the event without blocking the pipeline, dropping the subscribers too slow to keep up.
+// The last slot of the buffer of a subscriber is kept for the end event telling it was dropped.
+func (h *Hub) send(live *liveJob, ev Event) {
+	for sub := range live.subs {
+		if ev.Type == EventEnd || len(sub) < cap(sub)-1 {
+			sub <- ev
+			continue
+		}
+		sub <- Event{Type: EventEnd, Data: Dropped}
+		delete(live.subs, sub)
+		close(sub)
+	}
+}
@@ -0,0 +1,144 @@
+package status
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alligrader/jobs"
+	"github.com/alligrader/jobs/history"
+	"github.com/alligrader/jobs/queue"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeJobs is a Jobs backed by a map.
+type fakeJobs map[string]*queue.Job
+
+func (f fakeJobs) Get(id string) (*queue.Job, error) {
+	return f[id], nil
+}
+
+func (f fakeJobs) List(states ...queue.State) ([]*queue.Job, error) {
+	var list []*queue.Job
+	for _, job := range f {
+		list = append(list, job)
+	}
+	return list, nil
+}
+
+func TestHandler(t *testing.T) {
+	spec, err := jobs.ParseJobSpec([]byte("name: hw1\nstages: [{name: test, steps: [{type: command, params: {name: tests, command: 'true'}}]}]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		job = &queue.Job{ID: "d1", Spec: "hw1.yml", State: queue.Running, KeyVal: map[string]interface{}{"OWNER": "cs101", "REPO": "hw1-bob", "SHA": "abc"}}
+		hub = NewHub()
+		rec = history.NewRecorder(job.ID, 1, job.Spec, spec, job.KeyVal)
+	)
+	rec.Wrap("test", spec.Stages[0].Steps[0], jobs.NewSeedStep(nil))
+	hub.Started(job, rec)
+	hub.Status(job, "Compiling...")
+
+	server := httptest.NewServer(NewHandler(hub, fakeJobs{job.ID: job}, nil, logrus.New()))
+	defer server.Close()
+
+	var status JobStatus
+	resp, err := http.Get(server.URL + "/jobs/d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.State != StateRunning || len(status.Steps) != 1 || status.Steps[0].Name != "tests" || status.Steps[0].Status != history.StepPending {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	var listed []JobStatus
+	resp, err = http.Get(server.URL + "/jobs?repo=hw1-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].ID != "d1" {
+		t.Errorf("expected the job of hw1-bob, observed %+v", listed)
+	}
+
+	resp, err = http.Get(server.URL + "/jobs/d1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %v", ct)
+	}
+
+	// Wait for the stream to subscribe before emitting more lines.
+	go func() {
+		for i := 0; i < 100; i++ {
+			hub.mu.Lock()
+			subscribed := len(hub.live[job.ID].subs) > 0
+			hub.mu.Unlock()
+			if subscribed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		hub.Status(job, "Running tests...\n3 passed")
+		hub.Finished(job, rec.Finish(nil, nil))
+	}()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			events = append(events, line)
+		}
+	}
+	expected := []string{
+		"event: status", "data: Compiling...",
+		"event: status", "data: Running tests...", "data: 3 passed",
+		"event: end", "data: passed",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the events\n%v\nobserved\n%v", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+	}
+
+	if _, ok := hub.Running(job.ID); ok {
+		t.Error("expected the job to be finished")
+	}
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	job := &queue.Job{ID: "d2", Spec: "hw1.yml"}
+	hub := NewHub()
+	hub.Started(job, history.NewRecorder(job.ID, 1, job.Spec, &jobs.JobSpec{Name: "hw1"}, nil))
+	_, events, cancel, ok := hub.Subscribe(job.ID)
+	if !ok {
+		t.Fatal("expected the job to be running")
+	}
+	defer cancel()
+
+	for i := 0; i < maxLines+10; i++ {
+		hub.Status(job, "line")
+	}
+	if lines := len(hub.live[job.ID].lines); lines != maxLines {
+		t.Errorf("expected %v lines to be kept, observed %v", maxLines, lines)
+	}
+
+	var last Event
+	received := 0
+	for ev := range events {
+		last = ev
+		received++
+	}
+	if received != subscriberBuffer || last.Type != EventEnd || last.Data != Dropped {
+		t.Errorf("expected %v events ending with a dropped end event, observed %v ending with %+v", subscriberBuffer, received, last)
+	}
+}
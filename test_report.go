@@ -0,0 +1,101 @@
+package jobs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formats of the test results a CommandStep reads, see CommandStep.Tests.
+const (
+	TestsTAP   = "tap"
+	TestsJUnit = "junit"
+)
+
+// tapLine matches a test line of TAP output, e.g. "not ok 2 - subtracts # TODO".
+var tapLine = regexp.MustCompile(`^(not )?ok\b\s*(\d*)\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+).*)?$`)
+
+// ParseTAP decodes the results of the tests in Test Anything Protocol output. A test skipped or marked
+// TODO passes, as in TAP, and the diagnostics following a test become its Output.
+func ParseTAP(output string) ([]TestResult, error) {
+	var tests []TestResult
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "Bail out!") {
+			return tests, fmt.Errorf("tests bailed out: %v", strings.TrimSpace(strings.TrimPrefix(trimmed, "Bail out!")))
+		}
+		match := tapLine.FindStringSubmatch(line)
+		if match == nil {
+			// Diagnostics and YAML blocks of the last test
+			if n := len(tests); n > 0 && trimmed != "" && !strings.HasPrefix(line, "1..") {
+				tests[n-1].Output += strings.TrimPrefix(trimmed, "# ") + "\n"
+			}
+			continue
+		}
+		name := match[3]
+		if name == "" {
+			name = "test " + match[2]
+			if match[2] == "" {
+				name = "test " + strconv.Itoa(len(tests)+1)
+			}
+		}
+		directive := strings.ToUpper(match[4])
+		tests = append(tests, TestResult{
+			Name:   name,
+			Passed: match[1] == "" || directive == "SKIP" || directive == "TODO",
+		})
+	}
+	return tests, nil
+}
+
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// ParseJUnit decodes the results of the tests in a JUnit XML report, whose root is either a testsuite
+// or testsuites, as written by Maven Surefire, Gradle or Ant. Skipped tests are left out.
+func ParseJUnit(report []byte) ([]TestResult, error) {
+	var suite junitSuite
+	if err := xml.Unmarshal(report, &suite); err != nil {
+		return nil, err
+	}
+	return suite.results(nil), nil
+}
+
+func (s junitSuite) results(tests []TestResult) []TestResult {
+	for _, c := range s.Cases {
+		if c.Skipped != nil {
+			continue
+		}
+		test := TestResult{Name: c.Name, Passed: c.Failure == nil && c.Error == nil}
+		if c.Classname != "" {
+			test.Name = c.Classname + "." + c.Name
+		}
+		for _, failure := range []*junitFailure{c.Failure, c.Error} {
+			if failure != nil {
+				test.Output += strings.TrimSpace(failure.Message+"\n"+failure.Text) + "\n"
+			}
+		}
+		tests = append(tests, test)
+	}
+	for _, suite := range s.Suites {
+		tests = suite.results(tests)
+	}
+	return tests
+}
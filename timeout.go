@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/RobbieMcKinstry/pipeline"
+)
+
+// abandonAfter is how long a timed out step has to return once cancelled, before it is left behind.
+const abandonAfter = CancelGracePeriod + time.Second
+
+type timeoutKey struct{}
+
+// WithJobTimeout returns a context for running a job which expires after the timeout, if not zero.
+// A job run by RunContext under this context fails with a *TimeoutError once it expires.
+func WithJobTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return context.WithValue(ctx, timeoutKey{}, timeout), cancel
+}
+
+// RunContext runs the pipeline like RunWithStatus, and cancels its steps once the context is done.
+// Its steps get the context if they are ContextSteps.
+func RunContext(ctx context.Context, workpipe *pipeline.Pipeline, status func(line string)) *pipeline.Result {
+	for _, stage := range workpipe.Stages {
+		for _, step := range stage.Steps {
+			SetContext(step, ctx)
+		}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			workpipe.Cancel()
+		case <-stop:
+		}
+	}()
+
+	res := RunWithStatus(workpipe, status)
+	close(stop)
+
+	timeout, ok := ctx.Value(timeoutKey{}).(time.Duration)
+	if ok && ctx.Err() == context.DeadlineExceeded && (res == nil || res.Error != nil) {
+		timedOut := &pipeline.Result{Error: &TimeoutError{Timeout: timeout}}
+		if res != nil {
+			timedOut.KeyVal = res.KeyVal
+		}
+		return timedOut
+	}
+	return res
+}
+
+// TimeoutStep runs a step under a timeout. Once it expires, the step is cancelled and TimeoutStep
+// fails with a *TimeoutError. A ContextStep also gets the deadline through its context.
+type TimeoutStep struct {
+	pipeline.Step
+	name    string
+	timeout time.Duration
+	jobContext
+}
+
+// NewTimeoutStep limits the step, named name in its TimeoutError, to the timeout.
+func NewTimeoutStep(step pipeline.Step, name string, timeout time.Duration) *TimeoutStep {
+	return &TimeoutStep{Step: step, name: name, timeout: timeout}
+}
+
+// Exec runs the wrapped step. Should be run by the pipeline, not directly.
+func (t *TimeoutStep) Exec(request *pipeline.Request) *pipeline.Result {
+	ctx, cancel := context.WithTimeout(t.jobCtx(), t.timeout)
+	defer cancel()
+	SetContext(t.Step, ctx)
+
+	done := make(chan *pipeline.Result, 1)
+	go func() {
+		done <- t.Step.Exec(request)
+	}()
+
+	select {
+	case res := <-done:
+		if ctx.Err() != context.DeadlineExceeded || (res != nil && res.Error == nil) {
+			return res
+		}
+	case <-ctx.Done():
+		t.Step.Cancel()
+		select {
+		case <-done:
+		case <-time.After(abandonAfter):
+			// The step ignores cancellation: leave it running rather than hang the job
+		}
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		// The job was cancelled rather than timed out
+		return &pipeline.Result{Error: ErrCancelled}
+	}
+	return &pipeline.Result{Error: &TimeoutError{Step: t.name, Timeout: t.timeout}}
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestTimeouts(t *testing.T) {
+	var cases = []struct {
+		spec string
+		step string
+		job  time.Duration
+	}{
+		{"name: hw1\nstages: [{name: test, steps: [{type: command, timeout: 200ms, params: {name: loop, command: 'sleep 30'}}]}]", "loop", 0},
+		{"name: hw1\ntimeout: 200ms\nstages: [{name: test, steps: [{type: command, params: {name: loop, command: 'sleep 30'}}]}]", "", 200 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		spec, err := ParseJobSpec([]byte(c.spec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		workpipe, err := spec.Pipeline(logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := WithJobTimeout(context.Background(), spec.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		res := RunContext(ctx, workpipe, nil)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the job to stop at its timeout, observed it ran for %v", elapsed)
+		}
+		timeoutErr, ok := res.Error.(*TimeoutError)
+		if !ok || !IsTimeout(res.Error) || IsStudentError(res.Error) {
+			t.Fatalf("expected a timeout, observed %v", res.Error)
+		}
+		if timeoutErr.Step != c.step || (c.job != 0 && timeoutErr.Timeout != c.job) {
+			t.Errorf("unexpected timeout %+v", timeoutErr)
+		}
+	}
+
+	if _, err := ParseJobSpec([]byte("name: hw1\nstages: [{name: test, steps: [{type: command, timeout: -1s, params: {command: 'true'}}]}]")); err == nil {
+		t.Error("expected a negative timeout to be rejected")
+	}
+}
@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/RobbieMcKinstry/pipeline"
+	"github.com/alligrader/jobs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The attributes of the spans, besides those of OpenTelemetry's conventions.
+const (
+	AttrJob     = attribute.Key("alligrader.job")
+	AttrAttempt = attribute.Key("alligrader.attempt")
+	AttrOwner   = attribute.Key("alligrader.owner")
+	AttrRepo    = attribute.Key("alligrader.repo")
+	AttrSHA     = attribute.Key("alligrader.sha")
+	AttrStage   = attribute.Key("alligrader.stage")
+	AttrType    = attribute.Key("alligrader.step.type")
+	AttrOutcome = attribute.Key("alligrader.outcome")
+)
+
+// Job traces a run of a job. Its root span has a child span per stage, each having a span per step.
+type Job struct {
+	tracer trace.Tracer
+	ctx    context.Context
+	span   trace.Span
+
+	mu     sync.Mutex
+	stages map[string]*stageSpan
+}
+
+type stageSpan struct {
+	ctx  context.Context
+	span trace.Span
+	// left is the number of steps of the stage not yet finished
+	left int
+}
+
+// StartJob starts the trace of a run of the job named name, with the OWNER, REPO, and SHA of the KeyVal as attributes.
+func StartJob(ctx context.Context, name string, keyVal map[string]interface{}, attrs ...attribute.KeyValue) *Job {
+	for key, attr := range map[string]attribute.Key{"OWNER": AttrOwner, "REPO": AttrRepo, "SHA": AttrSHA} {
+		if val, ok := keyVal[key].(string); ok && val != "" {
+			attrs = append(attrs, attr.String(val))
+		}
+	}
+
+	tracer := otel.Tracer(jobs.TracerName)
+	ctx, span := tracer.Start(ctx, name, trace.WithNewRoot(), trace.WithAttributes(attrs...))
+	return &Job{tracer: tracer, ctx: ctx, span: span, stages: map[string]*stageSpan{}}
+}
+
+// Context returns the context of the root span of the job.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Wrap traces the step, and gives the context of its span to the step if it is a jobs.ContextStep.
+// It is a jobs.StepWrapper, and must wrap the step directly, before any other wrapper.
+func (j *Job) Wrap(stage string, spec jobs.StepSpec, step pipeline.Step) pipeline.Step {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stages[stage] == nil {
+		j.stages[stage] = &stageSpan{}
+	}
+	j.stages[stage].left++
+	return jobs.Use(spec.Name(), step, j.trace(stage, spec.Type))
+}
+
+// End ends the spans of the stages which did not finish, then the root span, recording the error if any.
+func (j *Job) End(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, stage := range j.stages {
+		if stage.span != nil && stage.left > 0 {
+			stage.span.End()
+		}
+	}
+	endSpan(j.span, err)
+}
+
+// enterStage returns the context of the span of the stage, starting it with the first step of the stage.
+func (j *Job) enterStage(stage string) context.Context {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.stages[stage]
+	if s.span == nil {
+		s.ctx, s.span = j.tracer.Start(j.ctx, stage, trace.WithAttributes(AttrStage.String(stage)))
+	}
+	return s.ctx
+}
+
+// leaveStage ends the span of the stage with its last step.
+func (j *Job) leaveStage(stage string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.stages[stage]
+	if s.left--; s.left == 0 {
+		s.span.End()
+	}
+}
+
+// trace runs the steps of a stage, of the type, in a span.
+func (j *Job) trace(stage, stepType string) jobs.Middleware {
+	return func(name string, step pipeline.Step, next jobs.ExecFunc) jobs.ExecFunc {
+		return func(request *pipeline.Request) *pipeline.Result {
+			ctx := j.enterStage(stage)
+			defer j.leaveStage(stage)
+
+			ctx, span := j.tracer.Start(ctx, name, trace.WithAttributes(
+				AttrStage.String(stage),
+				AttrType.String(stepType),
+			))
+			jobs.SetContext(step, ctx)
+			res := next(request)
+
+			var err error
+			if res != nil {
+				err = res.Error
+			}
+			endSpan(span, err)
+			return res
+		}
+	}
+}
+
+// endSpan records the outcome of the error, then ends the span.
+func endSpan(span trace.Span, err error) {
+	switch {
+	case err == nil:
+		span.SetAttributes(AttrOutcome.String("ok"))
+	case jobs.IsStudentError(err):
+		// The submission failed, not the grader: the span is not an error
+		span.SetAttributes(AttrOutcome.String("student_failure"))
+		span.RecordError(err)
+	case jobs.IsTimeout(err):
+		span.SetAttributes(AttrOutcome.String("timeout"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(AttrOutcome.String("infra_failure"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,85 @@
+// Package tracing traces the runs of jobs with OpenTelemetry: a trace per run, with a span for each
+// stage and step, and child spans for the commands the steps launch and the requests they send to GitHub.
+//
+// Until Start installs a tracer provider, every span is a no-op.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName is the service.name of the traces.
+const ServiceName = "alligrader"
+
+// The destinations of Start other than a file.
+const (
+	// Stdout writes the spans to the standard output as JSON.
+	Stdout = "-"
+	// OTLP sends the spans to a collector over OTLP/HTTP, configured by the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS environment variables.
+	OTLP = "otlp"
+)
+
+// Start installs a global tracer provider exporting the spans to dest: Stdout, OTLP, or else
+// the path of a file to which the spans are appended as JSON, for offline use.
+// The returned function flushes the spans not yet exported, and must be called before exiting.
+func Start(ctx context.Context, dest string) (shutdown func(context.Context) error, err error) {
+	var (
+		exporter sdktrace.SpanExporter
+		file     io.Closer
+	)
+	switch dest {
+	case "":
+		return nil, fmt.Errorf("no destination for the traces")
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case OTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		var f *os.File
+		if f, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+		file = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// InstrumentTransport wraps the transport so that each request it sends gets a span,
+// a child of the span of the step sending it.
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return fmt.Sprintf("%v %v", r.Method, r.URL.Host)
+	}))
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alligrader/jobs"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testSpec = `
+name: hw1
+stages:
+  - name: build
+    steps:
+      - type: command
+        params: {name: compile, command: echo compiled}
+  - name: test
+    steps:
+      - type: command
+        params: {name: tests, command: exit 1, student: true}
+`
+
+func TestJob(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	spec, err := jobs.ParseJobSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyVal := map[string]interface{}{"OWNER": "cs101", "REPO": "hw1-bob", "SHA": "abc123"}
+	job := StartJob(context.Background(), spec.Name, keyVal, AttrJob.String("d1"))
+	workpipe, err := spec.WrappedPipeline(logrus.New(), job.Wrap, jobs.NewSeedStep(keyVal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := workpipe.Run()
+
+	// A request sent under the job has a span too
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	client := &http.Client{Transport: InstrumentTransport(http.DefaultTransport)}
+	resp, err := client.Do(req.WithContext(job.Context()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	job.End(res.Error)
+
+	var (
+		spans    = map[string]sdktrace.ReadOnlySpan{}
+		commands []sdktrace.ReadOnlySpan
+	)
+	for _, span := range exporter.GetSpans().Snapshots() {
+		spans[span.Name()] = span
+		if span.Name() == "bash" {
+			commands = append(commands, span)
+		}
+	}
+	for _, name := range []string{"hw1", "build", "compile", "bash", "test", "tests", "GET " + req.URL.Host} {
+		if spans[name] == nil {
+			t.Fatalf("expected a span named %q, observed %v", name, spans)
+		}
+	}
+
+	root := spans["hw1"]
+	for child, parent := range map[string]string{
+		"build": "hw1", "compile": "build", "test": "hw1", "tests": "test", "GET " + req.URL.Host: "hw1",
+	} {
+		if spans[child].Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("expected %q to be a child of %q", child, parent)
+		}
+		if spans[child].SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("expected %q to be part of the trace of the job", child)
+		}
+	}
+
+	if len(commands) != 2 || commands[0].Parent().SpanID() != spans["compile"].SpanContext().SpanID() {
+		t.Errorf("expected a span for the command of each step, observed %v", commands)
+	}
+
+	var sha string
+	for _, attr := range root.Attributes() {
+		if attr.Key == AttrSHA {
+			sha = attr.Value.AsString()
+		}
+	}
+	if sha != "abc123" {
+		t.Errorf("expected the SHA as an attribute of the job, observed %v", root.Attributes())
+	}
+
+	// exit 1 is the fault of the submission, not of the grader
+	if status := spans["tests"].Status(); status.Code == codes.Error {
+		t.Errorf("expected a student failure not to be an error, observed %v", status)
+	}
+}
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Route maps the repos of an assignment to the job spec grading them.
+type Route struct {
+	// Repo is a pattern over the full name of the repo, as in path.Match, e.g. "cs101/hw1-*".
+	Repo string `yaml:"repo" json:"repo"`
+	// Spec is the path of the job spec.
+	Spec string `yaml:"spec" json:"spec"`
+	// Events are the events which launch a job, defaults to push and pull_request.
+	Events []string `yaml:"events,omitempty" json:"events,omitempty"`
+}
+
+// Routes are tried in order; the first match wins.
+type Routes []Route
+
+// LoadRoutes reads routes from a YAML or JSON file.
+// Relative spec paths are resolved against the directory of the file.
+//
+//	# routes.yml
+//	- repo: cs101/hw1-*
+//	  spec: specs/hw1.yml
+//	- repo: cs101/hw2-*
+//	  spec: specs/hw2.yml
+//	  events: [push]
+func LoadRoutes(file string) (Routes, error) {
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes Routes
+	if err := yaml.UnmarshalStrict(blob, &routes); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	for i, route := range routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("%v: route %v: %v", file, i+1, err)
+		}
+		if !filepath.IsAbs(route.Spec) {
+			routes[i].Spec = filepath.Join(filepath.Dir(file), route.Spec)
+		}
+	}
+	return routes, nil
+}
+
+// Match returns the first route matching the full name of the repo and the event.
+func (routes Routes) Match(fullName, event string) (Route, bool) {
+	for _, route := range routes {
+		if ok, _ := path.Match(route.Repo, fullName); ok && route.handles(event) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+func (route Route) validate() error {
+	if route.Repo == "" || route.Spec == "" {
+		return fmt.Errorf("both repo and spec are required")
+	}
+	if _, err := path.Match(route.Repo, ""); err != nil {
+		return fmt.Errorf("bad repo pattern %q: %v", route.Repo, err)
+	}
+	for _, event := range route.Events {
+		if event != EventPush && event != EventPullRequest {
+			return fmt.Errorf("unsupported event %q", event)
+		}
+	}
+	return nil
+}
+
+func (route Route) handles(event string) bool {
+	if len(route.Events) == 0 {
+		return true
+	}
+	for _, e := range route.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
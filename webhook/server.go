@@ -0,0 +1,240 @@
+// Package webhook launches grading jobs when students push to GitHub.
+//
+// A Server receives the push and pull_request webhooks of the assignment repos, checks their signature,
+// picks the job spec of the repo from its Routes, and hands a queue.Job to a Queue. The ID of the job
+// is the delivery ID of the webhook, which GitHub keeps when redelivering it. The KeyVal of the job
+// holds the OWNER, REPO and SHA of the graded commit, as read by the steps of package jobs, and the login
+// of who pushed it or opened the pull request as STUDENT.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alligrader/jobs/queue"
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// The events launching jobs.
+const (
+	EventPush        = "push"
+	EventPullRequest = "pull_request"
+)
+
+const (
+	// SignatureHeader holds the HMAC-SHA256 of the payload, keyed with the webhook secret.
+	SignatureHeader = "X-Hub-Signature-256"
+	// DefaultMaxDeliveries is the number of delivery IDs remembered to ignore redeliveries.
+	DefaultMaxDeliveries = 10000
+	// maxPayloadLen is the largest payload GitHub sends.
+	maxPayloadLen = 25 << 20
+)
+
+// Queue accepts the jobs launched by a Server.
+type Queue interface {
+	Enqueue(job *queue.Job) error
+}
+
+// QueueFunc adapts a function to a Queue.
+type QueueFunc func(job *queue.Job) error
+
+// Enqueue calls f(job).
+func (f QueueFunc) Enqueue(job *queue.Job) error {
+	return f(job)
+}
+
+// Server is an http.Handler receiving GitHub webhooks.
+type Server struct {
+	secret []byte
+	routes Routes
+	queue  Queue
+	log    *logrus.Logger
+
+	// MaxDeliveries bounds the number of delivery IDs remembered, defaults to DefaultMaxDeliveries.
+	MaxDeliveries int
+
+	mu         sync.Mutex
+	deliveries map[string]bool
+	order      []string
+}
+
+// NewServer creates a server which enqueues a job for every push or pull request to a repo matching the routes.
+func NewServer(secret []byte, routes Routes, q Queue, logger *logrus.Logger) *Server {
+	return &Server{
+		secret:        secret,
+		routes:        routes,
+		queue:         q,
+		log:           logger,
+		MaxDeliveries: DefaultMaxDeliveries,
+		deliveries:    map[string]bool{},
+	}
+}
+
+// ServeHTTP handles a single webhook delivery.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadLen))
+	if err != nil {
+		http.Error(w, "could not read the payload", http.StatusBadRequest)
+		return
+	}
+	if !ValidSignature(payload, r.Header.Get(SignatureHeader), s.secret) {
+		s.log.Warnf("Rejected a webhook with a bad signature from %v", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		event    = github.WebHookType(r)
+		delivery = github.DeliveryID(r)
+	)
+	if delivery == "" {
+		http.Error(w, "missing delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.newJob(event, delivery, payload)
+	if err != nil {
+		s.log.Warnf("Could not parse the %v webhook %v: %v", event, delivery, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if job == nil {
+		fmt.Fprintf(w, "ignored %v\n", event)
+		return
+	}
+
+	if !s.claim(delivery) {
+		s.log.Infof("Ignored the redelivery of %v", delivery)
+		fmt.Fprintf(w, "already received %v\n", delivery)
+		return
+	}
+	if err := s.queue.Enqueue(job); err != nil {
+		// Forget the delivery, so that GitHub can redeliver it
+		s.release(delivery)
+		s.log.Errorf("Could not enqueue the job for %v: %v", delivery, err)
+		http.Error(w, "could not enqueue the job", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.log.Infof("Enqueued %v for %v/%v@%v", job.Spec, job.KeyVal["OWNER"], job.KeyVal["REPO"], job.KeyVal["SHA"])
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "enqueued %v\n", delivery)
+}
+
+// newJob returns the job launched by the webhook, or nil if the webhook does not launch one.
+func (s *Server) newJob(event, delivery string, payload []byte) (*queue.Job, error) {
+	if event != EventPush && event != EventPullRequest {
+		return nil, nil
+	}
+	parsed, err := github.ParseWebHook(event, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// routed is the assignment repo picking the route, and fullName the repo holding the graded commit
+	// student is who pushed the commit, or opened the pull request
+	var routed, fullName, sha, ref, student string
+	switch e := parsed.(type) {
+	case *github.PushEvent:
+		if e.GetDeleted() || strings.Trim(e.GetAfter(), "0") == "" {
+			return nil, nil
+		}
+		routed, sha, ref = e.GetRepo().GetFullName(), e.GetAfter(), e.GetRef()
+		fullName = routed
+		// The pusher only has a name, which is the login of the sender
+		if student = e.GetSender().GetLogin(); student == "" {
+			student = e.GetPusher().GetName()
+		}
+
+	case *github.PullRequestEvent:
+		switch e.GetAction() {
+		case "opened", "reopened", "synchronize":
+		default:
+			return nil, nil
+		}
+		// The head commit lives in a fork when the pull request comes from one
+		head := e.GetPullRequest().GetHead()
+		routed, sha, ref = e.GetRepo().GetFullName(), head.GetSHA(), head.GetRef()
+		if fullName = head.GetRepo().GetFullName(); fullName == "" {
+			fullName = routed
+		}
+		if student = e.GetPullRequest().GetUser().GetLogin(); student == "" {
+			student = e.GetSender().GetLogin()
+		}
+	}
+
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 || sha == "" {
+		return nil, fmt.Errorf("the %v event names no repo or commit", event)
+	}
+
+	route, ok := s.routes.Match(routed, event)
+	if !ok {
+		s.log.Debugf("No job for %v on %v", event, routed)
+		return nil, nil
+	}
+	job := &queue.Job{
+		ID:    delivery,
+		Event: event,
+		Spec:  route.Spec,
+		KeyVal: map[string]interface{}{
+			"OWNER": parts[0],
+			"REPO":  parts[1],
+			"SHA":   sha,
+			"REF":   ref,
+		},
+		Received: time.Now().UTC(),
+	}
+	if student != "" {
+		job.KeyVal["STUDENT"] = student
+	}
+	return job, nil
+}
+
+// claim records the delivery, returning false if it was already received.
+func (s *Server) claim(delivery string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deliveries[delivery] {
+		return false
+	}
+	s.deliveries[delivery] = true
+	s.order = append(s.order, delivery)
+	for len(s.order) > s.MaxDeliveries && s.MaxDeliveries > 0 {
+		delete(s.deliveries, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+func (s *Server) release(delivery string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deliveries, delivery)
+}
+
+// ValidSignature reports whether header, the value of the X-Hub-Signature-256 header, signs the payload with the secret.
+func ValidSignature(payload []byte, header string, secret []byte) bool {
+	return hmac.Equal([]byte(header), []byte(Sign(payload, secret)))
+}
+
+// Sign returns the X-Hub-Signature-256 header of the payload, as GitHub computes it.
+func Sign(payload []byte, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alligrader/jobs/queue"
+	"github.com/sirupsen/logrus"
+)
+
+const secret = "it's a secret to everybody"
+
+const pushPayload = `{
+	"ref": "refs/heads/master",
+	"after": "d6a5d32f84e346574aded51404010d4ad2817641",
+	"repository": {"name": "hw1-bob", "full_name": "cs101/hw1-bob", "owner": {"name": "cs101"}},
+	"pusher": {"name": "bob", "email": "bob@example.com"},
+	"sender": {"login": "bob"}
+}`
+
+const pullRequestPayload = `{
+	"action": "synchronize",
+	"number": 2,
+	"pull_request": {"user": {"login": "bob"}, "head": {"ref": "fix", "sha": "0a1b2c", "repo": {"full_name": "bob/hw1-bob"}}},
+	"repository": {"full_name": "cs101/hw1-bob"}
+}`
+
+func deliver(s *Server, event, delivery, payload, signature string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(payload))
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-GitHub-Delivery", delivery)
+	r.Header.Set(SignatureHeader, signature)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServer(t *testing.T) {
+	var (
+		jobs   []*queue.Job
+		routes = Routes{
+			{Repo: "cs101/hw1-*", Spec: "hw1.yml"},
+			{Repo: "cs101/hw2-*", Spec: "hw2.yml", Events: []string{EventPush}},
+		}
+		server = NewServer([]byte(secret), routes, QueueFunc(func(job *queue.Job) error {
+			jobs = append(jobs, job)
+			return nil
+		}), logrus.New())
+	)
+
+	if w := deliver(server, "push", "1", pushPayload, "sha256=00"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a bad signature to be rejected, observed %v", w.Code)
+	}
+
+	if w := deliver(server, "push", "1", pushPayload, Sign([]byte(pushPayload), []byte(secret))); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the push to be accepted, observed %v: %v", w.Code, w.Body)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("expected a job, observed %v", len(jobs))
+	}
+	job := jobs[0]
+	if job.ID != "1" || job.Spec != "hw1.yml" || job.KeyVal["OWNER"] != "cs101" || job.KeyVal["REPO"] != "hw1-bob" || job.KeyVal["SHA"] != "d6a5d32f84e346574aded51404010d4ad2817641" || job.KeyVal["STUDENT"] != "bob" {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	// A redelivery keeps its delivery ID and does not launch a second job.
+	if w := deliver(server, "push", "1", pushPayload, Sign([]byte(pushPayload), []byte(secret))); w.Code != http.StatusOK {
+		t.Errorf("expected the redelivery to be acknowledged, observed %v", w.Code)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("expected the redelivery to be ignored, observed %v jobs", len(jobs))
+	}
+
+	if w := deliver(server, "pull_request", "2", pullRequestPayload, Sign([]byte(pullRequestPayload), []byte(secret))); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the pull request to be accepted, observed %v: %v", w.Code, w.Body)
+	}
+	if job := jobs[len(jobs)-1]; job.KeyVal["OWNER"] != "bob" || job.KeyVal["SHA"] != "0a1b2c" || job.KeyVal["STUDENT"] != "bob" || job.Spec != "hw1.yml" {
+		t.Errorf("expected the fork's head commit to be graded, observed %+v", job)
+	}
+
+	for _, c := range []struct{ event, payload string }{
+		{"ping", `{"zen": "Keep it logically awesome."}`},
+		{"push", `{"after": "abc", "repository": {"full_name": "cs101/lab-bob"}}`},
+		{"push", `{"deleted": true, "after": "0000000000000000000000000000000000000000", "repository": {"full_name": "cs101/hw1-bob"}}`},
+		{"pull_request", `{"action": "synchronize", "pull_request": {"head": {"sha": "abc"}}, "repository": {"full_name": "cs101/hw2-bob"}}`},
+	} {
+		if w := deliver(server, c.event, "3", c.payload, Sign([]byte(c.payload), []byte(secret))); w.Code != http.StatusOK {
+			t.Errorf("expected %v to be ignored, observed %v", c.payload, w.Code)
+		}
+	}
+	if len(jobs) != 2 {
+		t.Errorf("expected 2 jobs, observed %v", len(jobs))
+	}
+}
+
+func TestServerQueueFailure(t *testing.T) {
+	var (
+		fail   = true
+		server = NewServer([]byte(secret), Routes{{Repo: "cs101/*", Spec: "hw1.yml"}}, QueueFunc(func(job *queue.Job) error {
+			if fail {
+				return errors.New("queue is down")
+			}
+			return nil
+		}), logrus.New())
+		signature = Sign([]byte(pushPayload), []byte(secret))
+	)
+
+	if w := deliver(server, "push", "1", pushPayload, signature); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a failure, observed %v", w.Code)
+	}
+	fail = false
+	if w := deliver(server, "push", "1", pushPayload, signature); w.Code != http.StatusAccepted {
+		t.Errorf("expected the redelivery of a failed delivery to be accepted, observed %v", w.Code)
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes.yml")
+	ioutil.WriteFile(path, []byte("- repo: cs101/hw1-*\n  spec: specs/hw1.yml\n- repo: cs101/*\n  spec: /specs/default.yml\n  events: [push]\n"), 0644)
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if route, ok := routes.Match("cs101/hw1-bob", EventPullRequest); !ok || route.Spec != filepath.Join(dir, "specs/hw1.yml") {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if route, ok := routes.Match("cs101/lab-bob", EventPush); !ok || route.Spec != "/specs/default.yml" {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if _, ok := routes.Match("cs101/lab-bob", EventPullRequest); ok {
+		t.Error("expected no route for a pull request to cs101/lab-bob")
+	}
+
+	ioutil.WriteFile(path, []byte("- repo: cs101/*\n  spec: hw1.yml\n  events: [issues]\n"), 0644)
+	if _, err := LoadRoutes(path); err == nil {
+		t.Error("expected an error for an unsupported event")
+	}
+}
+
+func TestServerStudent(t *testing.T) {
+	var (
+		jobs   []*queue.Job
+		server = NewServer([]byte(secret), Routes{{Repo: "cs101/*", Spec: "hw1.yml"}}, QueueFunc(func(job *queue.Job) error {
+			jobs = append(jobs, job)
+			return nil
+		}), logrus.New())
+	)
+
+	for i, c := range []struct{ payload, student string }{
+		{`{"after": "abc", "repository": {"full_name": "cs101/hw1-bob"}, "pusher": {"name": "bob"}}`, "bob"},
+		{`{"after": "abc", "repository": {"full_name": "cs101/hw1-bob"}, "pusher": {"name": "ta"}, "sender": {"login": "carol"}}`, "carol"},
+		{`{"after": "abc", "repository": {"full_name": "cs101/hw1-bob"}}`, ""},
+	} {
+		if w := deliver(server, "push", fmt.Sprint(i), c.payload, Sign([]byte(c.payload), []byte(secret))); w.Code != http.StatusAccepted {
+			t.Fatalf("expected the push to be accepted, observed %v: %v", w.Code, w.Body)
+		}
+		student, ok := jobs[len(jobs)-1].KeyVal["STUDENT"]
+		if c.student == "" && ok || c.student != "" && student != c.student {
+			t.Errorf("%v: expected the student %q, observed %v", c.payload, c.student, student)
+		}
+	}
+}